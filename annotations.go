@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxDiagnosticLines bounds how many continuation lines are folded into a
+// single wrapped warning or error message.
+const maxDiagnosticLines = 20
+
+// diagnosticPrefixes maps the prefixes Ansible prints in front of errors and
+// warnings to their diagnostic kind. "ERROR!" is the format before
+// ansible-core 2.19, "[ERROR]:" the one after.
+var diagnosticPrefixes = []struct {
+	prefix string
+	kind   string
+}{
+	{"[DEPRECATION WARNING]:", diagnosticDeprecation},
+	{"[WARNING]:", diagnosticWarning},
+	{"[ERROR]:", diagnosticError},
+	{"ERROR!", diagnosticError},
+}
+
+// errorLocation matches the location hint of pre-2.19 syntax errors, e.g.
+// "The error appears to be in '/src/site.yml': line 4, column 7, but may".
+var errorLocation = regexp.MustCompile(`The error appears to be in '([^']+)': line (\d+), column (\d+)`)
+
+// errorOrigin matches the location hint of ansible-core 2.19+ errors, e.g.
+// "Origin: /src/site.yml:4:7".
+var errorOrigin = regexp.MustCompile(`^Origin: (.+):(\d+):(\d+)$`)
+
+// diagnosticParser extracts errors and warnings from Ansible's stderr. Ansible
+// wraps long messages over several lines, so continuation lines are folded
+// into the pending message until a blank line or the next prefix.
+type diagnosticParser struct {
+	report   *runReport
+	pending  *diagnostic
+	lines    int
+	skipping bool
+}
+
+// newDiagnosticParser returns a diagnosticParser recording into report.
+func newDiagnosticParser(report *runReport) *diagnosticParser {
+	return &diagnosticParser{report: report}
+}
+
+// handleLine processes a single line of Ansible's stderr.
+func (p *diagnosticParser) handleLine(raw string) {
+	clean := stripANSI(raw)
+	p.report.appendTail(clean)
+	line := strings.TrimSpace(clean)
+
+	for _, dp := range diagnosticPrefixes {
+		if rest, ok := strings.CutPrefix(line, dp.prefix); ok {
+			p.flush()
+			msg := strings.TrimSpace(rest)
+			// ansible-core 2.19+ also prints failed task results as errors;
+			// those are already reported from the task result itself.
+			if dp.kind == diagnosticError && strings.HasPrefix(msg, "Task failed:") {
+				p.skipping = true
+				return
+			}
+			p.pending = &diagnostic{Kind: dp.kind, Msg: msg}
+			return
+		}
+	}
+	if p.skipping {
+		if line == "" {
+			p.skipping = false
+		}
+		return
+	}
+	if m := errorLocation.FindStringSubmatch(line); m != nil {
+		p.flush()
+		p.locate(m[1], m[2], m[3])
+		return
+	}
+	if m := errorOrigin.FindStringSubmatch(line); m != nil {
+		p.flush()
+		p.locate(m[1], m[2], m[3])
+		return
+	}
+	if line == "" {
+		p.flush()
+		return
+	}
+	if p.pending != nil && p.lines < maxDiagnosticLines {
+		p.pending.Msg += " " + line
+		p.lines++
+	}
+}
+
+// Flush records a pending message. It is called after every attempt.
+func (p *diagnosticParser) Flush() {
+	p.flush()
+	p.skipping = false
+}
+
+// flush records the pending message, if any.
+func (p *diagnosticParser) flush() {
+	if p.pending == nil {
+		return
+	}
+	if p.pending.Msg != "" {
+		p.report.recordDiagnostic(*p.pending)
+	}
+	p.pending = nil
+	p.lines = 0
+}
+
+// locate attaches a parsed file location to the most recent error.
+func (p *diagnosticParser) locate(file, line, col string) {
+	l, _ := strconv.Atoi(line)
+	c, _ := strconv.Atoi(col)
+	p.report.locateLastError(file, l, c)
+}
+
+// writeAnnotations emits ::error and ::warning workflow commands for Ansible
+// errors, failed tasks, tasks that are not idempotent or drifted, unreachable
+// hosts and warnings, so they show up on the workflow run page and — when
+// Ansible names a file — next to the offending line. If the run failed without
+// any of those, execErr itself is reported.
+func writeAnnotations(w io.Writer, report *runReport, execErr error) {
+	errorsWritten := 0
+	for _, d := range report.diagnosticsOf(diagnosticRequirements) {
+		writeAnnotation(w, "error", "Invalid Galaxy requirements", d.File, d.Line, d.Col, d.Msg)
+		errorsWritten++
+	}
+	for _, d := range report.diagnosticsOf(diagnosticError) {
+		writeAnnotation(w, "error", "Ansible error", d.File, d.Line, d.Col, d.Msg)
+		errorsWritten++
+	}
+	for _, f := range report.failedTasks() {
+		file, line := splitTaskPath(f.Path)
+		title := fmt.Sprintf("Task failed: %s (%s)", f.Task, f.Host)
+		if f.Item != "" {
+			title = fmt.Sprintf("Task failed: %s (%s, item=%s)", f.Task, f.Host, f.Item)
+		}
+		writeAnnotation(w, "error", title, file, line, 0, f.Msg)
+		errorsWritten++
+	}
+	changes, _ := report.idempotence()
+	for _, ch := range changes {
+		writeChangeAnnotation(w, "error", "Not idempotent", ch, "Task reported a change on the second run")
+		errorsWritten++
+	}
+	drift, _ := report.drift()
+	driftFails := errors.Is(execErr, ErrDriftDetected)
+	for _, ch := range drift {
+		if driftFails {
+			writeChangeAnnotation(w, "error", "Drift", ch, "Check mode reported a change")
+			errorsWritten++
+		} else {
+			writeChangeAnnotation(w, "warning", "Drift", ch, "Check mode reported a change")
+		}
+	}
+	errs := report.unreachableErrors()
+	for _, host := range report.unreachableHosts() {
+		writeAnnotation(w, "error", "Host unreachable: "+host, "", 0, 0, errs[host])
+		errorsWritten++
+	}
+	if execErr != nil && errorsWritten == 0 {
+		writeAnnotation(w, "error", "Ansible playbook failed", "", 0, 0, execErr.Error())
+	}
+	for _, d := range report.diagnosticsOf(diagnosticWarning, diagnosticDeprecation) {
+		title := "Ansible warning"
+		if d.Kind == diagnosticDeprecation {
+			title = "Ansible deprecation warning"
+		}
+		writeAnnotation(w, "warning", title, "", 0, 0, d.Msg)
+	}
+}
+
+// writeChangeAnnotation annotates a task that reported an unexpected change,
+// pointing at the task's file and line when known.
+func writeChangeAnnotation(w io.Writer, level, prefix string, ch taskChange, msg string) {
+	file, line := splitTaskPath(ch.Path)
+	title := fmt.Sprintf("%s: %s", prefix, ch.Host)
+	if ch.Task != "" {
+		title = fmt.Sprintf("%s: %s (%s)", prefix, ch.Task, ch.Host)
+	}
+	writeAnnotation(w, level, title, file, line, 0, msg)
+}
+
+// writeAnnotation writes a single workflow command. file, line and col are
+// optional.
+func writeAnnotation(w io.Writer, level, title, file string, line, col int, msg string) {
+	props := []string{"title=" + escapeWorkflowProperty(title)}
+	if file != "" {
+		props = append(props, "file="+escapeWorkflowProperty(annotationPath(file)))
+		if line > 0 {
+			props = append(props, "line="+strconv.Itoa(line))
+		}
+		if col > 0 {
+			props = append(props, "col="+strconv.Itoa(col))
+		}
+	}
+	if msg == "" {
+		msg = title
+	}
+	_, _ = fmt.Fprintf(w, "::%s %s::%s\n", level, strings.Join(props, ","), escapeWorkflowData(msg))
+}
+
+// escapeWorkflowProperty escapes a workflow command property value.
+func escapeWorkflowProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+// annotationPath makes an absolute path relative to the workspace, which is
+// what GitHub needs to link an annotation to a file in the repository.
+func annotationPath(path string) string {
+	if !filepath.IsAbs(path) {
+		return path
+	}
+	base := os.Getenv("GITHUB_WORKSPACE")
+	if base == "" {
+		var err error
+		if base, err = os.Getwd(); err != nil {
+			return path
+		}
+	}
+	rel, err := filepath.Rel(base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return rel
+}
+
+// splitTaskPath splits a task path as reported by Ansible ("site.yml:12")
+// into file and line.
+func splitTaskPath(path string) (string, int) {
+	i := strings.LastIndex(path, ":")
+	if i < 0 {
+		return path, 0
+	}
+	line, err := strconv.Atoi(path[i+1:])
+	if err != nil {
+		return path, 0
+	}
+	return path[:i], line
+}
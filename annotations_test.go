@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func parseDiagnostics(lines ...string) *runReport {
+	report := newRunReport()
+	p := newDiagnosticParser(report)
+	for _, line := range lines {
+		p.handleLine(line)
+	}
+	p.Flush()
+	return report
+}
+
+func TestDiagnosticParser_LegacySyntaxError(t *testing.T) {
+	report := parseDiagnostics(
+		"ERROR! conflicting action statements: debug, command",
+		"",
+		"The error appears to be in '/github/workspace/site.yml': line 4, column 7, but may",
+		"be elsewhere in the file depending on the exact syntax problem.",
+		"",
+		"The offending line appears to be:",
+	)
+	errs := report.diagnosticsOf(diagnosticError)
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %+v", errs)
+	}
+	want := diagnostic{Kind: diagnosticError, Msg: "conflicting action statements: debug, command", File: "/github/workspace/site.yml", Line: 4, Col: 7, Count: 1}
+	if errs[0] != want {
+		t.Errorf("expected %+v, got %+v", want, errs[0])
+	}
+}
+
+func TestDiagnosticParser_OriginSyntaxError(t *testing.T) {
+	report := parseDiagnostics(
+		"[ERROR]: conflicting action statements: debug, command",
+		"Origin: /src/site.yml:12:3",
+		"",
+		"12 - name: broken",
+		"     ^ column 3",
+	)
+	errs := report.diagnosticsOf(diagnosticError)
+	if len(errs) != 1 || errs[0].File != "/src/site.yml" || errs[0].Line != 12 || errs[0].Col != 3 {
+		t.Fatalf("unexpected errors: %+v", errs)
+	}
+}
+
+func TestDiagnosticParser_SkipsTaskFailedErrors(t *testing.T) {
+	report := parseDiagnostics(
+		"ERROR! earlier error without location",
+		"",
+		"[ERROR]: Task failed: Module failed: boom",
+		"Origin: /src/site.yml:5:7",
+		"",
+	)
+	errs := report.diagnosticsOf(diagnosticError)
+	if len(errs) != 1 || errs[0].File != "" {
+		t.Fatalf("expected the task failure and its origin to be skipped, got %+v", errs)
+	}
+}
+
+func TestDiagnosticParser_WarningsDeduplicated(t *testing.T) {
+	report := parseDiagnostics(
+		"\x1b[1;35m[WARNING]: Could not match supplied host pattern, ignoring:\x1b[0m",
+		"\x1b[1;35mwebservers\x1b[0m",
+		"",
+		"[WARNING]: Could not match supplied host pattern, ignoring: webservers",
+		"[DEPRECATION WARNING]: The 'foo' option is deprecated. This feature will be",
+		"removed in version 2.24.",
+	)
+	warnings := report.diagnosticsOf(diagnosticWarning, diagnosticDeprecation)
+	if len(warnings) != 2 {
+		t.Fatalf("expected 2 distinct warnings, got %+v", warnings)
+	}
+	if warnings[0].Msg != "Could not match supplied host pattern, ignoring: webservers" || warnings[0].Count != 2 {
+		t.Errorf("expected wrapped warning folded and counted twice, got %+v", warnings[0])
+	}
+	if warnings[1].Kind != diagnosticDeprecation || !strings.HasSuffix(warnings[1].Msg, "removed in version 2.24.") {
+		t.Errorf("unexpected deprecation: %+v", warnings[1])
+	}
+}
+
+func TestWriteAnnotations(t *testing.T) {
+	t.Setenv("GITHUB_WORKSPACE", "/github/workspace")
+	report := newRunReport()
+	report.recordDiagnostic(diagnostic{Kind: diagnosticError, Msg: "syntax", File: "/github/workspace/roles/web/tasks/main.yml", Line: 3, Col: 5})
+	report.recordFailure(taskFailure{Host: "web1", Task: "Install, configure", Path: "/github/workspace/site.yml:12", Msg: "100% broken\nsecond line"})
+	report.recordStats("db1", hostStats{Unreachable: 1})
+	report.recordUnreachable("db1", "ssh timeout")
+	report.recordDiagnostic(diagnostic{Kind: diagnosticDeprecation, Msg: "old option"})
+
+	var out bytes.Buffer
+	writeAnnotations(&out, report, errors.New("exit 2"))
+	got := out.String()
+	for _, want := range []string{
+		"::error title=Ansible error,file=roles/web/tasks/main.yml,line=3,col=5::syntax\n",
+		"::error title=Task failed%3A Install%2C configure (web1),file=site.yml,line=12::100%25 broken%0Asecond line\n",
+		"::error title=Host unreachable%3A db1::ssh timeout\n",
+		"::warning title=Ansible deprecation warning::old option\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in annotations, got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "Ansible playbook failed") {
+		t.Errorf("expected no generic error when specific errors exist, got:\n%s", got)
+	}
+}
+
+func TestWriteAnnotations_GenericFailure(t *testing.T) {
+	var out bytes.Buffer
+	writeAnnotations(&out, newRunReport(), errors.New("playbook file does not exist"))
+	if got := out.String(); got != "::error title=Ansible playbook failed::playbook file does not exist\n" {
+		t.Errorf("unexpected annotation: %q", got)
+	}
+}
+
+func TestWriteAnnotations_NotIdempotent(t *testing.T) {
+	t.Setenv("GITHUB_WORKSPACE", "/github/workspace")
+	report := newRunReport()
+	report.recordIdempotence([]taskChange{
+		{Host: "web1", Play: "Web", Task: "Render config", Path: "/github/workspace/site.yml:7"},
+		{Host: "db1"},
+	})
+
+	var out bytes.Buffer
+	writeAnnotations(&out, report, ErrNotIdempotent)
+	got := out.String()
+	for _, want := range []string{
+		"::error title=Not idempotent%3A Render config (web1),file=site.yml,line=7::Task reported a change on the second run\n",
+		"::error title=Not idempotent%3A db1::Task reported a change on the second run\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in annotations, got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "Ansible playbook failed") {
+		t.Errorf("expected no generic error, got:\n%s", got)
+	}
+}
+
+func TestWriteAnnotations_Drift(t *testing.T) {
+	report := newRunReport()
+	report.recordDrift([]taskChange{{Host: "web1", Task: "Render config"}})
+
+	var warn bytes.Buffer
+	writeAnnotations(&warn, report, nil)
+	if got := warn.String(); got != "::warning title=Drift%3A Render config (web1)::Check mode reported a change\n" {
+		t.Errorf("unexpected annotation for warn policy: %q", got)
+	}
+
+	var fail bytes.Buffer
+	writeAnnotations(&fail, report, ErrDriftDetected)
+	if got := fail.String(); got != "::error title=Drift%3A Render config (web1)::Check mode reported a change\n" {
+		t.Errorf("unexpected annotation for fail policy: %q", got)
+	}
+}
+
+func TestAnnotationPath(t *testing.T) {
+	t.Setenv("GITHUB_WORKSPACE", "/github/workspace")
+	tests := map[string]string{
+		"/github/workspace/site.yml": "site.yml",
+		"/etc/ansible/site.yml":      "/etc/ansible/site.yml",
+		"relative/site.yml":          "relative/site.yml",
+	}
+	for in, want := range tests {
+		if got := annotationPath(in); got != want {
+			t.Errorf("annotationPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSplitTaskPath(t *testing.T) {
+	if file, line := splitTaskPath("/src/site.yml:42"); file != "/src/site.yml" || line != 42 {
+		t.Errorf("unexpected split: %q %d", file, line)
+	}
+	if file, line := splitTaskPath(""); file != "" || line != 0 {
+		t.Errorf("unexpected split of empty path: %q %d", file, line)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ansibleConfigPath returns the ansible.cfg that ansible-playbook reads, in
+// Ansible's order: config-file, ANSIBLE_CONFIG, ansible.cfg in the working
+// directory, ~/.ansible.cfg and /etc/ansible/ansible.cfg. It returns "" if
+// there is none.
+func ansibleConfigPath(configFile string) string {
+	candidates := []string{configFile, os.Getenv("ANSIBLE_CONFIG"), "ansible.cfg"}
+	if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(home, ".ansible.cfg"))
+	}
+	candidates = append(candidates, "/etc/ansible/ansible.cfg")
+	for _, path := range candidates {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			path = filepath.Join(path, "ansible.cfg")
+		}
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+// ansibleConfigValue returns the value of the first of keys that is set in
+// the [defaults] section of the ansible.cfg at path, without quotes and
+// inline comments. It returns "" if the file or every key is missing.
+func ansibleConfigValue(path string, keys ...string) string {
+	if path == "" {
+		return ""
+	}
+	// #nosec G304 -- the configuration file is an input of the workflow.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	values := make(map[string]string)
+	section := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		i := strings.IndexAny(line, "=:")
+		if section != "defaults" || i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		if _, seen := values[key]; seen || !slices.Contains(keys, key) {
+			continue
+		}
+		value, _, _ := strings.Cut(line[i+1:], " ;")
+		values[key] = strings.Trim(strings.TrimSpace(value), `'"`)
+	}
+	for _, key := range keys {
+		if value := values[key]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// ansiblePathSetting returns a path list setting as ansible-playbook and
+// ansible-galaxy see it: the first of envVars that is set, else the first of
+// keys in the ansible.cfg the run uses, with relative directories resolved
+// against the file's directory as Ansible does, else def.
+func ansiblePathSetting(configFile string, envVars, keys []string, def string) string {
+	for _, name := range envVars {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	path := ansibleConfigPath(configFile)
+	value := ansibleConfigValue(path, keys...)
+	if value == "" {
+		return def
+	}
+	var dirs []string
+	for _, dir := range filepath.SplitList(value) {
+		if dir = strings.TrimSpace(dir); dir == "" {
+			continue
+		}
+		if !filepath.IsAbs(dir) && !strings.HasPrefix(dir, "~") && !strings.HasPrefix(dir, "$") {
+			dir = filepath.Join(filepath.Dir(path), dir)
+		}
+		dirs = append(dirs, dir)
+	}
+	return strings.Join(dirs, string(os.PathListSeparator))
+}
+
+// expandHome replaces a leading "~" of path with the home directory, as
+// Ansible does for the paths it reads.
+func expandHome(path string) string {
+	rest, ok := strings.CutPrefix(path, "~")
+	if !ok || (rest != "" && rest[0] != '/') {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return home + rest
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAnsibleConfigValue(t *testing.T) {
+	cfg := createTempFile(t, t.TempDir(), "ansible.cfg", `[galaxy]
+collections_path = /ignored
+
+[defaults]
+; comment
+Collections_Paths: './legacy' ; inline
+collections_path = ./collections
+`)
+	if got := ansibleConfigValue(cfg, "collections_path", "collections_paths"); got != "./collections" {
+		t.Errorf("expected the first key to win, got %q", got)
+	}
+	if got := ansibleConfigValue(cfg, "collections_paths"); got != "./legacy" {
+		t.Errorf("expected quotes and inline comments to be stripped, got %q", got)
+	}
+	if got := ansibleConfigValue(cfg, "roles_path"); got != "" {
+		t.Errorf("expected no value for a missing key, got %q", got)
+	}
+}
+
+func TestAnsiblePathSetting(t *testing.T) {
+	dir := t.TempDir()
+	cfg := createTempFile(t, dir, "ansible.cfg", "[defaults]\nroles_path = roles:~/shared:/opt/roles\n")
+	t.Setenv("ANSIBLE_ROLES_PATH", "")
+	want := filepath.Join(dir, "roles") + ":~/shared:/opt/roles"
+	if got := ansiblePathSetting(cfg, []string{"ANSIBLE_ROLES_PATH"}, []string{"roles_path"}, defaultRolesPath); got != want {
+		t.Errorf("expected the ansible.cfg path resolved against its directory, got %q, want %q", got, want)
+	}
+	t.Setenv("ANSIBLE_ROLES_PATH", "/env/roles")
+	if got := ansiblePathSetting(cfg, []string{"ANSIBLE_ROLES_PATH"}, []string{"roles_path"}, defaultRolesPath); got != "/env/roles" {
+		t.Errorf("expected the environment to take precedence, got %q", got)
+	}
+	t.Setenv("ANSIBLE_ROLES_PATH", "")
+	empty := createTempFile(t, dir, "empty.cfg", "[defaults]\n")
+	if got := ansiblePathSetting(empty, []string{"ANSIBLE_ROLES_PATH"}, []string{"roles_path"}, defaultRolesPath); got != defaultRolesPath {
+		t.Errorf("expected Ansible's default, got %q", got)
+	}
+}
+
+func TestExpandHome(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip(err)
+	}
+	for in, want := range map[string]string{
+		"~":                   home,
+		"~/.ansible/roles":    home + "/.ansible/roles",
+		"~other/roles":        "~other/roles",
+		"/usr/share/ansible":  "/usr/share/ansible",
+		"relative/~/not-home": "relative/~/not-home",
+	} {
+		if got := expandHome(in); got != want {
+			t.Errorf("expandHome(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+# -*- coding: utf-8 -*-
+# (c) 2026, Arillso
+# MIT License (see LICENSE)
+
+from __future__ import absolute_import, division, print_function
+
+__metaclass__ = type
+
+DOCUMENTATION = """
+    name: action_events
+    type: aggregate
+    short_description: Stream playbook events to the action.playbook wrapper
+    description:
+      - Sends one JSON document per line for playbook, play, task, result and
+        stats events to the Unix socket named by ACTION_PLAYBOOK_EVENTS_SOCKET.
+      - The wrapper enables and configures this plugin itself; it does nothing
+        when the variable is unset.
+    requirements:
+      - enable in configuration
+"""
+
+import json
+import os
+import socket
+import time
+
+from ansible.plugins.callback import CallbackBase
+
+try:
+    from ansible.module_utils.common.json import AnsibleJSONEncoder
+except ImportError:  # ansible-core < 2.11
+    from ansible.parsing.ajson import AnsibleJSONEncoder
+
+SOCKET_ENV = "ACTION_PLAYBOOK_EVENTS_SOCKET"
+
+NO_LOG_MESSAGE = (
+    "the output has been hidden due to the fact that 'no_log: true' "
+    "was specified for this result"
+)
+
+
+def _message(result):
+    """Return the most useful human-readable message of a module result."""
+    for key in ("msg", "reason", "stderr", "module_stderr"):
+        value = result.get(key)
+        if value:
+            return value if isinstance(value, str) else json.dumps(value, cls=AnsibleJSONEncoder)
+    return ""
+
+
+def _diff_path(diff):
+    """Return the file a diff belongs to: the path on the host, else the source."""
+    if not isinstance(diff, dict):
+        return ""
+    return diff.get("before_header") or diff.get("after_header") or ""
+
+
+class CallbackModule(CallbackBase):
+    CALLBACK_VERSION = 2.0
+    CALLBACK_TYPE = "aggregate"
+    CALLBACK_NAME = "action_events"
+    CALLBACK_NEEDS_ENABLED = True
+
+    def __init__(self, display=None):
+        super(CallbackModule, self).__init__(display=display)
+        self._sock = None
+        self._play = ""
+        self._started = {}
+
+        path = os.environ.get(SOCKET_ENV)
+        if not path:
+            return
+        try:
+            self._sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+            self._sock.connect(path)
+        except OSError as e:
+            self._display.warning("action_events: cannot connect to %s: %s" % (path, e))
+            self._sock = None
+
+    def _send(self, event, **fields):
+        if self._sock is None:
+            return
+        fields["event"] = event
+        fields["time"] = time.time()
+        try:
+            data = json.dumps(fields, cls=AnsibleJSONEncoder) + "\n"
+            self._sock.sendall(data.encode("utf-8"))
+        except (OSError, TypeError, ValueError) as e:
+            self._display.warning("action_events: event stream disabled: %s" % e)
+            self._sock = None
+
+    def _task_fields(self, task):
+        return dict(
+            play=self._play,
+            task=task.get_name().strip(),
+            action=task.action,
+            path=task.get_path() or "",
+        )
+
+    def _result(self, status, result):
+        task = result._task
+        res = result._result
+        host = result._host.get_name()
+        fields = self._task_fields(task)
+        fields.update(host=host, status=status)
+
+        started = self._started.pop((host, task._uuid), None)
+        if started is not None:
+            fields["duration"] = time.time() - started
+
+        if res.get("_ansible_no_log"):
+            fields["msg"] = NO_LOG_MESSAGE
+            self._send("result", **fields)
+            return
+
+        fields["msg"] = _message(res)
+        diffs = []
+        if res.get("diff"):
+            diffs.extend(res["diff"] if isinstance(res["diff"], list) else [res["diff"]])
+        items = []
+        for item in res.get("results") or []:
+            if not isinstance(item, dict):
+                continue
+            if item.get("diff") and not item.get("_ansible_no_log"):
+                diffs.extend(item["diff"] if isinstance(item["diff"], list) else [item["diff"]])
+            if item.get("failed") or item.get("unreachable"):
+                items.append(dict(
+                    item=self._get_item_label(item),
+                    msg=NO_LOG_MESSAGE if item.get("_ansible_no_log") else _message(item),
+                ))
+        if diffs:
+            fields["diff"] = self._get_diff(diffs)
+            fields["diff_files"] = [
+                dict(path=_diff_path(d), diff=self._get_diff([d]))
+                for d in diffs
+            ]
+        if items:
+            fields["failed_items"] = items
+        self._send("result", **fields)
+
+    def v2_playbook_on_start(self, playbook):
+        self._send("playbook_start", playbook=playbook._file_name, pid=os.getpid())
+
+    def v2_playbook_on_play_start(self, play):
+        self._play = play.get_name().strip()
+        self._send("play_start", play=self._play)
+
+    def v2_playbook_on_task_start(self, task, is_conditional):
+        self._send("task_start", **self._task_fields(task))
+
+    def v2_playbook_on_handler_task_start(self, task):
+        self._send("task_start", handler=True, **self._task_fields(task))
+
+    def v2_runner_on_start(self, host, task):
+        self._started[(host.get_name(), task._uuid)] = time.time()
+
+    def v2_runner_on_ok(self, result):
+        self._result("changed" if result._result.get("changed") else "ok", result)
+
+    def v2_runner_on_failed(self, result, ignore_errors=False):
+        self._result("ignored" if ignore_errors else "failed", result)
+
+    def v2_runner_on_skipped(self, result):
+        self._result("skipped", result)
+
+    def v2_runner_on_unreachable(self, result):
+        self._result("unreachable", result)
+
+    def v2_playbook_on_stats(self, stats):
+        summary = {}
+        for host in sorted(stats.processed.keys()):
+            s = stats.summarize(host)
+            summary[host] = dict(
+                ok=s["ok"],
+                changed=s["changed"],
+                unreachable=s["unreachable"],
+                failed=s["failures"],
+                skipped=s["skipped"],
+                rescued=s.get("rescued", 0),
+                ignored=s.get("ignored", 0),
+            )
+        self._send("stats", stats=summary, custom=stats.custom)
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+)
+
+// Phases of a run that have a timeout of their own. The whole run is bounded
+// by execution-timeout.
+const (
+	phaseExecution = "execution"
+	phaseLint      = "lint"
+	phaseGalaxy    = "galaxy-install"
+	phasePip       = "pip-install"
+	phasePlaybook  = "playbook"
+)
+
+// timeoutError is the cause of a context that ran out of time. It names the
+// phase whose timeout expired and matches ErrTimedOut and
+// context.DeadlineExceeded.
+type timeoutError struct {
+	phase   string
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timeout of %s reached", e.phase, formatDuration(e.timeout))
+}
+
+// Is reports whether target is ErrTimedOut or context.DeadlineExceeded.
+func (e *timeoutError) Is(target error) bool {
+	return target == ErrTimedOut || target == context.DeadlineExceeded
+}
+
+// phaseContext returns a context for phase that ends after timeout, or with
+// ctx if timeout is zero.
+func phaseContext(ctx context.Context, phase string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, &timeoutError{phase: phase, timeout: timeout})
+}
+
+// execGracefully runs exec so that cancelling ctx interrupts ansible-playbook
+// rather than killing it: the process identified by pid gets SIGINT, which
+// lets Ansible run its handlers and print the recap, and is only killed if it
+// is still running after grace. Without a known PID it is killed right away.
+// If ctx ended the run, the returned error wraps the cause.
+func execGracefully(ctx context.Context, grace time.Duration, pid func() int, exec func(context.Context) error) error {
+	execCtx, kill := context.WithCancel(context.WithoutCancel(ctx))
+	defer kill()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+		p := pid()
+		if p <= 0 {
+			log.Printf("%s; stopping ansible-playbook", interruptReason(ctx))
+			kill()
+			return
+		}
+		log.Printf("%s; sending SIGINT to ansible-playbook (PID %d) and waiting up to %v", interruptReason(ctx), p, grace)
+		_ = syscall.Kill(p, syscall.SIGINT)
+		select {
+		case <-done:
+			return
+		case <-time.After(grace):
+		}
+		log.Printf("ansible-playbook did not stop within %v; killing it", grace)
+		_ = syscall.Kill(p, syscall.SIGKILL)
+		kill()
+	}()
+
+	err := exec(execCtx)
+	close(done)
+	<-stopped
+	if ctx.Err() != nil {
+		if err == nil {
+			return context.Cause(ctx)
+		}
+		return fmt.Errorf("%w: %w", context.Cause(ctx), err)
+	}
+	return err
+}
+
+// interruptReason describes why ctx ended.
+func interruptReason(ctx context.Context) string {
+	var te *timeoutError
+	if errors.As(context.Cause(ctx), &te) {
+		return fmt.Sprintf("The %s", te)
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "Execution timeout reached"
+	}
+	return "Run cancelled"
+}
+
+// interruptedError marks err as cancelled or timed out when ctx ended, so
+// outputs and the summary can tell it apart from a failed playbook. Errors
+// that already carry a timeout or cancellation are returned as they are.
+func interruptedError(ctx context.Context, err error) error {
+	switch {
+	case err == nil || ctx.Err() == nil:
+		return err
+	case errors.Is(err, ErrTimedOut) || errors.Is(err, ErrCancelled):
+		return err
+	case errors.Is(context.Cause(ctx), ErrTimedOut):
+		return fmt.Errorf("%w: %w", context.Cause(ctx), err)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrTimedOut, err)
+	default:
+		return fmt.Errorf("%w: %w", ErrCancelled, err)
+	}
+}
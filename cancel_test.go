@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runShell returns an exec func for execGracefully that runs script in a
+// shell and stores the shell's PID in pid.
+func runShell(script string, pid *atomic.Int64) func(context.Context) error {
+	return func(ctx context.Context) error {
+		cmd := exec.CommandContext(ctx, "sh", "-c", script)
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		pid.Store(int64(cmd.Process.Pid))
+		return cmd.Wait()
+	}
+}
+
+// cancelOnceStarted calls cancel once pid is set and the shell has had time
+// to install its traps.
+func cancelOnceStarted(pid *atomic.Int64, cancel context.CancelFunc) {
+	for pid.Load() == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+}
+
+func TestExecGracefully_InterruptsWithSIGINT(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var pid atomic.Int64
+	go cancelOnceStarted(&pid, cancel)
+
+	start := time.Now()
+	err := execGracefully(ctx, 10*time.Second, func() int { return int(pid.Load()) }, runShell("trap 'exit 99' INT; sleep 10 & wait", &pid))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the shell to stop on SIGINT, took %v", elapsed)
+	}
+	var exitErr *exec.ExitError
+	if !errors.Is(err, context.Canceled) || !errors.As(err, &exitErr) || exitErr.ExitCode() != 99 {
+		t.Errorf("expected the SIGINT handler's exit code wrapped with context.Canceled, got %v", err)
+	}
+}
+
+func TestExecGracefully_KillsAfterGracePeriod(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var pid atomic.Int64
+	go cancelOnceStarted(&pid, cancel)
+
+	start := time.Now()
+	err := execGracefully(ctx, 200*time.Millisecond, func() int { return int(pid.Load()) }, runShell("trap '' INT; while true; do sleep 0.05; done", &pid))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the shell to be killed after the grace period, took %v", elapsed)
+	}
+	var exitErr *exec.ExitError
+	if !errors.Is(err, context.Canceled) || !errors.As(err, &exitErr) || exitErr.ExitCode() != -1 {
+		t.Errorf("expected a killed process wrapped with context.Canceled, got %v", err)
+	}
+}
+
+func TestExecGracefully_WithoutPIDStopsRightAway(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var pid atomic.Int64
+
+	start := time.Now()
+	err := execGracefully(ctx, time.Minute, func() int { return 0 }, runShell("trap '' INT; sleep 10", &pid))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the process to be stopped right away, took %v", elapsed)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestExecGracefully_Completes(t *testing.T) {
+	var pid atomic.Int64
+	if err := execGracefully(context.Background(), time.Second, func() int { return 0 }, runShell("exit 0", &pid)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestInterruptedError(t *testing.T) {
+	failed := errors.New("exit status 2")
+
+	timedOut, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	if err := interruptedError(timedOut, failed); !errors.Is(err, ErrTimedOut) || !errors.Is(err, failed) {
+		t.Errorf("expected ErrTimedOut wrapping the failure, got %v", err)
+	}
+
+	cancelled, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+	if err := interruptedError(cancelled, failed); !errors.Is(err, ErrCancelled) {
+		t.Errorf("expected ErrCancelled, got %v", err)
+	}
+	if err := interruptedError(cancelled, nil); err != nil {
+		t.Errorf("expected a successful run to stay successful, got %v", err)
+	}
+	if err := interruptedError(context.Background(), failed); err != failed {
+		t.Errorf("expected the failure unchanged, got %v", err)
+	}
+}
+
+func TestPhaseContext_NamesThePhase(t *testing.T) {
+	ctx, cancel := phaseContext(context.Background(), phaseGalaxy, time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+
+	err := interruptedError(ctx, errors.New("signal: interrupt"))
+	if !errors.Is(err, ErrTimedOut) {
+		t.Fatalf("expected ErrTimedOut, got %v", err)
+	}
+	var te *timeoutError
+	if !errors.As(err, &te) || te.phase != phaseGalaxy {
+		t.Fatalf("expected a galaxy-install timeout, got %v", err)
+	}
+	if got := te.Error(); got != "galaxy-install timeout of 0s reached" {
+		t.Errorf("unexpected message: %q", got)
+	}
+	// The outer context decides once the phase error has been recorded.
+	if again := interruptedError(context.Background(), err); again != err {
+		t.Errorf("expected the phase timeout to be kept, got %v", again)
+	}
+}
+
+func TestPhaseContext_WithoutTimeout(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := phaseContext(parent, phasePlaybook, 0)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expected no deadline without a phase timeout")
+	}
+	cancelParent()
+	<-ctx.Done()
+	if err := interruptedError(ctx, errors.New("boom")); !errors.Is(err, ErrCancelled) {
+		t.Errorf("expected the parent cancellation to reach the phase, got %v", err)
+	}
+}
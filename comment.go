@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultGitHubAPIURL is the REST API of github.com. GitHub Enterprise Server
+// runners set $GITHUB_API_URL to their own.
+const defaultGitHubAPIURL = "https://api.github.com"
+
+// githubAPITimeout bounds every single request to the GitHub API.
+const githubAPITimeout = 30 * time.Second
+
+// commentsPerPage is the page size used when looking for an existing comment.
+const commentsPerPage = 100
+
+// pullRequestEvent holds the fields of a pull_request webhook payload the
+// wrapper needs.
+type pullRequestEvent struct {
+	Number      int `json:"number"`
+	PullRequest struct {
+		Number int `json:"number"`
+	} `json:"pull_request"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// issueComment is an issue or pull request comment as returned by the API.
+type issueComment struct {
+	ID      int64  `json:"id"`
+	Body    string `json:"body"`
+	HTMLURL string `json:"html_url"`
+}
+
+// currentPullRequest returns the repository and number of the pull request
+// the workflow runs for. ok is false for any event other than pull_request or
+// pull_request_target.
+func currentPullRequest() (repo string, number int, ok bool, err error) {
+	switch os.Getenv("GITHUB_EVENT_NAME") {
+	case "pull_request", "pull_request_target":
+	default:
+		return "", 0, false, nil
+	}
+	path := os.Getenv("GITHUB_EVENT_PATH")
+	if path == "" {
+		return "", 0, false, errors.New("GITHUB_EVENT_PATH is not set")
+	}
+	// #nosec G304 -- the path is set by the Actions runner.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", 0, false, fmt.Errorf("failed to read event payload: %w", err)
+	}
+	var ev pullRequestEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", 0, false, fmt.Errorf("failed to parse event payload: %w", err)
+	}
+	number = ev.Number
+	if number == 0 {
+		number = ev.PullRequest.Number
+	}
+	repo = ev.Repository.FullName
+	if repo == "" {
+		repo = os.Getenv("GITHUB_REPOSITORY")
+	}
+	if number == 0 || repo == "" {
+		return "", 0, false, errors.New("event payload names no pull request")
+	}
+	return repo, number, true, nil
+}
+
+// githubClient is a minimal client for the GitHub REST API.
+type githubClient struct {
+	apiURL string
+	token  string
+	http   *http.Client
+}
+
+// newGitHubClient returns a client for the API at apiURL, authenticating with
+// token.
+func newGitHubClient(apiURL, token string) *githubClient {
+	if apiURL == "" {
+		apiURL = defaultGitHubAPIURL
+	}
+	return &githubClient{
+		apiURL: strings.TrimRight(apiURL, "/"),
+		token:  token,
+		http:   &http.Client{Timeout: githubAPITimeout},
+	}
+}
+
+// do sends a JSON request and decodes the JSON response into out, if set.
+func (g *githubClient) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, g.apiURL+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	req.Header.Set("User-Agent", "arillso-action-playbook")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := g.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s %s: failed to decode response: %w", method, path, err)
+	}
+	return nil
+}
+
+// findComment returns the first comment on the pull request whose body
+// contains marker, or nil.
+func (g *githubClient) findComment(ctx context.Context, repo string, number int, marker string) (*issueComment, error) {
+	for page := 1; ; page++ {
+		var comments []issueComment
+		path := fmt.Sprintf("/repos/%s/issues/%d/comments?per_page=%d&page=%d", repo, number, commentsPerPage, page)
+		if err := g.do(ctx, http.MethodGet, path, nil, &comments); err != nil {
+			return nil, err
+		}
+		for i := range comments {
+			if strings.Contains(comments[i].Body, marker) {
+				return &comments[i], nil
+			}
+		}
+		if len(comments) < commentsPerPage {
+			return nil, nil
+		}
+	}
+}
+
+// upsertComment updates the pull request comment tagged with marker in place,
+// or creates it if there is none yet.
+func (g *githubClient) upsertComment(ctx context.Context, repo string, number int, marker, body string) (*issueComment, error) {
+	existing, err := g.findComment(ctx, repo, number, marker)
+	if err != nil {
+		return nil, err
+	}
+	payload := map[string]string{"body": body}
+	var comment issueComment
+	if existing != nil {
+		err = g.do(ctx, http.MethodPatch, fmt.Sprintf("/repos/%s/issues/comments/%d", repo, existing.ID), payload, &comment)
+	} else {
+		err = g.do(ctx, http.MethodPost, fmt.Sprintf("/repos/%s/issues/%d/comments", repo, number), payload, &comment)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+// unsafeMarkerRun matches a run of dashes and characters that may not appear
+// in the id of a comment marker.
+var unsafeMarkerRun = regexp.MustCompile(`[^A-Za-z0-9._:]+`)
+
+// commentMarker returns the hidden HTML comment that identifies the wrapper's
+// pull request comment. id tells apart comments of several jobs on one pull
+// request. Characters other than letters, digits, ".", "_", ":" and "-" are
+// replaced by "-" and runs of "-" collapsed, so the id cannot end the HTML
+// comment early.
+func commentMarker(id string) string {
+	if id == "" {
+		return "<!-- arillso/action.playbook -->"
+	}
+	return fmt.Sprintf("<!-- arillso/action.playbook:%s -->", unsafeMarkerRun.ReplaceAllString(id, "-"))
+}
+
+// renderPRComment builds the pull request comment: status, per-host recap and,
+// when the run produced diffs, the diff summary, within GitHub's size limit.
+func renderPRComment(marker string, playbooks []string, execErr error, report *runReport) string {
+	var b strings.Builder
+	b.WriteString(marker + "\n")
+	spans := make([]string, len(playbooks))
+	for i, p := range playbooks {
+		spans[i] = codeSpan(p)
+	}
+	fmt.Fprintf(&b, "## Ansible Playbook Results\n\n**Status:** %s\n\n**Playbooks:** %s\n",
+		summaryStatus(execErr), strings.Join(spans, ", "))
+	if url := workflowRunURL(); url != "" {
+		fmt.Fprintf(&b, "\n[View workflow run](%s)\n", url)
+	}
+	writeHostRecap(&b, report)
+
+	results := report.taskResults()
+	for _, r := range results {
+		if strings.TrimSpace(r.Diff) != "" {
+			md, _ := renderDiffMarkdown(results, githubCommentLimit-b.Len())
+			b.WriteString("\n" + md)
+			break
+		}
+	}
+	return b.String()
+}
+
+// workflowRunURL links to the current workflow run, or returns "" outside
+// GitHub Actions.
+func workflowRunURL() string {
+	server, repo, run := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID")
+	if server == "" || repo == "" || run == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s/actions/runs/%s", server, repo, run)
+}
+
+// postPRComment creates or updates the pull request comment for this run. It
+// only logs failures: a missing comment must not fail a deployment.
+func postPRComment(ctx context.Context, client *githubClient, marker string, playbooks []string, execErr error, report *runReport) {
+	repo, number, ok, err := currentPullRequest()
+	if err != nil {
+		log.Printf("Warning: could not post pull request comment: %v", err)
+		return
+	}
+	if !ok {
+		log.Printf("Not running for a pull request; skipping pull request comment")
+		return
+	}
+	if client.token == "" {
+		log.Printf("Warning: could not post pull request comment: no GitHub token set")
+		return
+	}
+
+	// The run's own deadline may already have passed; the comment is still
+	// worth posting.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 2*githubAPITimeout)
+	defer cancel()
+	comment, err := client.upsertComment(ctx, repo, number, marker, renderPRComment(marker, playbooks, execErr, report))
+	if err != nil {
+		log.Printf("Warning: could not post pull request comment: %v", err)
+		return
+	}
+	log.Printf("Pull request comment updated: %s", comment.HTMLURL)
+}
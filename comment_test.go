@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGitHub is an httptest stand-in for the issue comment endpoints.
+type fakeGitHub struct {
+	mu       sync.Mutex
+	comments []issueComment
+	nextID   int64
+	requests []string
+	auth     string
+}
+
+func newFakeGitHub(t *testing.T, existing ...issueComment) (*fakeGitHub, *httptest.Server) {
+	t.Helper()
+	f := &fakeGitHub{comments: existing, nextID: 1000}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeGitHub) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.RequestURI())
+	f.auth = r.Header.Get("Authorization")
+
+	var in struct {
+		Body string `json:"body"`
+	}
+	if r.Body != nil {
+		_ = json.NewDecoder(r.Body).Decode(&in)
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/repos/octo/repo/issues/7/comments":
+		var page int
+		_, _ = fmt.Sscan(r.URL.Query().Get("page"), &page)
+		start := min((page-1)*commentsPerPage, len(f.comments))
+		end := min(start+commentsPerPage, len(f.comments))
+		_ = json.NewEncoder(w).Encode(f.comments[start:end])
+	case r.Method == http.MethodPost && r.URL.Path == "/repos/octo/repo/issues/7/comments":
+		f.nextID++
+		c := issueComment{ID: f.nextID, Body: in.Body, HTMLURL: fmt.Sprintf("https://github.test/c/%d", f.nextID)}
+		f.comments = append(f.comments, c)
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(c)
+	case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/repos/octo/repo/issues/comments/"):
+		for i := range f.comments {
+			if r.URL.Path == fmt.Sprintf("/repos/octo/repo/issues/comments/%d", f.comments[i].ID) {
+				f.comments[i].Body = in.Body
+				_ = json.NewEncoder(w).Encode(f.comments[i])
+				return
+			}
+		}
+		http.NotFound(w, r)
+	default:
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+	}
+}
+
+// setPullRequestEvent points the GitHub event variables at a pull_request
+// payload for octo/repo#7.
+func setPullRequestEvent(t *testing.T) {
+	t.Helper()
+	path := createTempFile(t, t.TempDir(), "event.json", `{"number": 7, "pull_request": {"number": 7}, "repository": {"full_name": "octo/repo"}}`)
+	t.Setenv("GITHUB_EVENT_NAME", "pull_request")
+	t.Setenv("GITHUB_EVENT_PATH", path)
+}
+
+func TestCurrentPullRequest(t *testing.T) {
+	setPullRequestEvent(t)
+	repo, number, ok, err := currentPullRequest()
+	if err != nil || !ok || repo != "octo/repo" || number != 7 {
+		t.Fatalf("unexpected pull request: %q #%d ok=%t err=%v", repo, number, ok, err)
+	}
+
+	t.Setenv("GITHUB_EVENT_NAME", "push")
+	if _, _, ok, err := currentPullRequest(); ok || err != nil {
+		t.Errorf("expected push events to be skipped, got ok=%t err=%v", ok, err)
+	}
+
+	t.Setenv("GITHUB_EVENT_NAME", "pull_request")
+	t.Setenv("GITHUB_EVENT_PATH", createTempFile(t, t.TempDir(), "event.json", `{}`))
+	t.Setenv("GITHUB_REPOSITORY", "octo/repo")
+	if _, _, _, err := currentPullRequest(); err == nil {
+		t.Error("expected an error for a payload without a pull request number")
+	}
+}
+
+func TestUpsertComment_Creates(t *testing.T) {
+	f, srv := newFakeGitHub(t, issueComment{ID: 1, Body: "unrelated"})
+	client := newGitHubClient(srv.URL+"/", "s3cret")
+
+	c, err := client.upsertComment(context.Background(), "octo/repo", 7, commentMarker(""), commentMarker("")+"\nhello")
+	if err != nil {
+		t.Fatalf("upsertComment: %v", err)
+	}
+	if c.ID != 1001 || len(f.comments) != 2 {
+		t.Errorf("expected a new comment, got %+v and %+v", c, f.comments)
+	}
+	if f.auth != "Bearer s3cret" {
+		t.Errorf("expected a bearer token, got %q", f.auth)
+	}
+}
+
+func TestUpsertComment_UpdatesAcrossPages(t *testing.T) {
+	var existing []issueComment
+	for i := range commentsPerPage {
+		existing = append(existing, issueComment{ID: int64(i + 1), Body: "noise"})
+	}
+	marker := commentMarker("staging")
+	existing = append(existing, issueComment{ID: 500, Body: marker + "\nold"})
+	f, srv := newFakeGitHub(t, existing...)
+
+	c, err := newGitHubClient(srv.URL, "t").upsertComment(context.Background(), "octo/repo", 7, marker, marker+"\nnew")
+	if err != nil {
+		t.Fatalf("upsertComment: %v", err)
+	}
+	if c.ID != 500 || f.comments[commentsPerPage].Body != marker+"\nnew" || len(f.comments) != commentsPerPage+1 {
+		t.Errorf("expected comment 500 to be updated in place, got %+v", c)
+	}
+	if want := "PATCH /repos/octo/repo/issues/comments/500"; f.requests[len(f.requests)-1] != want {
+		t.Errorf("expected %q as last request, got %v", want, f.requests)
+	}
+}
+
+func TestUpsertComment_APIError(t *testing.T) {
+	_, srv := newFakeGitHub(t)
+	_, err := newGitHubClient(srv.URL, "t").upsertComment(context.Background(), "octo/other", 7, "m", "b")
+	if err == nil || !strings.Contains(err.Error(), "404 Not Found") {
+		t.Errorf("expected a 404 error, got %v", err)
+	}
+}
+
+func TestCommentMarker(t *testing.T) {
+	if got := commentMarker(""); got != "<!-- arillso/action.playbook -->" {
+		t.Errorf("unexpected default marker %q", got)
+	}
+	for id, want := range map[string]string{
+		"prod--eu":       "prod-eu",
+		"staging":        "staging",
+		"eu-1.prod:web_": "eu-1.prod:web_",
+		"x--->y":         "x-y",
+		"a -- b<!--c":    "a-b-c",
+		"--!>":           "-",
+	} {
+		if got := commentMarker(id); got != "<!-- arillso/action.playbook:"+want+" -->" {
+			t.Errorf("expected id %q to be made safe for an HTML comment, got %q", id, got)
+		}
+	}
+}
+
+func TestRenderPRComment(t *testing.T) {
+	t.Setenv("GITHUB_SERVER_URL", "https://github.com")
+	t.Setenv("GITHUB_REPOSITORY", "octo/repo")
+	t.Setenv("GITHUB_RUN_ID", "42")
+	report := newRunReport()
+	report.recordStats("web1", hostStats{Ok: 2, Changed: 1})
+	report.recordResult(taskResult{Host: "web1", Play: "Web", Task: "Render", Status: "changed", Diff: "-a\n+b\n"})
+
+	body := renderPRComment(commentMarker(""), []string{"site.yml"}, nil, report)
+	for _, want := range []string{
+		"<!-- arillso/action.playbook -->\n## Ansible Playbook Results",
+		"**Status:** ✅ Success",
+		"[View workflow run](https://github.com/octo/repo/actions/runs/42)",
+		"| `web1` | 2 | 1 | 0 | 0 | 0 | 0 | 0 |",
+		"## Ansible diff",
+		"```diff\n-a\n+b\n```",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in comment, got:\n%s", want, body)
+		}
+	}
+
+	noDiff := newRunReport()
+	noDiff.recordStats("web1", hostStats{Ok: 1})
+	if body := renderPRComment("m", []string{"site.yml"}, errors.New("boom"), noDiff); strings.Contains(body, "Ansible diff") || !strings.Contains(body, "❌ Failed: boom") {
+		t.Errorf("unexpected comment without diffs:\n%s", body)
+	}
+	if body := renderPRComment("m", []string{"site.yml", "odd`name|x.yml", "`tick.yml"}, nil, noDiff); !strings.Contains(body, "**Playbooks:** `site.yml`, ``odd`name|x.yml``, `` `tick.yml ``\n") {
+		t.Errorf("expected playbook names in safe code spans, got:\n%s", body)
+	}
+}
+
+// TestRun_PostsPRComment verifies run() posts the comment even when the
+// playbook itself fails.
+func TestRun_PostsPRComment(t *testing.T) {
+	setPullRequestEvent(t)
+	f, srv := newFakeGitHub(t)
+	tmpDir := t.TempDir()
+	pb := createTempFile(t, tmpDir, "pb.yml", "---\n- hosts: all\n")
+	inv := createTempFile(t, tmpDir, "inv.yml", "all:\n  hosts:\n    localhost:\n")
+
+	err := runWithArgs(t, []string{
+		"test", "--playbook", pb, "--inventory", inv,
+		"--pr-comment", "--github-token", "t", "--github-api-url", srv.URL,
+	})
+	if err == nil {
+		t.Fatal("expected run() to fail at ansible exec, got nil")
+	}
+	if len(f.comments) != 1 || !strings.Contains(f.comments[0].Body, filepath.Base(pb)) || !strings.Contains(f.comments[0].Body, "❌ Failed") {
+		t.Errorf("expected a failure comment, got %+v", f.comments)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// githubCommentLimit is the maximum length of an issue or pull request comment
+// body on GitHub.
+const githubCommentLimit = 65536
+
+// diffMarkdownReserve is kept free below the limit for the truncation note and
+// for whatever a caller wraps around the markdown, e.g. a comment marker.
+const diffMarkdownReserve = 1024
+
+// diffMarkdownMinBlock is the smallest remaining budget worth starting another
+// diff block for.
+const diffMarkdownMinBlock = 256
+
+// renderDiffMarkdown renders the diffs in results as markdown for a pull
+// request comment: one collapsible section per host and one fenced diff block
+// per changed file, or per task for diffs Ansible reports without a file. The output stays below limit; if diffs had to be cut, a note says
+// so and the second return value is true.
+func renderDiffMarkdown(results []taskResult, limit int) (string, bool) {
+	byHost := make(map[string][]taskResult)
+	for _, r := range results {
+		if strings.TrimSpace(r.Diff) != "" {
+			byHost[r.Host] = append(byHost[r.Host], r)
+		}
+	}
+	hosts := make([]string, 0, len(byHost))
+	for host := range byHost {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var b strings.Builder
+	b.WriteString("## Ansible diff\n\n")
+	if len(hosts) == 0 {
+		b.WriteString("_No differences reported._\n")
+		return b.String(), false
+	}
+	fmt.Fprintf(&b, "%d host(s) with changes.\n", len(hosts))
+
+	budget := limit - diffMarkdownReserve
+	truncated := false
+	shownHosts := 0
+	for _, host := range hosts {
+		header := fmt.Sprintf("\n<details>\n<summary><code>%s</code> — %d changed task(s)</summary>\n", htmlEscape(host), len(byHost[host]))
+		const footer = "\n</details>\n"
+		if b.Len()+len(header)+len(footer)+diffMarkdownMinBlock > budget {
+			truncated = true
+			break
+		}
+		b.WriteString(header)
+		for _, section := range diffSections(byHost[host]) {
+			block, cut := diffBlock(section.heading(), strings.Join(section.diffs, "\n"), budget-b.Len()-len(footer))
+			if block == "" {
+				truncated = true
+				break
+			}
+			b.WriteString(block)
+			if cut {
+				truncated = true
+				break
+			}
+		}
+		b.WriteString(footer)
+		shownHosts++
+		if truncated {
+			break
+		}
+	}
+
+	if truncated {
+		fmt.Fprintf(&b, "\n> [!NOTE]\n> Diff truncated to fit GitHub's comment size limit (%d of %d host(s) shown). See the workflow log for the full diff.\n",
+			shownHosts, len(hosts))
+	}
+	return b.String(), truncated
+}
+
+// diffSection is the diff of one file on one host, with the tasks that
+// changed it, or the diff of one task that Ansible reported without a file.
+type diffSection struct {
+	path  string
+	tasks []string
+	diffs []string
+}
+
+// diffSections groups the diffs of one host's results by file, in the order
+// the files were first changed.
+func diffSections(results []taskResult) []*diffSection {
+	var sections []*diffSection
+	byKey := make(map[string]*diffSection)
+	for i, r := range results {
+		files := r.Files
+		if len(files) == 0 {
+			files = []fileDiff{{Diff: r.Diff}}
+		}
+		task := "**" + markdownText(r.Task) + "**"
+		if r.Play != "" {
+			task += " · " + markdownText(r.Play)
+		}
+		for _, f := range files {
+			if strings.TrimSpace(f.Diff) == "" {
+				continue
+			}
+			key := "file\x00" + f.Path
+			if f.Path == "" {
+				key = fmt.Sprintf("task\x00%d", i)
+			}
+			section, ok := byKey[key]
+			if !ok {
+				section = &diffSection{path: f.Path}
+				byKey[key] = section
+				sections = append(sections, section)
+			}
+			if !slices.Contains(section.tasks, task) {
+				section.tasks = append(section.tasks, task)
+			}
+			section.diffs = append(section.diffs, strings.TrimRight(f.Diff, "\n"))
+		}
+	}
+	return sections
+}
+
+// heading names the file and the tasks that changed it, or only the task.
+func (s *diffSection) heading() string {
+	if s.path == "" {
+		return "\n" + strings.Join(s.tasks, ", ")
+	}
+	return fmt.Sprintf("\n<code>%s</code> — %s", htmlEscape(s.path), strings.Join(s.tasks, ", "))
+}
+
+// diffBlock renders a heading and a fenced diff block of at most budget bytes.
+// If the diff has to be cut, whole lines are dropped from the end and the
+// second return value is true; if not even the heading fits, it returns "".
+func diffBlock(heading, diff string, budget int) (string, bool) {
+	fence := codeFence(diff)
+	open := heading + "\n\n" + fence + "diff\n"
+	closing := "\n" + fence + "\n"
+
+	if len(open)+len(closing)+len(diff) <= budget {
+		return open + diff + closing, false
+	}
+	room := budget - len(open) - len(closing) - len("\n… (truncated)")
+	if room < diffMarkdownMinBlock {
+		return "", true
+	}
+	// Never split a multi-byte character, even when no line fits whole.
+	for room > 0 && !utf8.RuneStart(diff[room]) {
+		room--
+	}
+	cut := diff[:room]
+	if i := strings.LastIndex(cut, "\n"); i > 0 {
+		cut = cut[:i]
+	}
+	return open + cut + "\n… (truncated)" + closing, true
+}
+
+// codeFence returns a backtick fence longer than any backtick run in s, so the
+// content cannot close the block early.
+func codeFence(s string) string {
+	return strings.Repeat("`", max(3, longestBacktickRun(s)+1))
+}
+
+// codeSpan wraps s in an inline code span whose delimiters are longer than any
+// backtick run in s, padded with spaces if s starts or ends with a backtick.
+func codeSpan(s string) string {
+	delim := strings.Repeat("`", longestBacktickRun(s)+1)
+	if strings.HasPrefix(s, "`") || strings.HasSuffix(s, "`") {
+		s = " " + s + " "
+	}
+	return delim + s + delim
+}
+
+// longestBacktickRun returns the length of the longest run of backticks in s.
+func longestBacktickRun(s string) int {
+	longest, run := 0, 0
+	for _, c := range s {
+		if c == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	return longest
+}
+
+// markdownText escapes characters that would otherwise be read as inline
+// markdown or HTML in running text.
+func markdownText(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		"*", `\*`,
+		"_", `\_`,
+		"`", "\\`",
+		"<", "&lt;",
+		">", "&gt;",
+		"\n", " ",
+	).Replace(s)
+}
+
+// htmlEscape escapes s for use inside an HTML element.
+func htmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// writeDiffMarkdown renders the diffs of the last attempt, writes them to path
+// and records them for the diff_markdown output.
+func writeDiffMarkdown(path string, report *runReport) error {
+	md, truncated := renderDiffMarkdown(report.taskResults(), githubCommentLimit)
+	if err := writeArtifactFile(path, []byte(md)); err != nil {
+		return fmt.Errorf("could not write diff markdown: %w", err)
+	}
+	report.recordDiffMarkdown(md)
+	if truncated {
+		log.Printf("Warning: diff markdown truncated to %d bytes", len(md))
+	}
+	log.Printf("Diff markdown written to %s", path)
+	return nil
+}
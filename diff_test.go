@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestRenderDiffMarkdown(t *testing.T) {
+	results := []taskResult{
+		{Host: "web2", Play: "Web", Task: "Render config", Status: "changed", Diff: "--- before: /etc/app.conf\n+++ after: /etc/app.conf\n@@ -1 +1 @@\n-a\n+b\n"},
+		{Host: "web1", Play: "Web", Task: "Render *config*", Status: "changed", Diff: "-x\n+y\n"},
+		{Host: "web1", Play: "Web", Task: "Ping", Status: "ok"},
+		{Host: "db<1>", Play: "DB", Task: "Copy", Status: "changed", Diff: "+```\n"},
+	}
+	md, truncated := renderDiffMarkdown(results, githubCommentLimit)
+	if truncated {
+		t.Error("expected no truncation")
+	}
+	for _, want := range []string{
+		"## Ansible diff\n\n3 host(s) with changes.\n",
+		"<summary><code>db&lt;1&gt;</code> — 1 changed task(s)</summary>",
+		"**Render \\*config\\*** · Web\n\n```diff\n-x\n+y\n```\n",
+		"````diff\n+```\n````\n",
+		"```diff\n--- before: /etc/app.conf\n+++ after: /etc/app.conf\n@@ -1 +1 @@\n-a\n+b\n```\n",
+		"\n</details>\n",
+	} {
+		if !strings.Contains(md, want) {
+			t.Errorf("expected %q in markdown, got:\n%s", want, md)
+		}
+	}
+	if strings.Contains(md, "Ping") {
+		t.Errorf("expected tasks without a diff to be left out, got:\n%s", md)
+	}
+	if db, web1 := strings.Index(md, "db&lt;1&gt;"), strings.Index(md, "<code>web1</code>"); db > web1 {
+		t.Errorf("expected hosts in sorted order, got:\n%s", md)
+	}
+}
+
+func TestRenderDiffMarkdown_ByFile(t *testing.T) {
+	results := []taskResult{
+		{Host: "web1", Play: "Web", Task: "Render", Status: "changed", Diff: "-a\n+b\n-c\n+d\n", Files: []fileDiff{
+			{Path: "/etc/a.conf", Diff: "-a\n+b\n"},
+			{Path: "/etc/b<1>.conf", Diff: "-c\n+d\n"},
+		}},
+		{Host: "web1", Play: "Web", Task: "Tune", Status: "changed", Diff: "-b\n+e\n", Files: []fileDiff{
+			{Path: "/etc/a.conf", Diff: "-b\n+e\n"},
+		}},
+		{Host: "web1", Play: "Web", Task: "Packages", Status: "changed", Diff: "+nginx\n", Files: []fileDiff{{Diff: "+nginx\n"}}},
+	}
+	md, _ := renderDiffMarkdown(results, githubCommentLimit)
+	for _, want := range []string{
+		"\n<code>/etc/a.conf</code> — **Render** · Web, **Tune** · Web\n\n```diff\n-a\n+b\n-b\n+e\n```\n",
+		"\n<code>/etc/b&lt;1&gt;.conf</code> — **Render** · Web\n\n```diff\n-c\n+d\n```\n",
+		"\n**Packages** · Web\n\n```diff\n+nginx\n```\n",
+	} {
+		if !strings.Contains(md, want) {
+			t.Errorf("expected %q in markdown, got:\n%s", want, md)
+		}
+	}
+	if a, b := strings.Index(md, "/etc/a.conf"), strings.Index(md, "/etc/b"); a > b {
+		t.Errorf("expected files in the order they were changed, got:\n%s", md)
+	}
+}
+
+func TestDiffBlock_CutsAtRuneBoundary(t *testing.T) {
+	diff := "+" + strings.Repeat("ä", 400)
+	block, cut := diffBlock("\n**Render**", diff, 600)
+	if !cut {
+		t.Fatal("expected the diff to be cut")
+	}
+	if !utf8.ValidString(block) {
+		t.Errorf("expected valid UTF-8, got %q", block)
+	}
+}
+
+func TestRenderDiffMarkdown_NoDiffs(t *testing.T) {
+	md, truncated := renderDiffMarkdown([]taskResult{{Host: "web1", Task: "Ping", Status: "ok"}}, githubCommentLimit)
+	if truncated || md != "## Ansible diff\n\n_No differences reported._\n" {
+		t.Errorf("unexpected markdown (truncated=%t):\n%s", truncated, md)
+	}
+}
+
+func TestRenderDiffMarkdown_Truncated(t *testing.T) {
+	big := strings.Repeat("+"+strings.Repeat("x", 99)+"\n", 400) // ~40 KB per diff
+	var results []taskResult
+	for _, host := range []string{"a", "b", "c"} {
+		results = append(results, taskResult{Host: host, Task: "Render", Status: "changed", Diff: big})
+	}
+
+	md, truncated := renderDiffMarkdown(results, githubCommentLimit)
+	if !truncated {
+		t.Fatal("expected truncation")
+	}
+	if len(md) > githubCommentLimit-diffMarkdownReserve+300 {
+		t.Errorf("expected markdown to stay below the limit, got %d bytes", len(md))
+	}
+	for _, want := range []string{"… (truncated)\n```", "(2 of 3 host(s) shown)"} {
+		if !strings.Contains(md, want) {
+			t.Errorf("expected %q in markdown", want)
+		}
+	}
+	if strings.Contains(md, "<code>c</code>") {
+		t.Error("expected the third host to be left out")
+	}
+	if strings.Count(md, "<details>") != strings.Count(md, "</details>") {
+		t.Error("expected every details section to be closed")
+	}
+}
+
+func TestCodeFence(t *testing.T) {
+	tests := map[string]string{
+		"plain":      "```",
+		"one ` tick": "```",
+		"```":        "````",
+		"a ````` b":  "``````",
+		"`` and ```": "````",
+	}
+	for in, want := range tests {
+		if got := codeFence(in); got != want {
+			t.Errorf("codeFence(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCodeSpan(t *testing.T) {
+	tests := map[string]string{
+		"site.yml":  "`site.yml`",
+		"a`b":       "``a`b``",
+		"a``b":      "```a``b```",
+		"`tick.yml": "`` `tick.yml ``",
+	}
+	for in, want := range tests {
+		if got := codeSpan(in); got != want {
+			t.Errorf("codeSpan(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestWriteDiffMarkdown(t *testing.T) {
+	report := newRunReport()
+	report.recordResult(taskResult{Host: "web1", Task: "Render", Status: "changed", Diff: "-a\n+b\n"})
+	path := filepath.Join(t.TempDir(), "out", "diff.md")
+
+	if err := writeDiffMarkdown(path, report); err != nil {
+		t.Fatalf("writeDiffMarkdown: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading diff markdown: %v", err)
+	}
+	if string(data) != report.diffMarkdownText() || !strings.Contains(string(data), "-a\n+b\n") {
+		t.Errorf("unexpected diff markdown:\n%s", data)
+	}
+}
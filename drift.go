@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Drift policies, selecting what drift-detect does when check mode reports
+// changes.
+const (
+	driftPolicyFail = "fail"
+	driftPolicyWarn = "warn"
+)
+
+// checkDrift records every task that check mode reported as changed and
+// applies policy: with driftPolicyFail any drift fails the run, with
+// driftPolicyWarn it is only reported.
+func checkDrift(report *runReport, policy string) error {
+	changes := report.changedTasks()
+	report.recordDrift(changes)
+	if len(changes) == 0 {
+		log.Printf("No drift detected: check mode reported no changes")
+		return nil
+	}
+	hosts := hostsOf(changes)
+	if policy == driftPolicyFail {
+		return fmt.Errorf("%w: %d task result(s) on %d host(s) would change", ErrDriftDetected, len(changes), len(hosts))
+	}
+	log.Printf("Warning: drift detected: %d task result(s) on %d host(s) would change", len(changes), len(hosts))
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func driftReport() *runReport {
+	report := newRunReport()
+	report.setStreaming()
+	report.recordResult(taskResult{Host: "web2", Play: "Web", Task: "Render config", Status: "changed"})
+	report.recordResult(taskResult{Host: "web1", Play: "Web", Task: "Render config", Status: "changed"})
+	report.recordResult(taskResult{Host: "web1", Play: "Web", Task: "Install nginx", Status: "changed"})
+	report.recordResult(taskResult{Host: "db1", Play: "DB", Task: "Ping", Status: "ok"})
+	return report
+}
+
+func TestCheckDrift_Fail(t *testing.T) {
+	report := driftReport()
+	err := checkDrift(report, driftPolicyFail)
+	if !errors.Is(err, ErrDriftDetected) {
+		t.Fatalf("expected ErrDriftDetected, got %v", err)
+	}
+	changes, checked := report.drift()
+	if !checked || len(changes) != 3 {
+		t.Errorf("expected 3 drifted task results, got checked=%t %+v", checked, changes)
+	}
+}
+
+func TestCheckDrift_Warn(t *testing.T) {
+	report := driftReport()
+	if err := checkDrift(report, driftPolicyWarn); err != nil {
+		t.Fatalf("expected warn policy to succeed, got %v", err)
+	}
+	if changes, _ := report.drift(); len(changes) != 3 {
+		t.Errorf("expected drift to be recorded, got %+v", changes)
+	}
+}
+
+func TestCheckDrift_NoDrift(t *testing.T) {
+	report := newRunReport()
+	report.setStreaming()
+	report.recordResult(taskResult{Host: "web1", Task: "Ping", Status: "ok"})
+	if err := checkDrift(report, driftPolicyFail); err != nil {
+		t.Fatalf("expected no drift, got %v", err)
+	}
+	changes, checked := report.drift()
+	if !checked || changes == nil || len(changes) != 0 {
+		t.Errorf("expected an empty, non-nil drift list, got checked=%t %#v", checked, changes)
+	}
+}
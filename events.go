@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// actionEventsPlugin is the callback plugin that streams playbook events to
+// the wrapper. It is written to a temporary callback_plugins directory at run
+// time so the Docker image needs no extra files.
+//
+//go:embed callback_plugins/action_events.py
+var actionEventsPlugin []byte
+
+const (
+	// eventsCallbackName is the name under which the plugin is enabled.
+	eventsCallbackName = "action_events"
+	// eventsSocketEnv tells the plugin which Unix socket to connect to.
+	eventsSocketEnv = "ACTION_PLAYBOOK_EVENTS_SOCKET"
+	// maxEventSize bounds a single JSON event line. Results with large diffs
+	// can be big, but anything beyond this is almost certainly runaway output.
+	maxEventSize = 16 << 20
+	// eventDrainTimeout bounds how long the wrapper waits for open event
+	// connections after ansible-playbook has exited.
+	eventDrainTimeout = 5 * time.Second
+	// eventSettleTime is how long the wrapper waits for the connection of an
+	// ansible-playbook process that has exited but whose connection has not
+	// been accepted yet, or that never connected at all.
+	eventSettleTime = 200 * time.Millisecond
+)
+
+// playbookEvent is one JSON document sent by the callback plugin.
+type playbookEvent struct {
+	Event       string               `json:"event"`
+	Time        float64              `json:"time"`
+	Playbook    string               `json:"playbook"`
+	PID         int                  `json:"pid"`
+	Play        string               `json:"play"`
+	Task        string               `json:"task"`
+	Action      string               `json:"action"`
+	Path        string               `json:"path"`
+	Host        string               `json:"host"`
+	Status      string               `json:"status"`
+	Msg         string               `json:"msg"`
+	Duration    float64              `json:"duration"`
+	Diff        string               `json:"diff"`
+	DiffFiles   []fileDiff           `json:"diff_files"`
+	FailedItems []failedItemEvent    `json:"failed_items"`
+	Stats       map[string]hostStats `json:"stats"`
+	// Custom holds the set_stats data, keyed by host or "_run".
+	Custom map[string]map[string]json.RawMessage `json:"custom"`
+}
+
+// failedItemEvent is a failed loop item inside a result event.
+type failedItemEvent struct {
+	Item string `json:"item"`
+	Msg  string `json:"msg"`
+}
+
+// timestamp converts the event's Unix time in seconds to a time.Time.
+func (e playbookEvent) timestamp() time.Time {
+	sec, frac := math.Modf(e.Time)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second)))
+}
+
+// eventStream receives events from the embedded callback plugin over a Unix
+// socket and records them into a runReport. Every ansible-playbook process
+// opens its own connection, so one stream serves all attempts.
+type eventStream struct {
+	dir      string
+	listener net.Listener
+	report   *runReport
+
+	mu sync.Mutex
+	// active counts the connections that have neither sent their stats nor
+	// closed; finished counts the ones that have, and waited how many of
+	// those the last wait saw.
+	active   int
+	finished int
+	waited   int
+	pid      int
+	done     chan struct{}
+}
+
+// startEventStream writes the callback plugin to a private temporary directory
+// and starts listening for its connections.
+func startEventStream(report *runReport) (*eventStream, error) {
+	dir, err := os.MkdirTemp("", "action-playbook-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create event stream directory: %w", err)
+	}
+	pluginDir := filepath.Join(dir, "callback_plugins")
+	if err := os.Mkdir(pluginDir, 0700); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to create callback plugin directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(pluginDir, eventsCallbackName+".py"), actionEventsPlugin, 0600); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to write callback plugin: %w", err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "events.sock"))
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to listen for playbook events: %w", err)
+	}
+
+	s := &eventStream{dir: dir, listener: listener, report: report, done: make(chan struct{})}
+	go s.acceptLoop()
+	return s, nil
+}
+
+// defaultCallbackPlugins is Ansible's built-in callback plugin search path,
+// which setting ANSIBLE_CALLBACK_PLUGINS would otherwise replace.
+const defaultCallbackPlugins = "~/.ansible/plugins/callback:/usr/share/ansible/plugins/callback"
+
+// env returns the environment that makes ansible-playbook load the plugin and
+// connect to this stream. The wrapper's directory is prepended to the callback
+// plugin path already in effect: the one set in the environment, else the
+// one in the ansible.cfg the run uses, else Ansible's default.
+func (s *eventStream) env(configFile string) map[string]string {
+	existing := ansiblePathSetting(configFile, []string{"ANSIBLE_CALLBACK_PLUGINS"}, []string{"callback_plugins"}, defaultCallbackPlugins)
+	pluginPath := filepath.Join(s.dir, "callback_plugins") + string(os.PathListSeparator) + existing
+	return map[string]string{
+		"ANSIBLE_CALLBACK_PLUGINS": pluginPath,
+		eventsSocketEnv:            s.listener.Addr().String(),
+	}
+}
+
+// acceptLoop handles incoming plugin connections until the listener closes.
+func (s *eventStream) acceptLoop() {
+	defer close(s.done)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.active++
+		s.mu.Unlock()
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn decodes newline-delimited events from a single ansible-playbook
+// process until it disconnects.
+func (s *eventStream) handleConn(conn net.Conn) {
+	// A connection is finished by its stats, the plugin's last event, or
+	// else when it closes. A stray child process may keep it open longer.
+	finished := false
+	finish := func() {
+		if finished {
+			return
+		}
+		finished = true
+		s.mu.Lock()
+		s.active--
+		s.finished++
+		s.mu.Unlock()
+	}
+	defer func() {
+		_ = conn.Close()
+		finish()
+	}()
+
+	h := newEventHandler(s.report)
+	pid := 0
+	defer func() {
+		s.mu.Lock()
+		if s.pid == pid {
+			s.pid = 0
+		}
+		s.mu.Unlock()
+	}()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEventSize)
+	for scanner.Scan() {
+		var ev playbookEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			log.Printf("Warning: ignoring malformed playbook event: %v", err)
+			continue
+		}
+		if ev.Event == "playbook_start" && ev.PID > 0 {
+			pid = ev.PID
+			s.mu.Lock()
+			s.pid = pid
+			s.mu.Unlock()
+		}
+		h.handle(ev)
+		if ev.Event == "stats" {
+			finish()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Warning: playbook event stream interrupted: %v", err)
+	}
+}
+
+// playbookPID returns the PID of the running ansible-playbook process as
+// announced by the plugin, or 0 if no process is connected.
+func (s *eventStream) playbookPID() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pid
+}
+
+// wait blocks until the ansible-playbook process that just exited has sent
+// its stats or closed its connection, so the report is complete. The process
+// may have connected without the connection being accepted yet, so wait does
+// not return on no open connections alone: it waits eventSettleTime for one
+// to show up, in case the process never connected, e.g. because it failed to
+// start. It gives up after eventDrainTimeout in case a connection neither
+// finishes nor closes.
+func (s *eventStream) wait() {
+	start := time.Now()
+	defer func() {
+		s.mu.Lock()
+		s.waited = s.finished
+		s.mu.Unlock()
+	}()
+	for {
+		s.mu.Lock()
+		active, finished := s.active, s.finished-s.waited
+		s.mu.Unlock()
+		if active == 0 && (finished > 0 || time.Since(start) >= eventSettleTime) {
+			return
+		}
+		if time.Since(start) >= eventDrainTimeout {
+			log.Printf("Warning: playbook event stream did not close within %v", eventDrainTimeout)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// close stops listening and removes the plugin directory and socket.
+func (s *eventStream) close() {
+	_ = s.listener.Close()
+	<-s.done
+	if err := os.RemoveAll(s.dir); err != nil {
+		log.Printf("Warning: could not remove event stream directory: %v", err)
+	}
+}
+
+// eventHandler turns the events of one ansible-playbook process into report
+// entries. It tracks the current task to derive task durations.
+type eventHandler struct {
+	report    *runReport
+	play      string
+	task      string
+	taskStart time.Time
+}
+
+// newEventHandler returns an eventHandler recording into report.
+func newEventHandler(report *runReport) *eventHandler {
+	return &eventHandler{report: report}
+}
+
+// handle records a single event.
+func (h *eventHandler) handle(ev playbookEvent) {
+	switch ev.Event {
+	case "playbook_start":
+		h.report.setStreaming()
+	case "play_start":
+		h.finishTask(ev.timestamp())
+		h.play = ev.Play
+	case "task_start":
+		h.finishTask(ev.timestamp())
+		h.task = ev.Task
+		h.taskStart = ev.timestamp()
+	case "result":
+		h.handleResult(ev)
+	case "stats":
+		h.finishTask(ev.timestamp())
+		for host, s := range ev.Stats {
+			h.report.recordStats(host, s)
+		}
+		h.report.recordCustomStats(ev.Custom)
+	}
+}
+
+// handleResult records a per-host result, plus the failure or connection error
+// it carries.
+func (h *eventHandler) handleResult(ev playbookEvent) {
+	msg := ev.Msg
+	for _, item := range ev.FailedItems {
+		msg += fmt.Sprintf("\nitem=%s: %s", item.Item, item.Msg)
+	}
+	var files []fileDiff
+	for _, f := range ev.DiffFiles {
+		files = append(files, fileDiff{Path: f.Path, Diff: stripANSI(f.Diff)})
+	}
+	h.report.recordResult(taskResult{
+		Host:     ev.Host,
+		Play:     ev.Play,
+		Task:     ev.Task,
+		Module:   ev.Action,
+		Path:     ev.Path,
+		Status:   ev.Status,
+		Msg:      msg,
+		Diff:     stripANSI(ev.Diff),
+		Files:    files,
+		Duration: time.Duration(ev.Duration * float64(time.Second)),
+	})
+	switch ev.Status {
+	case "unreachable":
+		h.report.recordUnreachable(ev.Host, ev.Msg)
+	case "failed":
+		if len(ev.FailedItems) == 0 {
+			h.report.recordFailure(taskFailure{Host: ev.Host, Play: ev.Play, Task: ev.Task, Module: ev.Action, Path: ev.Path, Msg: ev.Msg})
+			return
+		}
+		for _, item := range ev.FailedItems {
+			h.report.recordFailure(taskFailure{Host: ev.Host, Play: ev.Play, Task: ev.Task, Module: ev.Action, Path: ev.Path, Item: item.Item, Msg: item.Msg})
+		}
+	}
+}
+
+// finishTask records the duration of the task currently in progress, if any.
+func (h *eventHandler) finishTask(now time.Time) {
+	if h.task == "" {
+		return
+	}
+	h.report.recordTiming(taskTiming{Play: h.play, Task: h.task, Duration: now.Sub(h.taskStart)})
+	h.task = ""
+}
+
+// enabledCallbacks returns the callbacks_enabled list in effect with name
+// appended: the callbacks-enabled input or its environment variables, else
+// callbacks_enabled or the legacy callback_whitelist of the ansible.cfg the
+// run uses. The wrapper sets the list in the environment, which would
+// otherwise replace the one in ansible.cfg.
+func enabledCallbacks(callbacks, configFile, name string) string {
+	if strings.TrimSpace(callbacks) == "" {
+		callbacks = ansibleConfigValue(ansibleConfigPath(configFile), "callbacks_enabled", "callback_whitelist")
+	}
+	return enableCallback(callbacks, name)
+}
+
+// enableCallback appends name to a comma-separated callbacks_enabled list
+// unless it is already present.
+func enableCallback(callbacks, name string) string {
+	var enabled []string
+	for _, cb := range strings.Split(callbacks, ",") {
+		cb = strings.TrimSpace(cb)
+		if cb == name {
+			return callbacks
+		}
+		if cb != "" {
+			enabled = append(enabled, cb)
+		}
+	}
+	return strings.Join(append(enabled, name), ",")
+}
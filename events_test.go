@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendEvents connects to the stream like the callback plugin does and writes
+// the given raw JSON lines, then waits until the stream has drained them.
+func sendEvents(t *testing.T, s *eventStream, lines ...string) {
+	t.Helper()
+	conn, err := net.Dial("unix", s.env("")[eventsSocketEnv])
+	if err != nil {
+		t.Fatalf("dialing event socket: %v", err)
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(conn, line); err != nil {
+			t.Fatalf("writing event: %v", err)
+		}
+	}
+	_ = conn.Close()
+	s.wait()
+}
+
+func TestEventStream_RecordsReport(t *testing.T) {
+	report := newRunReport()
+	s, err := startEventStream(report)
+	if err != nil {
+		t.Fatalf("startEventStream: %v", err)
+	}
+	defer s.close()
+
+	sendEvents(t, s,
+		`{"event": "playbook_start", "time": 1000, "playbook": "site.yml"}`,
+		`{"event": "play_start", "time": 1000, "play": "web"}`,
+		`{"event": "task_start", "time": 1001, "play": "web", "task": "Install nginx", "action": "ansible.builtin.apt"}`,
+		`{"event": "result", "time": 1004, "play": "web", "task": "Install nginx", "action": "ansible.builtin.apt", "path": "site.yml:5", "host": "web1", "status": "changed", "duration": 2.5}`,
+		`{"event": "result", "time": 1005, "play": "web", "task": "Install nginx", "action": "ansible.builtin.apt", "host": "web2", "status": "failed", "msg": "no package"}`,
+		`not json`,
+		`{"event": "task_start", "time": 1011, "play": "web", "task": "Loop", "action": "ansible.builtin.command"}`,
+		`{"event": "result", "time": 1012, "play": "web", "task": "Loop", "action": "ansible.builtin.command", "host": "web1", "status": "failed", "msg": "One or more items failed", "failed_items": [{"item": "a", "msg": "rc 1"}, {"item": "b", "msg": "rc 2"}]}`,
+		`{"event": "result", "time": 1012, "play": "web", "task": "Loop", "action": "ansible.builtin.command", "host": "db1", "status": "unreachable", "msg": "ssh timeout"}`,
+		`{"event": "stats", "time": 1013, "stats": {"web1": {"ok": 1, "changed": 1, "failed": 1}, "web2": {"failed": 1}, "db1": {"unreachable": 1}}, "custom": {"_run": {"version": "1.2.3"}, "web1": {"port": 8080}}}`,
+	)
+
+	if !report.isStreaming() {
+		t.Error("expected report to be marked as streaming")
+	}
+	if got := report.changedHosts(); len(got) != 1 || got[0] != "web1" {
+		t.Errorf("unexpected changed hosts: %v", got)
+	}
+	results := report.taskResults()
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(results))
+	}
+	if results[0].Module != "ansible.builtin.apt" || results[0].Path != "site.yml:5" || results[0].Duration != 2500*time.Millisecond {
+		t.Errorf("unexpected first result: %+v", results[0])
+	}
+	failures := report.failedTasks()
+	if len(failures) != 3 {
+		t.Fatalf("expected 3 failures (one plain, two loop items), got %d: %+v", len(failures), failures)
+	}
+	if failures[0].Module != "ansible.builtin.apt" || failures[0].Msg != "no package" {
+		t.Errorf("unexpected first failure: %+v", failures[0])
+	}
+	if failures[2].Item != "b" || failures[2].Msg != "rc 2" {
+		t.Errorf("unexpected loop item failure: %+v", failures[2])
+	}
+	if got := report.unreachableErrors()["db1"]; got != "ssh timeout" {
+		t.Errorf("unexpected unreachable error: %q", got)
+	}
+	slowest := report.slowestTasks(1)
+	if len(slowest) != 1 || slowest[0].Task != "Install nginx" || slowest[0].Duration != 10*time.Second {
+		t.Errorf("unexpected slowest task: %+v", slowest)
+	}
+	custom := report.customStats()
+	if string(custom["_run"]["version"]) != `"1.2.3"` || string(custom["web1"]["port"]) != "8080" {
+		t.Errorf("unexpected custom stats: %v", custom)
+	}
+}
+
+func TestEventStream_WaitsForLateConnection(t *testing.T) {
+	report := newRunReport()
+	s, err := startEventStream(report)
+	if err != nil {
+		t.Fatalf("startEventStream: %v", err)
+	}
+	defer s.close()
+
+	// The process has exited, but its connection only shows up after wait
+	// has started, as when it is still in the listen backlog.
+	waited := make(chan struct{})
+	go func() {
+		s.wait()
+		close(waited)
+	}()
+	time.Sleep(eventSettleTime / 4)
+	conn, err := net.Dial("unix", s.env("")[eventsSocketEnv])
+	if err != nil {
+		t.Fatalf("dialing event socket: %v", err)
+	}
+	fmt.Fprintln(conn, `{"event": "stats", "stats": {"web1": {"ok": 1}}}`)
+	_ = conn.Close()
+	<-waited
+
+	if got := report.hostStats()["web1"]; got.Ok != 1 {
+		t.Errorf("expected the stats of the late connection, got %+v", report.hostStats())
+	}
+}
+
+func TestEventStream_WaitReturnsOnStats(t *testing.T) {
+	report := newRunReport()
+	s, err := startEventStream(report)
+	if err != nil {
+		t.Fatalf("startEventStream: %v", err)
+	}
+	defer s.close()
+
+	// A stray child process keeps the connection open after the stats.
+	conn, err := net.Dial("unix", s.env("")[eventsSocketEnv])
+	if err != nil {
+		t.Fatalf("dialing event socket: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	fmt.Fprintln(conn, `{"event": "stats", "stats": {"web1": {"ok": 1}}}`)
+
+	start := time.Now()
+	s.wait()
+	if elapsed := time.Since(start); elapsed >= eventDrainTimeout {
+		t.Errorf("expected wait to return on the stats, took %v", elapsed)
+	}
+	if got := report.hostStats()["web1"]; got.Ok != 1 {
+		t.Errorf("expected the stats, got %+v", report.hostStats())
+	}
+}
+
+func TestEventStream_TracksPlaybookPID(t *testing.T) {
+	s, err := startEventStream(newRunReport())
+	if err != nil {
+		t.Fatalf("startEventStream: %v", err)
+	}
+	defer s.close()
+
+	conn, err := net.Dial("unix", s.env("")[eventsSocketEnv])
+	if err != nil {
+		t.Fatalf("dialing event socket: %v", err)
+	}
+	fmt.Fprintln(conn, `{"event": "playbook_start", "time": 1000, "playbook": "site.yml", "pid": 4242}`)
+	deadline := time.Now().Add(2 * time.Second)
+	for s.playbookPID() != 4242 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := s.playbookPID(); got != 4242 {
+		t.Fatalf("expected PID 4242 while the process is connected, got %d", got)
+	}
+
+	_ = conn.Close()
+	s.wait()
+	if got := s.playbookPID(); got != 0 {
+		t.Errorf("expected the PID to be cleared once the process disconnected, got %d", got)
+	}
+}
+
+func TestEventStream_SuppressesStdoutParsing(t *testing.T) {
+	report := newRunReport()
+	report.setStreaming()
+	p := newOutputParser(report)
+	p.handleLine("PLAY RECAP ***")
+	p.handleLine("web1 : ok=1 changed=1 unreachable=0 failed=0")
+	if got := report.hosts(); len(got) != 0 {
+		t.Errorf("expected stdout recap to be ignored while streaming, got %v", got)
+	}
+	if got := report.outputTail(); len(got) != 2 {
+		t.Errorf("expected the output tail to be kept while streaming, got %v", got)
+	}
+}
+
+func TestEventStream_Env(t *testing.T) {
+	t.Setenv("ANSIBLE_CALLBACK_PLUGINS", "/opt/callbacks")
+	s, err := startEventStream(newRunReport())
+	if err != nil {
+		t.Fatalf("startEventStream: %v", err)
+	}
+	env := s.env("")
+	pluginDir := filepath.Join(s.dir, "callback_plugins")
+	if env["ANSIBLE_CALLBACK_PLUGINS"] != pluginDir+":/opt/callbacks" {
+		t.Errorf("unexpected ANSIBLE_CALLBACK_PLUGINS: %q", env["ANSIBLE_CALLBACK_PLUGINS"])
+	}
+	data, err := os.ReadFile(filepath.Join(pluginDir, eventsCallbackName+".py"))
+	if err != nil {
+		t.Fatalf("expected callback plugin on disk: %v", err)
+	}
+	if !strings.Contains(string(data), `CALLBACK_NAME = "action_events"`) {
+		t.Error("plugin on disk does not declare the expected callback name")
+	}
+	s.close()
+
+	t.Setenv("ANSIBLE_CALLBACK_PLUGINS", "")
+	s, err = startEventStream(newRunReport())
+	if err != nil {
+		t.Fatalf("startEventStream: %v", err)
+	}
+	defer s.close()
+	if got := s.env("")["ANSIBLE_CALLBACK_PLUGINS"]; !strings.HasSuffix(got, ":"+defaultCallbackPlugins) {
+		t.Errorf("expected Ansible's default plugin path to be kept, got %q", got)
+	}
+
+	// A callback_plugins path from ansible.cfg is kept, resolved against the
+	// file's directory.
+	dir := t.TempDir()
+	cfg := createTempFile(t, dir, "ansible.cfg", "[ssh_connection]\ncallback_plugins = /ignored\n\n[defaults]\n# local plugins\ncallback_plugins = plugins/callback:/opt/callbacks ; inline\n")
+	want := filepath.Join(s.dir, "callback_plugins") + ":" + filepath.Join(dir, "plugins", "callback") + ":/opt/callbacks"
+	if got := s.env(cfg)["ANSIBLE_CALLBACK_PLUGINS"]; got != want {
+		t.Errorf("expected the ansible.cfg plugin path to be kept, got %q, want %q", got, want)
+	}
+	t.Setenv("ANSIBLE_CONFIG", cfg)
+	if got := s.env("")["ANSIBLE_CALLBACK_PLUGINS"]; got != want {
+		t.Errorf("expected the ansible.cfg from ANSIBLE_CONFIG to be read, got %q", got)
+	}
+}
+
+func TestEventStream_Cleanup(t *testing.T) {
+	s, err := startEventStream(newRunReport())
+	if err != nil {
+		t.Fatalf("startEventStream: %v", err)
+	}
+	s.close()
+	if _, err := os.Stat(s.dir); !os.IsNotExist(err) {
+		t.Errorf("expected event stream directory to be removed, got %v", err)
+	}
+}
+
+func TestEnableCallback(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", "action_events"},
+		{"profile_tasks", "profile_tasks,action_events"},
+		{" profile_tasks , timer ", "profile_tasks,timer,action_events"},
+		{"timer,action_events", "timer,action_events"},
+	}
+	for _, tt := range tests {
+		if got := enableCallback(tt.in, eventsCallbackName); got != tt.want {
+			t.Errorf("enableCallback(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEnabledCallbacks_AnsibleConfig(t *testing.T) {
+	dir := t.TempDir()
+	cfg := createTempFile(t, dir, "ansible.cfg", "[defaults]\ncallbacks_enabled = profile_tasks, timer\n")
+	legacy := createTempFile(t, dir, "legacy.cfg", "[defaults]\ncallback_whitelist = timer\n")
+	t.Setenv("ANSIBLE_CONFIG", "")
+
+	if got := enabledCallbacks("", cfg, eventsCallbackName); got != "profile_tasks,timer,action_events" {
+		t.Errorf("expected the ansible.cfg callbacks to stay enabled, got %q", got)
+	}
+	if got := enabledCallbacks("", legacy, eventsCallbackName); got != "timer,action_events" {
+		t.Errorf("expected callback_whitelist to be read, got %q", got)
+	}
+	if got := enabledCallbacks("junit", cfg, eventsCallbackName); got != "junit,action_events" {
+		t.Errorf("expected the input to take precedence over ansible.cfg, got %q", got)
+	}
+	t.Setenv("ANSIBLE_CONFIG", cfg)
+	if got := enabledCallbacks("", "", eventsCallbackName); got != "profile_tasks,timer,action_events" {
+		t.Errorf("expected the ansible.cfg from ANSIBLE_CONFIG to be read, got %q", got)
+	}
+}
+
+// fakeAnsible is a minimal stand-in for the parts of the ansible package the
+// callback plugin imports, so the plugin can be exercised without Ansible.
+var fakeAnsible = map[string]string{
+	"ansible/__init__.py":                     "",
+	"ansible/plugins/__init__.py":             "",
+	"ansible/module_utils/__init__.py":        "",
+	"ansible/module_utils/common/__init__.py": "",
+	"ansible/module_utils/common/json.py":     "import json\nAnsibleJSONEncoder = json.JSONEncoder\n",
+	"ansible/plugins/callback/__init__.py": `class _Display:
+    def warning(self, msg):
+        raise AssertionError(msg)
+
+
+class CallbackBase:
+    def __init__(self, display=None):
+        self._display = display or _Display()
+
+    def _get_item_label(self, result):
+        return result.get("item")
+
+    def _get_diff(self, diffs):
+        return "".join("-%s\n+%s\n" % (d["before"], d["after"]) for d in diffs)
+`,
+}
+
+// pluginDriver feeds the plugin a short run through fake Ansible objects.
+const pluginDriver = `import importlib.util, sys
+
+spec = importlib.util.spec_from_file_location("action_events", sys.argv[1])
+mod = importlib.util.module_from_spec(spec)
+spec.loader.exec_module(mod)
+
+
+class Obj:
+    def __init__(self, **kw):
+        self.__dict__.update(kw)
+
+
+class Task:
+    _uuid = "t1"
+    action = "ansible.builtin.copy"
+    def get_name(self):
+        return "Copy config "
+    def get_path(self):
+        return "site.yml:3"
+
+
+class Host:
+    def get_name(self):
+        return "web1"
+
+
+class Stats:
+    processed = {"web1": 1}
+    custom = {"_run": {"version": "1.2.3"}}
+    def summarize(self, host):
+        return dict(ok=1, changed=1, unreachable=0, failures=0, skipped=0, rescued=0, ignored=0)
+
+
+cb = mod.CallbackModule()
+cb.v2_playbook_on_start(Obj(_file_name="site.yml"))
+cb.v2_playbook_on_play_start(Obj(get_name=lambda: "web"))
+task = Task()
+cb.v2_playbook_on_task_start(task, False)
+cb.v2_runner_on_start(Host(), task)
+cb.v2_runner_on_ok(Obj(_task=task, _host=Host(), _result={"changed": True, "diff": {"before": "a", "after": "b", "before_header": "/etc/app.conf"}}))
+cb.v2_runner_on_failed(Obj(_task=task, _host=Host(), _result={"_ansible_no_log": True, "msg": "secret"}))
+cb.v2_playbook_on_stats(Stats())
+`
+
+func TestActionEventsPlugin_Python(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 not available")
+	}
+	dir := t.TempDir()
+	for name, content := range fakeAnsible {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		createTempFile(t, filepath.Dir(path), filepath.Base(path), content)
+	}
+	plugin := createTempFile(t, dir, "action_events.py", string(actionEventsPlugin))
+	driver := createTempFile(t, dir, "driver.py", pluginDriver)
+
+	report := newRunReport()
+	s, err := startEventStream(report)
+	if err != nil {
+		t.Fatalf("startEventStream: %v", err)
+	}
+	defer s.close()
+
+	cmd := exec.Command(python, driver, plugin)
+	cmd.Env = append(os.Environ(), "PYTHONPATH="+dir, "PYTHONDONTWRITEBYTECODE=1", eventsSocketEnv+"="+s.env("")[eventsSocketEnv])
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("plugin driver failed: %v\n%s", err, out)
+	}
+	s.wait()
+
+	if !report.isStreaming() {
+		t.Fatal("expected the plugin to announce the playbook start")
+	}
+	results := report.taskResults()
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d: %+v", len(results), results)
+	}
+	if results[0].Status != "changed" || results[0].Task != "Copy config" || results[0].Module != "ansible.builtin.copy" || results[0].Path != "site.yml:3" || results[0].Diff != "-a\n+b\n" {
+		t.Errorf("unexpected changed result: %+v", results[0])
+	}
+	if want := []fileDiff{{Path: "/etc/app.conf", Diff: "-a\n+b\n"}}; !reflect.DeepEqual(results[0].Files, want) {
+		t.Errorf("expected the diff by file %+v, got %+v", want, results[0].Files)
+	}
+	if results[1].Status != "failed" || strings.Contains(results[1].Msg, "secret") {
+		t.Errorf("expected a censored failure, got %+v", results[1])
+	}
+	if got := report.hostStats()["web1"]; got != (hostStats{Ok: 1, Changed: 1}) {
+		t.Errorf("unexpected stats: %+v", got)
+	}
+	if got := string(report.customStats()["_run"]["version"]); got != `"1.2.3"` {
+		t.Errorf("unexpected custom stats: %s", got)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// exportAllFacts selects every cached fact for export.
+	exportAllFacts = "all"
+	// factCachePrefix is the file name prefix the jsonfile cache plugin is
+	// told to use, so cache files can be told apart from anything else.
+	factCachePrefix = "facts_"
+)
+
+// factCache is a private directory the jsonfile fact cache plugin writes the
+// gathered facts to, one JSON file per host.
+type factCache struct {
+	dir string
+}
+
+// validateFactExport checks that the facts inputs can be served by a jsonfile
+// cache the wrapper configures itself.
+func validateFactExport(names []string, factsFile, caching string) error {
+	if len(names) == 0 {
+		if factsFile != "" {
+			return fmt.Errorf("%w: facts-file requires export-facts", ErrInvalidParameter)
+		}
+		return nil
+	}
+	if caching != "" && caching != "jsonfile" {
+		return fmt.Errorf("%w: export-facts needs the jsonfile fact cache, but fact-caching is %q", ErrInvalidParameter, caching)
+	}
+	if slices.Contains(names, exportAllFacts) && len(names) > 1 {
+		return fmt.Errorf("%w: export-facts accepts either %q or a list of fact names", ErrInvalidParameter, exportAllFacts)
+	}
+	return nil
+}
+
+// newFactCache creates the cache directory.
+func newFactCache() (*factCache, error) {
+	dir, err := os.MkdirTemp("", "ansible-facts-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create fact cache directory: %w", err)
+	}
+	return &factCache{dir: dir}, nil
+}
+
+// env returns the environment that points the jsonfile cache plugin at the
+// cache directory.
+func (f *factCache) env() map[string]string {
+	return map[string]string{
+		"ANSIBLE_CACHE_PLUGIN_CONNECTION": f.dir,
+		"ANSIBLE_CACHE_PLUGIN_PREFIX":     factCachePrefix,
+	}
+}
+
+// close removes the cache directory.
+func (f *factCache) close() {
+	_ = os.RemoveAll(f.dir)
+}
+
+// read returns the selected facts of every host in the cache. Hosts whose
+// cache file cannot be parsed are skipped with a warning.
+func (f *factCache) read(names []string) (map[string]map[string]any, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fact cache: %w", err)
+	}
+	facts := make(map[string]map[string]any)
+	for _, e := range entries {
+		host, ok := strings.CutPrefix(e.Name(), factCachePrefix)
+		if !ok || host == "" || e.IsDir() {
+			continue
+		}
+		// #nosec G304 -- the file lies in the wrapper's private cache directory.
+		data, err := os.ReadFile(filepath.Join(f.dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read facts of %s: %w", host, err)
+		}
+		var all map[string]any
+		if err := json.Unmarshal(data, &all); err != nil {
+			log.Printf("Warning: could not parse cached facts of %s: %v", host, err)
+			continue
+		}
+		facts[host] = selectFacts(all, names)
+	}
+	return facts, nil
+}
+
+// selectFacts picks names from a host's facts. A name may be given with or
+// without the "ansible_" prefix and may use dots to reach into nested values,
+// e.g. "default_ipv4.address". Names the host has no value for are left out.
+func selectFacts(all map[string]any, names []string) map[string]any {
+	if slices.Contains(names, exportAllFacts) {
+		return all
+	}
+	selected := make(map[string]any, len(names))
+	for _, name := range names {
+		if v, ok := lookupFact(all, name); ok {
+			selected[name] = v
+		}
+	}
+	return selected
+}
+
+// lookupFact resolves a possibly dotted fact name in facts.
+func lookupFact(facts map[string]any, name string) (any, bool) {
+	first, rest, nested := strings.Cut(name, ".")
+	v, ok := facts[first]
+	if !ok {
+		v, ok = facts["ansible_"+first]
+	}
+	for ok && nested {
+		m, isMap := v.(map[string]any)
+		if !isMap {
+			return nil, false
+		}
+		var key string
+		key, rest, nested = strings.Cut(rest, ".")
+		v, ok = m[key]
+	}
+	return v, ok
+}
+
+// exportHostFacts reads the selected facts from the cache, records them for the
+// facts output and, if path is set, writes them to path.
+func exportHostFacts(cache *factCache, names []string, path string, report *runReport) error {
+	facts, err := cache.read(names)
+	if err != nil {
+		return err
+	}
+	report.recordFacts(facts)
+	if path == "" {
+		return nil
+	}
+	return writeFactsFile(path, facts)
+}
+
+// writeFactsFile writes facts as indented JSON to path.
+func writeFactsFile(path string, facts map[string]map[string]any) error {
+	data, err := json.MarshalIndent(facts, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode facts: %w", err)
+	}
+	if err := writeArtifactFile(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("could not write facts file: %w", err)
+	}
+	log.Printf("Facts of %d host(s) written to %s", len(facts), path)
+	return nil
+}
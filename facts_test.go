@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const cachedFacts = `{
+    "ansible_kernel": "6.1.0-18-amd64",
+    "ansible_default_ipv4": {"address": "10.0.0.5", "interface": "eth0"},
+    "discovered_interpreter_python": "/usr/bin/python3"
+}`
+
+func TestSelectFacts(t *testing.T) {
+	var all map[string]any
+	if err := json.Unmarshal([]byte(cachedFacts), &all); err != nil {
+		t.Fatal(err)
+	}
+	got := selectFacts(all, []string{"kernel", "ansible_default_ipv4.address", "default_ipv4.interface", "discovered_interpreter_python", "missing", "kernel.release"})
+	want := map[string]any{
+		"kernel":                        "6.1.0-18-amd64",
+		"ansible_default_ipv4.address":  "10.0.0.5",
+		"default_ipv4.interface":        "eth0",
+		"discovered_interpreter_python": "/usr/bin/python3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected selection:\n got %v\nwant %v", got, want)
+	}
+	if got := selectFacts(all, []string{exportAllFacts}); len(got) != len(all) {
+		t.Errorf("expected all %d facts, got %v", len(all), got)
+	}
+}
+
+func TestFactCache_Read(t *testing.T) {
+	cache, err := newFactCache()
+	if err != nil {
+		t.Fatalf("newFactCache: %v", err)
+	}
+	defer cache.close()
+	if env := cache.env(); env["ANSIBLE_CACHE_PLUGIN_CONNECTION"] != cache.dir || env["ANSIBLE_CACHE_PLUGIN_PREFIX"] != factCachePrefix {
+		t.Errorf("unexpected cache env: %v", env)
+	}
+	createTempFile(t, cache.dir, factCachePrefix+"web1", cachedFacts)
+	createTempFile(t, cache.dir, factCachePrefix+"web2", "not json")
+	createTempFile(t, cache.dir, "unrelated", "{}")
+
+	facts, err := cache.read([]string{"kernel"})
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	want := map[string]map[string]any{"web1": {"kernel": "6.1.0-18-amd64"}}
+	if !reflect.DeepEqual(facts, want) {
+		t.Errorf("unexpected facts: %v", facts)
+	}
+
+	cache.close()
+	if _, err := os.Stat(cache.dir); !os.IsNotExist(err) {
+		t.Errorf("expected the cache directory to be removed, got %v", err)
+	}
+}
+
+func TestExportHostFacts_WritesFile(t *testing.T) {
+	cache, err := newFactCache()
+	if err != nil {
+		t.Fatalf("newFactCache: %v", err)
+	}
+	defer cache.close()
+	createTempFile(t, cache.dir, factCachePrefix+"web1", cachedFacts)
+
+	path := filepath.Join(t.TempDir(), "out", "facts.json")
+	report := newRunReport()
+	if err := exportHostFacts(cache, []string{"default_ipv4.address"}, path, report); err != nil {
+		t.Fatalf("exportHostFacts: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("facts file not written: %v", err)
+	}
+	var written map[string]map[string]any
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatalf("facts file is not valid JSON: %v", err)
+	}
+	if written["web1"]["default_ipv4.address"] != "10.0.0.5" {
+		t.Errorf("unexpected facts file: %s", data)
+	}
+	if !reflect.DeepEqual(report.exportedFacts(), written) {
+		t.Errorf("expected the recorded facts to match the file, got %v", report.exportedFacts())
+	}
+}
+
+func TestValidateFactExport(t *testing.T) {
+	tests := []struct {
+		name      string
+		names     []string
+		factsFile string
+		caching   string
+		wantErr   bool
+	}{
+		{name: "disabled", names: nil},
+		{name: "names", names: []string{"kernel"}, factsFile: "facts.json"},
+		{name: "all", names: []string{"all"}, caching: "jsonfile"},
+		{name: "facts file alone", factsFile: "facts.json", wantErr: true},
+		{name: "other cache", names: []string{"kernel"}, caching: "redis", wantErr: true},
+		{name: "all and names", names: []string{"all", "kernel"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFactExport(tt.names, tt.factsFile, tt.caching)
+			if tt.wantErr != errors.Is(err, ErrInvalidParameter) {
+				t.Errorf("validateFactExport() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
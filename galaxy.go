@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	cli "github.com/urfave/cli/v3"
+)
+
+const (
+	// galaxyCacheKeyPrefix starts every Galaxy cache key and the name of
+	// every cache entry.
+	galaxyCacheKeyPrefix = "galaxy-"
+	// galaxyCacheComplete marks a cache entry whose install finished.
+	galaxyCacheComplete = ".complete"
+	// Ansible's default search paths, used when neither the environment nor
+	// ansible.cfg sets one.
+	defaultCollectionsPath = "~/.ansible/collections:/usr/share/ansible/collections"
+	defaultRolesPath       = "~/.ansible/roles:/usr/share/ansible/roles:/etc/ansible/roles"
+)
+
+// galaxyInstall holds the ansible-galaxy install settings taken from the
+// galaxy-* inputs. The wrapper installs the requirements itself, once and
+// before the first attempt, so the install has a timeout of its own.
+type galaxyInstall struct {
+	file                        string
+	cacheDir                    string
+	vendorDir                   string
+	rolesPath                   string
+	lock                        bool
+	frozen                      bool
+	lockFile                    string
+	allowedNamespaces           []string
+	allowedLicenses             []string
+	force                       bool
+	forceWithDeps               bool
+	noDeps                      bool
+	ignoreCerts                 bool
+	apiKey                      string
+	server                      string
+	timeout                     int
+	collectionsPath             string
+	disableGPGVerify            bool
+	ignoreSignatureStatusCodes  []string
+	keyring                     string
+	offline                     bool
+	pre                         bool
+	requiredValidSignatureCount int
+	signature                   string
+	upgrade                     bool
+	// configFile is the config-file input; ansible-galaxy reads its paths
+	// from the ansible.cfg it names.
+	configFile string
+
+	// entry is the cache entry the requirements were found in or installed
+	// to, if galaxy-cache-dir is set.
+	entry string
+	// requirements is the file passed to ansible-galaxy when it is not file,
+	// e.g. the one that installs vendored archives.
+	requirements string
+	// vendored are the archives requirements installs.
+	vendored []vendoredArtifact
+}
+
+// newGalaxyInstall reads the galaxy-* inputs for installing file.
+func newGalaxyInstall(c *cli.Command, file string) *galaxyInstall {
+	lockFile := c.String("galaxy-lock-file")
+	if lockFile == "" {
+		lockFile = defaultLockFile(file)
+	}
+	return &galaxyInstall{
+		file:                        file,
+		cacheDir:                    c.String("galaxy-cache-dir"),
+		vendorDir:                   c.String("galaxy-vendor-dir"),
+		lock:                        c.Bool("galaxy-lock"),
+		frozen:                      c.Bool("galaxy-frozen"),
+		lockFile:                    lockFile,
+		allowedNamespaces:           normalizeSlice(c.StringSlice("galaxy-allowed-namespaces")),
+		allowedLicenses:             normalizeSlice(c.StringSlice("galaxy-allowed-licenses")),
+		force:                       c.Bool("galaxy-force"),
+		forceWithDeps:               c.Bool("galaxy-force-with-deps"),
+		noDeps:                      c.Bool("galaxy-no-deps"),
+		ignoreCerts:                 c.Bool("galaxy-ignore-certs"),
+		apiKey:                      c.String("galaxy-api-key"),
+		server:                      c.String("galaxy-api-server-url"),
+		timeout:                     c.Int("galaxy-timeout"),
+		collectionsPath:             c.String("galaxy-collections-path"),
+		disableGPGVerify:            c.Bool("galaxy-disable-gpg-verify"),
+		ignoreSignatureStatusCodes:  normalizeSlice(c.StringSlice("galaxy-ignore-signature-status-codes")),
+		keyring:                     c.String("galaxy-keyring"),
+		offline:                     c.Bool("galaxy-offline") || c.String("galaxy-vendor-dir") != "",
+		pre:                         c.Bool("galaxy-pre"),
+		requiredValidSignatureCount: c.Int("galaxy-required-valid-signature-count"),
+		signature:                   c.String("galaxy-signature"),
+		upgrade:                     c.Bool("galaxy-upgrade"),
+		configFile:                  c.String("config-file"),
+	}
+}
+
+// commonArgs returns the options role and collection installs share.
+func (g *galaxyInstall) commonArgs() []string {
+	file := g.file
+	if g.requirements != "" {
+		file = g.requirements
+	}
+	args := []string{"-r", file}
+	if g.force {
+		args = append(args, "--force")
+	}
+	if g.forceWithDeps {
+		args = append(args, "--force-with-deps")
+	}
+	if g.noDeps {
+		args = append(args, "--no-deps")
+	}
+	if g.ignoreCerts {
+		args = append(args, "--ignore-certs")
+	}
+	if g.apiKey != "" {
+		args = append(args, "--api-key", g.apiKey)
+	}
+	if g.server != "" {
+		args = append(args, "--server", g.server)
+	}
+	if g.timeout > 0 {
+		args = append(args, "--timeout", strconv.Itoa(g.timeout))
+	}
+	return args
+}
+
+// roleArgs returns the arguments of "ansible-galaxy role install".
+func (g *galaxyInstall) roleArgs() []string {
+	args := append([]string{"role", "install"}, g.commonArgs()...)
+	if g.rolesPath != "" {
+		args = append(args, "--roles-path", g.rolesPath)
+	}
+	return args
+}
+
+// collectionArgs returns the arguments of "ansible-galaxy collection install".
+func (g *galaxyInstall) collectionArgs() []string {
+	args := append([]string{"collection", "install"}, g.commonArgs()...)
+	if g.collectionsPath != "" {
+		args = append(args, "--collections-path", g.collectionsPath)
+	}
+	if g.disableGPGVerify {
+		args = append(args, "--disable-gpg-verify")
+	}
+	for _, code := range g.ignoreSignatureStatusCodes {
+		args = append(args, "--ignore-signature-status-code", code)
+	}
+	if g.keyring != "" {
+		args = append(args, "--keyring", g.keyring)
+	}
+	if g.offline {
+		args = append(args, "--offline")
+	}
+	if g.pre {
+		args = append(args, "--pre")
+	}
+	if g.requiredValidSignatureCount > 0 {
+		args = append(args, "--required-valid-signature-count", strconv.Itoa(g.requiredValidSignatureCount))
+	}
+	if g.signature != "" {
+		args = append(args, "--signature", g.signature)
+	}
+	if g.upgrade {
+		args = append(args, "--upgrade")
+	}
+	return args
+}
+
+// run installs the roles and then the collections of the requirements file.
+// env is added to the wrapper's environment, e.g. for the ssh-agent that
+// roles from private Git repositories need. When ctx ends, ansible-galaxy
+// gets SIGINT and is killed after grace, or right away if grace is zero.
+func (g *galaxyInstall) run(ctx context.Context, env map[string]string, grace time.Duration) error {
+	if _, err := exec.LookPath("ansible-galaxy"); err != nil {
+		return fmt.Errorf("ansible-galaxy is not installed: %w", err)
+	}
+	log.Printf("Installing Galaxy requirements from %s", g.file)
+	for _, args := range [][]string{g.roleArgs(), g.collectionArgs()} {
+		if err := runCommand(ctx, env, grace, "ansible-galaxy", args...); err != nil {
+			return fmt.Errorf("ansible-galaxy %s install failed: %w", args[0], err)
+		}
+	}
+	return nil
+}
+
+// galaxyPhase describes the Galaxy install for the step summary. CacheKey is
+// set when galaxy-cache-dir is, and CacheHit when the install was skipped.
+type galaxyPhase struct {
+	Attempts int
+	Duration time.Duration
+	Failed   bool
+	CacheKey string
+	CacheHit bool
+}
+
+// validateGalaxyCache rejects a collections path next to the cache, which
+// decides where collections are installed.
+func validateGalaxyCache(cacheDir, collectionsPath string) error {
+	if cacheDir != "" && collectionsPath != "" {
+		return fmt.Errorf("%w: galaxy-cache-dir cannot be combined with galaxy-collections-path", ErrInvalidParameter)
+	}
+	return nil
+}
+
+// installGalaxyRequirements runs g under policy, inside a log group if group
+// is set, then checks the allow-lists, writes or checks the lock file and
+// records how long it all took in report. A failed install is reported as
+// ErrGalaxyFailed, so it is not mistaken for a playbook failure.
+func installGalaxyRequirements(ctx context.Context, g *galaxyInstall, policy retryPolicy, env map[string]string, grace time.Duration, group bool, report *runReport) error {
+	if group {
+		fmt.Println("::group::Install Galaxy requirements")
+		defer fmt.Println("::endgroup::")
+	}
+	start := time.Now()
+	phase := galaxyPhase{}
+	err := g.install(ctx, policy, env, grace, &phase)
+	if err == nil {
+		err = g.checkPolicy()
+	}
+	if err == nil {
+		err = g.applyLock()
+	}
+	phase.Duration = time.Since(start)
+	phase.Failed = err != nil
+	report.recordGalaxy(phase)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrGalaxyFailed, err)
+	}
+	if !phase.CacheHit {
+		log.Printf("Galaxy requirements installed in %s", formatDuration(phase.Duration))
+	}
+	return nil
+}
+
+// install runs g under policy. With a cache directory, it looks the
+// requirements up in the cache first and otherwise installs them into a new
+// entry, which replaces the entries of older requirements.
+func (g *galaxyInstall) install(ctx context.Context, policy retryPolicy, env map[string]string, grace time.Duration, phase *galaxyPhase) error {
+	if g.vendorDir != "" {
+		path, err := g.vendor()
+		if err != nil {
+			return err
+		}
+		defer func() { _ = os.Remove(path) }()
+	}
+	if g.cacheDir == "" {
+		return execWithRetry(ctx, policy, func(ctx context.Context) error {
+			phase.Attempts++
+			return g.run(ctx, env, grace)
+		})
+	}
+
+	cacheDir, err := filepath.Abs(g.cacheDir)
+	if err != nil {
+		return fmt.Errorf("invalid galaxy-cache-dir: %w", err)
+	}
+	version, err := galaxyVersion(ctx)
+	if err != nil {
+		return err
+	}
+	key, err := g.cacheKey(version)
+	if err != nil {
+		return err
+	}
+	phase.CacheKey = key
+	entry := filepath.Join(cacheDir, key)
+	if _, err := os.Stat(filepath.Join(entry, galaxyCacheComplete)); err == nil {
+		log.Printf("Galaxy cache hit: %s", key)
+		phase.CacheHit = true
+		g.entry = entry
+		return nil
+	}
+	log.Printf("Galaxy cache miss: %s", key)
+
+	// Install into a staging directory that becomes the entry once complete,
+	// so a failed or cancelled install never looks like a cache hit.
+	// #nosec G301 -- the cache lives in the workspace and is saved by a later
+	// step, e.g. actions/cache, which may run as a different user.
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return fmt.Errorf("failed to create galaxy-cache-dir: %w", err)
+	}
+	staging, err := os.MkdirTemp(cacheDir, ".install-")
+	if err != nil {
+		return fmt.Errorf("failed to create Galaxy cache entry: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(staging) }()
+	// #nosec G302 -- see above; MkdirTemp creates the directory as 0700.
+	if err := os.Chmod(staging, 0755); err != nil {
+		return fmt.Errorf("failed to create Galaxy cache entry: %w", err)
+	}
+	staged := *g
+	staged.rolesPath = filepath.Join(staging, "roles")
+	staged.collectionsPath = filepath.Join(staging, "collections")
+	err = execWithRetry(ctx, policy, func(ctx context.Context) error {
+		phase.Attempts++
+		return staged.run(ctx, env, grace)
+	})
+	if err != nil {
+		return err
+	}
+	// #nosec G306 -- the marker is saved with the rest of the cache.
+	if err := os.WriteFile(filepath.Join(staging, galaxyCacheComplete), []byte(version+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to complete Galaxy cache entry: %w", err)
+	}
+	if err := os.RemoveAll(entry); err != nil {
+		return fmt.Errorf("failed to replace Galaxy cache entry: %w", err)
+	}
+	if err := os.Rename(staging, entry); err != nil {
+		return fmt.Errorf("failed to complete Galaxy cache entry: %w", err)
+	}
+	g.entry = entry
+	pruneCache(cacheDir, galaxyCacheKeyPrefix, key)
+	return nil
+}
+
+// vendor resolves the requirements to the archives in the vendor directory
+// and writes a requirements file that installs them. The caller removes the
+// file at the returned path.
+func (g *galaxyInstall) vendor() (string, error) {
+	// #nosec G304 -- the requirements file is an input of the workflow.
+	data, err := os.ReadFile(g.file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read galaxy file: %w", err)
+	}
+	reqs, err := parseRequirements(data)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", g.file, err)
+	}
+	artifacts, err := resolveVendored(reqs, g.vendorDir, g.file)
+	if err != nil {
+		return "", err
+	}
+	vendored, err := vendoredRequirements(reqs, artifacts)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp("", "galaxy-vendored-*.yml")
+	if err != nil {
+		return "", fmt.Errorf("failed to create vendored requirements file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := f.Write(vendored); err != nil {
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write vendored requirements file: %w", err)
+	}
+	g.requirements, g.vendored = f.Name(), artifacts
+	log.Printf("Installing %d Galaxy requirement(s) from archives in %s", len(artifacts), g.vendorDir)
+	return f.Name(), nil
+}
+
+// galaxyVersion returns the first line of "ansible-galaxy --version", e.g.
+// "ansible-galaxy [core 2.17.1]".
+func galaxyVersion(ctx context.Context) (string, error) {
+	if _, err := exec.LookPath("ansible-galaxy"); err != nil {
+		return "", fmt.Errorf("ansible-galaxy is not installed: %w", err)
+	}
+	out, err := exec.CommandContext(ctx, "ansible-galaxy", "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("could not determine the Ansible version: %w", err)
+	}
+	version, _, _ := strings.Cut(string(bytes.TrimSpace(out)), "\n")
+	return version, nil
+}
+
+// cacheKey hashes the requirements file together with the Ansible version,
+// the options that change what gets installed and the name and content of
+// every vendored archive.
+func (g *galaxyInstall) cacheKey(version string) (string, error) {
+	// #nosec G304 -- the requirements file is an input of the workflow.
+	data, err := os.ReadFile(g.file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read galaxy file: %w", err)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\nserver=%s\npre=%t\nno-deps=%t\nupgrade=%t\nforce=%t\nforce-with-deps=%t\n",
+		version, g.server, g.pre, g.noDeps, g.upgrade, g.force, g.forceWithDeps)
+	fmt.Fprintf(h, "disable-gpg-verify=%t\nkeyring=%s\nrequired-valid-signature-count=%d\nsignature=%s\nignore-signature-status-codes=%s\n",
+		g.disableGPGVerify, g.keyring, g.requiredValidSignatureCount, g.signature, strings.Join(g.ignoreSignatureStatusCodes, ","))
+	for _, a := range g.vendored {
+		sum, err := hashFile(a.path)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash vendored archive: %w", err)
+		}
+		fmt.Fprintf(h, "vendored=%s %s\n", filepath.Base(a.path), sum)
+	}
+	h.Write([]byte("\n"))
+	h.Write(data)
+	return galaxyCacheKeyPrefix + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// pruneCache removes the entries of other cache keys with the given prefix
+// from dir, so a cache that is restored and saved again does not keep growing.
+func pruneCache(dir, prefix, key string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Warning: could not prune cache %s: %v", dir, err)
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != key && strings.HasPrefix(e.Name(), prefix) {
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				log.Printf("Warning: could not remove stale cache entry %s: %v", e.Name(), err)
+			}
+		}
+	}
+}
+
+// env returns the environment that points Ansible at the paths the
+// requirements were installed to: the cache entry, if they came from the
+// cache, or else galaxy-collections-path and the roles path, if set. They are
+// put in front of the search paths from the environment or ansible.cfg, so
+// content installed there stays visible.
+func (g *galaxyInstall) env() map[string]string {
+	collections, roles := g.collectionsPath, g.rolesPath
+	if g.entry != "" {
+		collections, roles = filepath.Join(g.entry, "collections"), filepath.Join(g.entry, "roles")
+	}
+	env := make(map[string]string, 2)
+	if collections != "" {
+		env["ANSIBLE_COLLECTIONS_PATH"] = collections + ":" + collectionsSearchPath(g.configFile)
+	}
+	if roles != "" {
+		env["ANSIBLE_ROLES_PATH"] = roles + ":" + rolesSearchPath(g.configFile)
+	}
+	return env
+}
+
+// galaxyEnv returns the environment of the Galaxy install: the wrapper's
+// extra environment, e.g. the ssh-agent socket, and the Ansible configuration
+// file, which may list Galaxy servers.
+func galaxyEnv(c *cli.Command, extraEnv map[string]string) map[string]string {
+	env := make(map[string]string, len(extraEnv)+1)
+	for k, v := range extraEnv {
+		env[k] = v
+	}
+	if configFile := c.String("config-file"); configFile != "" {
+		env["ANSIBLE_CONFIG"] = configFile
+	}
+	return env
+}
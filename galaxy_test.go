@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeGalaxy puts an ansible-galaxy script into PATH that appends its
+// arguments and GALAXY_TEST_ENV to a log file and then runs body.
+func fakeGalaxy(t *testing.T, body string) string {
+	t.Helper()
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "calls.log")
+	script := "#!/bin/sh\necho \"$* env=$GALAXY_TEST_ENV\" >> " + logFile + "\n" + body + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "ansible-galaxy"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":/usr/bin:/bin")
+	return logFile
+}
+
+func TestGalaxyInstall_Args(t *testing.T) {
+	g := &galaxyInstall{
+		file:                        "requirements.yml",
+		force:                       true,
+		server:                      "https://galaxy.example.com",
+		timeout:                     30,
+		collectionsPath:             "/tmp/collections",
+		offline:                     true,
+		requiredValidSignatureCount: 2,
+		ignoreSignatureStatusCodes:  []string{"NO_PUBKEY"},
+	}
+
+	wantRole := []string{"role", "install", "-r", "requirements.yml", "--force", "--server", "https://galaxy.example.com", "--timeout", "30"}
+	if got := g.roleArgs(); !slices.Equal(got, wantRole) {
+		t.Errorf("role args:\n got %q\nwant %q", got, wantRole)
+	}
+	collection := strings.Join(g.collectionArgs(), " ")
+	for _, want := range []string{
+		"collection install -r requirements.yml --force",
+		"--collections-path /tmp/collections",
+		"--ignore-signature-status-code NO_PUBKEY",
+		"--offline",
+		"--required-valid-signature-count 2",
+	} {
+		if !strings.Contains(collection, want) {
+			t.Errorf("collection args %q lack %q", collection, want)
+		}
+	}
+}
+
+func TestGalaxyInstall_RunsRolesThenCollections(t *testing.T) {
+	logFile := fakeGalaxy(t, "exit 0")
+	g := &galaxyInstall{file: "requirements.yml"}
+
+	if err := g.run(context.Background(), map[string]string{"GALAXY_TEST_ENV": "set"}, time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "role install -r requirements.yml env=set\ncollection install -r requirements.yml env=set\n"
+	if string(data) != want {
+		t.Errorf("unexpected calls:\n%s", data)
+	}
+}
+
+func TestGalaxyInstall_StopsOnRoleFailure(t *testing.T) {
+	logFile := fakeGalaxy(t, "exit 1")
+	g := &galaxyInstall{file: "requirements.yml"}
+
+	err := g.run(context.Background(), nil, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "ansible-galaxy role install failed") {
+		t.Fatalf("expected the role install to fail, got %v", err)
+	}
+	data, _ := os.ReadFile(logFile)
+	if strings.Contains(string(data), "collection") {
+		t.Error("expected no collection install after a failed role install")
+	}
+}
+
+func TestGalaxyInstall_PhaseTimeout(t *testing.T) {
+	fakeGalaxy(t, "sleep 5")
+	g := &galaxyInstall{file: "requirements.yml"}
+
+	ctx, cancel := phaseContext(context.Background(), phaseGalaxy, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := interruptedError(ctx, g.run(ctx, nil, 100*time.Millisecond))
+	if time.Since(start) > 3*time.Second {
+		t.Fatal("expected the install to be stopped at the phase timeout")
+	}
+	var te *timeoutError
+	if !errors.Is(err, ErrTimedOut) || !errors.As(err, &te) || te.phase != phaseGalaxy {
+		t.Fatalf("expected a galaxy-install timeout, got %v", err)
+	}
+}
+
+func TestGalaxyInstall_NotInstalled(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	g := &galaxyInstall{file: "requirements.yml"}
+	if err := g.run(context.Background(), nil, 0); err == nil || !strings.Contains(err.Error(), "not installed") {
+		t.Fatalf("expected a not-installed error, got %v", err)
+	}
+}
+
+func TestInstallGalaxyRequirements_RetriesTransientFailure(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "failed-once")
+	logFile := fakeGalaxy(t, "if [ ! -f "+marker+" ]; then touch "+marker+"; exit 1; fi")
+	report := newRunReport()
+
+	err := installGalaxyRequirements(context.Background(), &galaxyInstall{file: "requirements.yml"}, retryPolicy{retries: 2}, nil, time.Second, false, report)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	phase := report.galaxyRecord()
+	if phase == nil || phase.Attempts != 2 || phase.Failed {
+		t.Errorf("expected a successful second attempt, got %+v", phase)
+	}
+	data, _ := os.ReadFile(logFile)
+	if n := strings.Count(string(data), "role install"); n != 2 {
+		t.Errorf("expected the role install to run twice, ran %d times", n)
+	}
+}
+
+func TestInstallGalaxyRequirements_Failure(t *testing.T) {
+	fakeGalaxy(t, "exit 1")
+	report := newRunReport()
+
+	err := installGalaxyRequirements(context.Background(), &galaxyInstall{file: "requirements.yml"}, retryPolicy{retries: 1}, nil, time.Second, false, report)
+	if !errors.Is(err, ErrGalaxyFailed) || errors.Is(err, ErrPlaybookExecution) {
+		t.Fatalf("expected ErrGalaxyFailed, got %v", err)
+	}
+	if phase := report.galaxyRecord(); phase == nil || phase.Attempts != 2 || !phase.Failed {
+		t.Errorf("expected two failed attempts, got %+v", phase)
+	}
+}
+
+// fakeGalaxyVersion answers "ansible-galaxy --version" and otherwise runs body.
+func fakeGalaxyVersion(t *testing.T, version, body string) string {
+	t.Helper()
+	return fakeGalaxy(t, "if [ \"$1\" = --version ]; then echo '"+version+"'; echo '  config file = None'; exit 0; fi\n"+body)
+}
+
+func TestGalaxyInstall_CacheKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "requirements.yml")
+	if err := os.WriteFile(file, []byte("collections:\n  - community.general\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	g := &galaxyInstall{file: file}
+
+	key, err := g.cacheKey("ansible-galaxy [core 2.17.1]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, galaxyCacheKeyPrefix) || len(key) != len(galaxyCacheKeyPrefix)+64 {
+		t.Errorf("unexpected key %q", key)
+	}
+	if again, _ := g.cacheKey("ansible-galaxy [core 2.17.1]"); again != key {
+		t.Error("expected the same key for the same inputs")
+	}
+	if other, _ := g.cacheKey("ansible-galaxy [core 2.18.0]"); other == key {
+		t.Error("expected another Ansible version to change the key")
+	}
+	for name, set := range map[string]func(*galaxyInstall){
+		"--pre":                            func(g *galaxyInstall) { g.pre = true },
+		"--upgrade":                        func(g *galaxyInstall) { g.upgrade = true },
+		"--force":                          func(g *galaxyInstall) { g.force = true },
+		"--force-with-deps":                func(g *galaxyInstall) { g.forceWithDeps = true },
+		"--disable-gpg-verify":             func(g *galaxyInstall) { g.disableGPGVerify = true },
+		"--keyring":                        func(g *galaxyInstall) { g.keyring = "/keys.kbx" },
+		"--required-valid-signature-count": func(g *galaxyInstall) { g.requiredValidSignatureCount = 2 },
+		"--signature":                      func(g *galaxyInstall) { g.signature = "https://example.com/sig.asc" },
+		"--ignore-signature-status-code":   func(g *galaxyInstall) { g.ignoreSignatureStatusCodes = []string{"EXPSIG"} },
+	} {
+		changed := *g
+		set(&changed)
+		if other, _ := changed.cacheKey("ansible-galaxy [core 2.17.1]"); other == key {
+			t.Errorf("expected %s to change the key", name)
+		}
+	}
+
+	// The name and content of every vendored archive are part of the key.
+	archive := createTempFile(t, filepath.Dir(file), "community-general-8.6.0.tar.gz", "v1")
+	g.vendored = []vendoredArtifact{{path: archive, version: "8.6.0"}}
+	vendored, err := g.cacheKey("ansible-galaxy [core 2.17.1]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vendored == key {
+		t.Error("expected a vendored archive to change the key")
+	}
+	createTempFile(t, filepath.Dir(file), "community-general-8.6.0.tar.gz", "v2")
+	if other, _ := g.cacheKey("ansible-galaxy [core 2.17.1]"); other == vendored {
+		t.Error("expected a changed vendored archive to change the key")
+	}
+}
+
+func TestInstallGalaxyRequirements_Cache(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "requirements.yml")
+	if err := os.WriteFile(file, []byte("collections:\n  - community.general\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := filepath.Join(dir, "cache")
+	logFile := fakeGalaxyVersion(t, "ansible-galaxy [core 2.17.1]", "exit 0")
+
+	// A miss installs into a new entry.
+	miss := &galaxyInstall{file: file, cacheDir: cacheDir}
+	report := newRunReport()
+	if err := installGalaxyRequirements(context.Background(), miss, retryPolicy{}, nil, time.Second, false, report); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	phase := report.galaxyRecord()
+	if phase.CacheHit || phase.CacheKey == "" {
+		t.Fatalf("expected a cache miss with a key, got %+v", phase)
+	}
+	entry := filepath.Join(cacheDir, phase.CacheKey)
+	if _, err := os.Stat(filepath.Join(entry, galaxyCacheComplete)); err != nil {
+		t.Errorf("expected a completed cache entry: %v", err)
+	}
+	if env := miss.env(); !strings.HasPrefix(env["ANSIBLE_COLLECTIONS_PATH"], filepath.Join(entry, "collections")+":") ||
+		!strings.HasPrefix(env["ANSIBLE_ROLES_PATH"], filepath.Join(entry, "roles")+":") {
+		t.Errorf("expected Ansible to be pointed at the entry, got %v", env)
+	}
+	data, _ := os.ReadFile(logFile)
+	if !strings.Contains(string(data), "--roles-path "+cacheDir+"/.install-") || !strings.Contains(string(data), "--collections-path "+cacheDir+"/.install-") {
+		t.Errorf("expected the install to target a staging directory:\n%s", data)
+	}
+
+	// A hit skips the install.
+	if err := os.Remove(logFile); err != nil {
+		t.Fatal(err)
+	}
+	hit := &galaxyInstall{file: file, cacheDir: cacheDir}
+	if err := installGalaxyRequirements(context.Background(), hit, retryPolicy{}, nil, time.Second, false, report); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if phase := report.galaxyRecord(); !phase.CacheHit || phase.Attempts != 0 {
+		t.Errorf("expected a cache hit, got %+v", phase)
+	}
+	data, _ = os.ReadFile(logFile)
+	if strings.Contains(string(data), "install") {
+		t.Errorf("expected no install on a cache hit:\n%s", data)
+	}
+	if hit.env()["ANSIBLE_ROLES_PATH"] != miss.env()["ANSIBLE_ROLES_PATH"] {
+		t.Error("expected the hit to use the same entry")
+	}
+
+	// New requirements replace the old entry.
+	if err := os.WriteFile(file, []byte("collections:\n  - ansible.posix\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := installGalaxyRequirements(context.Background(), &galaxyInstall{file: file, cacheDir: cacheDir}, retryPolicy{}, nil, time.Second, false, report); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(entry); !os.IsNotExist(err) {
+		t.Errorf("expected the stale entry to be pruned, got %v", err)
+	}
+}
+
+func TestInstallGalaxyRequirements_FailedInstallIsNotCached(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "requirements.yml")
+	if err := os.WriteFile(file, []byte("roles: []\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := filepath.Join(dir, "cache")
+	fakeGalaxyVersion(t, "ansible-galaxy [core 2.17.1]", "exit 1")
+
+	g := &galaxyInstall{file: file, cacheDir: cacheDir}
+	if err := installGalaxyRequirements(context.Background(), g, retryPolicy{}, nil, time.Second, false, newRunReport()); !errors.Is(err, ErrGalaxyFailed) {
+		t.Fatalf("expected ErrGalaxyFailed, got %v", err)
+	}
+	entries, _ := os.ReadDir(cacheDir)
+	if len(entries) != 0 {
+		t.Errorf("expected an empty cache, got %d entries", len(entries))
+	}
+	if env := g.env(); len(env) != 0 {
+		t.Errorf("expected no environment without an entry, got %v", env)
+	}
+}
+
+func TestGalaxyInstall_EnvWithoutCache(t *testing.T) {
+	t.Setenv("ANSIBLE_COLLECTIONS_PATH", "")
+	t.Setenv("ANSIBLE_COLLECTIONS_PATHS", "")
+	cfg := createTempFile(t, t.TempDir(), "ansible.cfg", "[defaults]\n")
+	g := &galaxyInstall{collectionsPath: "/opt/collections", configFile: cfg}
+	env := g.env()
+	if env["ANSIBLE_COLLECTIONS_PATH"] != "/opt/collections:"+defaultCollectionsPath {
+		t.Errorf("expected galaxy-collections-path to be exported, got %v", env)
+	}
+	if _, ok := env["ANSIBLE_ROLES_PATH"]; ok {
+		t.Errorf("expected no roles path without one, got %v", env)
+	}
+}
+
+func TestGalaxyInstall_EnvKeepsSearchPaths(t *testing.T) {
+	t.Setenv("ANSIBLE_COLLECTIONS_PATH", "")
+	t.Setenv("ANSIBLE_COLLECTIONS_PATHS", "")
+	t.Setenv("ANSIBLE_ROLES_PATH", "/srv/roles")
+	dir := t.TempDir()
+	cfg := createTempFile(t, dir, "ansible.cfg", "[defaults]\ncollections_path = ./collections:/usr/share/collections\nroles_path = ./roles\n")
+	g := &galaxyInstall{entry: "/cache/entry", configFile: cfg}
+	env := g.env()
+	if want := "/cache/entry/collections:" + filepath.Join(dir, "collections") + ":/usr/share/collections"; env["ANSIBLE_COLLECTIONS_PATH"] != want {
+		t.Errorf("expected the ansible.cfg collections path to be kept, got %q, want %q", env["ANSIBLE_COLLECTIONS_PATH"], want)
+	}
+	if want := "/cache/entry/roles:/srv/roles"; env["ANSIBLE_ROLES_PATH"] != want {
+		t.Errorf("expected the roles path from the environment to be kept, got %q, want %q", env["ANSIBLE_ROLES_PATH"], want)
+	}
+}
+
+func TestValidateGalaxyCache(t *testing.T) {
+	if err := validateGalaxyCache(".galaxy", ""); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validateGalaxyCache(".galaxy", "/tmp/collections"); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("expected ErrInvalidParameter, got %v", err)
+	}
+}
@@ -6,4 +6,5 @@ require (
 	github.com/arillso/go.ansible/v2 v2.0.0
 	github.com/joho/godotenv v1.5.1
 	github.com/urfave/cli/v3 v3.10.1
+	gopkg.in/yaml.v3 v3.0.1
 )
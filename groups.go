@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Log grouping granularities accepted by --log-groups.
+const (
+	logGroupsNone = "none"
+	logGroupsPlay = "play"
+	logGroupsTask = "task"
+)
+
+// logGroupWriter wraps Ansible's stdout in ::group:: / ::endgroup:: workflow
+// commands so the Actions log folds each play or task. GitHub does not nest
+// groups, so in task mode the PLAY banners stay outside any group.
+type logGroupWriter struct {
+	out   io.Writer
+	mode  string
+	open  bool
+	lines *lineWriter
+}
+
+// newLogGroupWriter returns a writer that forwards everything to out, adding
+// group commands around plays or tasks depending on mode.
+func newLogGroupWriter(out io.Writer, mode string) *logGroupWriter {
+	g := &logGroupWriter{out: out, mode: mode}
+	g.lines = newLineWriter(g.handleLine)
+	return g
+}
+
+// Write implements io.Writer. Output is forwarded line by line.
+func (g *logGroupWriter) Write(p []byte) (int, error) {
+	return g.lines.Write(p)
+}
+
+// Flush forwards a pending partial line and closes an open group. It is called
+// after every attempt so a retried run starts outside any group.
+func (g *logGroupWriter) Flush() {
+	g.lines.Flush()
+	g.endGroup()
+}
+
+// handleLine forwards one line, opening or closing a group first when the
+// line is a play, task or recap banner.
+func (g *logGroupWriter) handleLine(line string) {
+	header := strings.TrimSpace(stripANSI(line))
+	if strings.HasPrefix(header, "PLAY RECAP") {
+		g.endGroup()
+	} else if m := headerLine.FindStringSubmatch(header); m != nil {
+		switch {
+		case m[1] == "PLAY" && g.mode == logGroupsPlay:
+			g.startGroup(header)
+		case m[1] == "PLAY":
+			g.endGroup()
+		case g.mode == logGroupsTask:
+			g.startGroup(header)
+		}
+	}
+	_, _ = fmt.Fprintln(g.out, line)
+}
+
+// startGroup closes an open group and opens a new one titled after the banner.
+func (g *logGroupWriter) startGroup(banner string) {
+	g.endGroup()
+	title := strings.TrimSpace(strings.TrimRight(banner, "*"))
+	_, _ = fmt.Fprintf(g.out, "::group::%s\n", escapeWorkflowData(title))
+	g.open = true
+}
+
+// endGroup closes the open group, if any.
+func (g *logGroupWriter) endGroup() {
+	if !g.open {
+		return
+	}
+	_, _ = fmt.Fprintln(g.out, "::endgroup::")
+	g.open = false
+}
+
+// escapeWorkflowData escapes the message part of a workflow command so it
+// cannot terminate the command or smuggle in another one.
+func escapeWorkflowData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// inGitHubActions reports whether the wrapper runs on a GitHub Actions runner,
+// where workflow commands are understood.
+func inGitHubActions() bool {
+	return os.Getenv("GITHUB_ACTIONS") == "true"
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// sampleRun is a trimmed default-callback run with two plays.
+const sampleRun = `PLAY [web] *********
+
+TASK [Gathering Facts] *****
+ok: [web1]
+
+TASK [Install nginx] *****
+changed: [web1]
+
+RUNNING HANDLER [restart nginx] *****
+changed: [web1]
+
+PLAY [db] *********
+
+TASK [Install postgres] *****
+ok: [db1]
+
+PLAY RECAP *********
+web1 : ok=3 changed=2 unreachable=0 failed=0
+`
+
+func TestLogGroupWriter_Play(t *testing.T) {
+	var out bytes.Buffer
+	g := newLogGroupWriter(&out, logGroupsPlay)
+	_, _ = g.Write([]byte(sampleRun))
+	g.Flush()
+
+	got := out.String()
+	if strings.Count(got, "::group::") != 2 || strings.Count(got, "::endgroup::") != 2 {
+		t.Fatalf("expected two play groups, got:\n%s", got)
+	}
+	if !strings.Contains(got, "::group::PLAY [web]\nPLAY [web] *********\n") {
+		t.Errorf("expected the play banner to open its group, got:\n%s", got)
+	}
+	if !strings.Contains(got, "ok: [db1]\n\n::endgroup::\nPLAY RECAP") {
+		t.Errorf("expected the recap outside any group, got:\n%s", got)
+	}
+}
+
+func TestLogGroupWriter_Task(t *testing.T) {
+	var out bytes.Buffer
+	g := newLogGroupWriter(&out, logGroupsTask)
+	_, _ = g.Write([]byte(sampleRun))
+	g.Flush()
+
+	got := out.String()
+	if strings.Count(got, "::group::") != 4 || strings.Count(got, "::endgroup::") != 4 {
+		t.Fatalf("expected four task groups, got:\n%s", got)
+	}
+	if !strings.Contains(got, "::group::RUNNING HANDLER [restart nginx]\n") {
+		t.Errorf("expected handlers to be grouped like tasks, got:\n%s", got)
+	}
+	if !strings.Contains(got, "changed: [web1]\n\n::endgroup::\nPLAY [db]") {
+		t.Errorf("expected the PLAY banner outside any group, got:\n%s", got)
+	}
+}
+
+func TestLogGroupWriter_FlushClosesOpenGroup(t *testing.T) {
+	var out bytes.Buffer
+	g := newLogGroupWriter(&out, logGroupsPlay)
+	_, _ = g.Write([]byte("PLAY [web] ***\nfatal: [web1]: FAILED!"))
+	g.Flush()
+	if !strings.HasSuffix(out.String(), "fatal: [web1]: FAILED!\n::endgroup::\n") {
+		t.Errorf("expected the partial line and a closing endgroup, got:\n%s", out.String())
+	}
+}
+
+func TestLogGroupWriter_ColoredBanner(t *testing.T) {
+	var out bytes.Buffer
+	g := newLogGroupWriter(&out, logGroupsPlay)
+	_, _ = g.Write([]byte("\x1b[0;32mPLAY [100% done] ***\x1b[0m\n"))
+	if !strings.HasPrefix(out.String(), "::group::PLAY [100%25 done]\n\x1b[0;32mPLAY") {
+		t.Errorf("expected an escaped, color-free group title, got %q", out.String())
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// checkIdempotence runs the playbooks a second time through exec — the same
+// attempt function the first run used — and fails if anything changed. The
+// report keeps the first run's results, with the second run's changes recorded
+// on top. If the second run fails outright, its report is kept instead so the
+// failure can be diagnosed.
+func checkIdempotence(ctx context.Context, report *runReport, exec func(ctx context.Context) error) error {
+	log.Printf("Running playbooks a second time to check idempotence")
+	first := report.snapshot()
+	if err := exec(ctx); err != nil {
+		report.recordIdempotence(report.changedTasks())
+		return fmt.Errorf("idempotence check run failed: %w", err)
+	}
+	changes := report.changedTasks()
+	report.restore(first)
+	report.recordIdempotence(changes)
+	if len(changes) > 0 {
+		return fmt.Errorf("%w: %d task result(s) changed on the second run", ErrNotIdempotent, len(changes))
+	}
+	log.Printf("Idempotence check passed: the second run reported no changes")
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// fakePasses returns an exec function that replays one pass per call into
+// report, the way the real attempt closure resets and refills it.
+func fakePasses(report *runReport, passes ...func()) func(ctx context.Context) error {
+	calls := 0
+	return func(ctx context.Context) error {
+		report.reset()
+		report.setStreaming()
+		passes[calls]()
+		calls++
+		return nil
+	}
+}
+
+func TestCheckIdempotence_Passes(t *testing.T) {
+	report := newRunReport()
+	exec := fakePasses(report,
+		func() {
+			report.recordResult(taskResult{Host: "web1", Play: "Web", Task: "Render config", Status: "changed"})
+			report.recordStats("web1", hostStats{Ok: 2, Changed: 1})
+		},
+		func() {
+			report.recordResult(taskResult{Host: "web1", Play: "Web", Task: "Render config", Status: "ok"})
+			report.recordStats("web1", hostStats{Ok: 2})
+		},
+	)
+	if err := exec(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkIdempotence(context.Background(), report, exec); err != nil {
+		t.Fatalf("expected idempotent run, got %v", err)
+	}
+	changes, checked := report.idempotence()
+	if !checked || len(changes) != 0 {
+		t.Errorf("expected a clean check, got checked=%t changes=%+v", checked, changes)
+	}
+	if got := report.changedHosts(); len(got) != 1 || got[0] != "web1" {
+		t.Errorf("expected the first run's recap to be kept, got changed hosts %v", got)
+	}
+}
+
+func TestCheckIdempotence_ReportsChanges(t *testing.T) {
+	report := newRunReport()
+	exec := fakePasses(report,
+		func() {
+			report.recordResult(taskResult{Host: "web1", Play: "Web", Task: "Render config", Status: "changed"})
+			report.recordStats("web1", hostStats{Ok: 1, Changed: 1})
+		},
+		func() {
+			report.recordResult(taskResult{Host: "web1", Play: "Web", Task: "Render config", Path: "site.yml:7", Status: "changed"})
+			report.recordResult(taskResult{Host: "web1", Play: "Web", Task: "Ping", Status: "ok"})
+			report.recordStats("web1", hostStats{Ok: 2, Changed: 1})
+		},
+	)
+	if err := exec(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	err := checkIdempotence(context.Background(), report, exec)
+	if !errors.Is(err, ErrNotIdempotent) {
+		t.Fatalf("expected ErrNotIdempotent, got %v", err)
+	}
+	changes, _ := report.idempotence()
+	want := taskChange{Host: "web1", Play: "Web", Task: "Render config", Path: "site.yml:7"}
+	if len(changes) != 1 || changes[0] != want {
+		t.Errorf("expected %+v, got %+v", want, changes)
+	}
+	if got := report.totals(); got.Ok != 1 {
+		t.Errorf("expected the first run's totals to be kept, got %+v", got)
+	}
+}
+
+func TestCheckIdempotence_SecondRunFails(t *testing.T) {
+	report := newRunReport()
+	boom := errors.New("boom")
+	calls := 0
+	exec := func(ctx context.Context) error {
+		report.reset()
+		calls++
+		if calls == 2 {
+			report.recordFailure(taskFailure{Host: "web1", Task: "Restart"})
+			return boom
+		}
+		return nil
+	}
+	if err := exec(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	err := checkIdempotence(context.Background(), report, exec)
+	if !errors.Is(err, boom) || errors.Is(err, ErrNotIdempotent) {
+		t.Fatalf("expected the second run's error, got %v", err)
+	}
+	if len(report.failedTasks()) != 1 {
+		t.Errorf("expected the second run's failure to be reported, got %+v", report.failedTasks())
+	}
+}
+
+func TestRunReport_ChangedTasksFromRecap(t *testing.T) {
+	report := newRunReport()
+	report.recordStats("web2", hostStats{Changed: 2})
+	report.recordStats("web1", hostStats{Changed: 1})
+	report.recordStats("db1", hostStats{Ok: 3})
+
+	changes := report.changedTasks()
+	if len(changes) != 2 || changes[0] != (taskChange{Host: "web1"}) || changes[1] != (taskChange{Host: "web2"}) {
+		t.Errorf("expected host-only changes for web1 and web2, got %+v", changes)
+	}
+}
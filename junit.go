@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// junitTestSuites is the root element of a JUnit XML report.
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+// junitTestSuite holds the test cases of one play.
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+// junitTestCase is the result of one task on one host.
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+// junitMessage is the body of a failure, error or skipped element.
+type junitMessage struct {
+	Message string `xml:"message,attr,omitempty"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// buildJUnitReport turns the per-host task results into JUnit test suites:
+// one suite per play and one test case per task and host. Failed tasks become
+// failures typed by their module, unreachable hosts become errors and skipped
+// tasks are marked skipped. Ignored failures count as passed.
+func buildJUnitReport(name string, results []taskResult) junitTestSuites {
+	root := junitTestSuites{Name: name}
+	index := make(map[string]int)
+	var total time.Duration
+	suiteTime := make(map[string]time.Duration)
+
+	for _, r := range results {
+		i, ok := index[r.Play]
+		if !ok {
+			i = len(root.Suites)
+			index[r.Play] = i
+			root.Suites = append(root.Suites, junitTestSuite{Name: r.Play})
+		}
+		suite := &root.Suites[i]
+
+		file, _ := splitTaskPath(r.Path)
+		tc := junitTestCase{
+			Name:      fmt.Sprintf("%s [%s]", r.Task, r.Host),
+			Classname: r.Play,
+			File:      annotationPath(file),
+			Time:      junitSeconds(r.Duration),
+		}
+		switch r.Status {
+		case "failed":
+			tc.Failure = &junitMessage{Message: firstLine(r.Msg), Type: r.Module, Text: r.Msg}
+			suite.Failures++
+		case "unreachable":
+			tc.Error = &junitMessage{Message: firstLine(r.Msg), Type: "unreachable", Text: r.Msg}
+			suite.Errors++
+		case "skipped":
+			tc.Skipped = &junitMessage{Message: r.Msg}
+			suite.Skipped++
+		}
+		suite.Tests++
+		suite.Cases = append(suite.Cases, tc)
+		suiteTime[r.Play] += r.Duration
+		total += r.Duration
+	}
+
+	for i := range root.Suites {
+		s := &root.Suites[i]
+		s.Time = junitSeconds(suiteTime[s.Name])
+		root.Tests += s.Tests
+		root.Failures += s.Failures
+		root.Errors += s.Errors
+		root.Skipped += s.Skipped
+	}
+	root.Time = junitSeconds(total)
+	return root
+}
+
+// renderJUnitReport encodes the report as indented JUnit XML.
+func renderJUnitReport(name string, results []taskResult) ([]byte, error) {
+	data, err := xml.MarshalIndent(buildJUnitReport(name, results), "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode JUnit report: %w", err)
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+// writeJUnitFile writes the JUnit XML report of the last attempt to path.
+func writeJUnitFile(path string, report *runReport) error {
+	data, err := renderJUnitReport("ansible-playbook", report.taskResults())
+	if err != nil {
+		return err
+	}
+	if err := writeArtifactFile(path, data); err != nil {
+		return fmt.Errorf("could not write JUnit report: %w", err)
+	}
+	log.Printf("JUnit report written to %s", path)
+	return nil
+}
+
+// junitSeconds formats a duration the way JUnit expects: seconds with
+// millisecond precision.
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// firstLine returns the first line of s.
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
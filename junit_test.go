@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildJUnitReport(t *testing.T) {
+	results := []taskResult{
+		{Host: "web1", Play: "Web", Task: "Install nginx", Module: "apt", Path: "site.yml:4", Status: "changed", Duration: 1500 * time.Millisecond},
+		{Host: "web2", Play: "Web", Task: "Install nginx", Module: "apt", Path: "site.yml:4", Status: "failed", Msg: "No package matching 'nginx'\nsecond line", Duration: time.Second},
+		{Host: "web1", Play: "Web", Task: "Debug", Module: "debug", Status: "skipped", Msg: "Conditional result was False"},
+		{Host: "db1", Play: "DB", Task: "Gathering Facts", Module: "gather_facts", Status: "unreachable", Msg: "ssh: connect to host db1 port 22: Connection refused"},
+		{Host: "db2", Play: "DB", Task: "Ping", Module: "ping", Status: "ignored", Msg: "boom"},
+	}
+	r := buildJUnitReport("ansible-playbook", results)
+
+	if r.Tests != 5 || r.Failures != 1 || r.Errors != 1 || r.Skipped != 1 || r.Time != "2.500" {
+		t.Errorf("unexpected totals: %+v", r)
+	}
+	if len(r.Suites) != 2 || r.Suites[0].Name != "Web" || r.Suites[1].Name != "DB" {
+		t.Fatalf("expected suites Web and DB in play order, got %+v", r.Suites)
+	}
+	web := r.Suites[0]
+	if web.Tests != 3 || web.Failures != 1 || web.Skipped != 1 || web.Time != "2.500" {
+		t.Errorf("unexpected Web suite counts: %+v", web)
+	}
+	failed := web.Cases[1]
+	if failed.Name != "Install nginx [web2]" || failed.Classname != "Web" || failed.File != "site.yml" {
+		t.Errorf("unexpected test case: %+v", failed)
+	}
+	if failed.Failure == nil || failed.Failure.Type != "apt" || failed.Failure.Message != "No package matching 'nginx'" || !strings.Contains(failed.Failure.Text, "second line") {
+		t.Errorf("unexpected failure: %+v", failed.Failure)
+	}
+	if web.Cases[0].Failure != nil || web.Cases[0].Skipped != nil {
+		t.Errorf("changed task should pass, got %+v", web.Cases[0])
+	}
+	if web.Cases[2].Skipped == nil {
+		t.Errorf("expected skipped test case, got %+v", web.Cases[2])
+	}
+	db := r.Suites[1]
+	if db.Errors != 1 || db.Cases[0].Error == nil || db.Cases[0].Error.Type != "unreachable" {
+		t.Errorf("expected unreachable host as error, got %+v", db)
+	}
+	if db.Cases[1].Failure != nil || db.Cases[1].Error != nil {
+		t.Errorf("ignored failure should pass, got %+v", db.Cases[1])
+	}
+}
+
+func TestRenderJUnitReport(t *testing.T) {
+	data, err := renderJUnitReport("ansible-playbook", []taskResult{
+		{Host: "web1", Play: "Web", Task: "Fail <now>", Module: "fail", Status: "failed", Msg: "a & b"},
+	})
+	if err != nil {
+		t.Fatalf("renderJUnitReport: %v", err)
+	}
+	out := string(data)
+	if !strings.HasPrefix(out, xml.Header) {
+		t.Errorf("expected XML header, got:\n%s", out)
+	}
+	for _, want := range []string{
+		`<testsuites name="ansible-playbook" tests="1" failures="1" errors="0" skipped="0" time="0.000">`,
+		`<testsuite name="Web" tests="1" failures="1" errors="0" skipped="0" time="0.000">`,
+		`<testcase name="Fail &lt;now&gt; [web1]" classname="Web" time="0.000">`,
+		`<failure message="a &amp; b" type="fail">a &amp; b</failure>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in:\n%s", want, out)
+		}
+	}
+
+	var decoded junitTestSuites
+	if err := xml.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("report is not valid XML: %v", err)
+	}
+}
+
+func TestRenderJUnitReport_Empty(t *testing.T) {
+	data, err := renderJUnitReport("ansible-playbook", nil)
+	if err != nil {
+		t.Fatalf("renderJUnitReport: %v", err)
+	}
+	if !strings.Contains(string(data), `<testsuites name="ansible-playbook" tests="0" failures="0" errors="0" skipped="0" time="0.000"></testsuites>`) {
+		t.Errorf("unexpected empty report:\n%s", data)
+	}
+}
+
+func TestWriteJUnitFile_CreatesDirectories(t *testing.T) {
+	report := newRunReport()
+	report.recordResult(taskResult{Host: "web1", Play: "Web", Task: "Ping", Module: "ping", Status: "ok"})
+	path := filepath.Join(t.TempDir(), "reports", "junit.xml")
+
+	if err := writeJUnitFile(path, report); err != nil {
+		t.Fatalf("writeJUnitFile: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading report: %v", err)
+	}
+	if !strings.Contains(string(data), `name="Ping [web1]"`) {
+		t.Errorf("expected test case in report, got:\n%s", data)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	galaxyLockCollections = "collections"
+	galaxyLockRoles       = "roles"
+	// galaxyLockHashPrefix starts the comment line that records the hash of
+	// the requirements file a lock file was written from.
+	galaxyLockHashPrefix = "# requirements-sha256: "
+	// maxLockDifferences caps the differences listed in a frozen-mode or
+	// allow-list policy error.
+	maxLockDifferences = 10
+)
+
+// lockedContent is one collection or role pinned in a lock file. Source is the
+// Galaxy server a collection was downloaded from, if ansible-galaxy recorded
+// it; it is empty for roles.
+type lockedContent struct {
+	Kind    string
+	Name    string
+	Version string
+	Source  string
+}
+
+// galaxyLock is the installed content of a Galaxy requirements file, together
+// with the hash of that file.
+type galaxyLock struct {
+	RequirementsHash string
+	Content          []lockedContent
+}
+
+// defaultLockFile returns the lock file next to the requirements file, e.g.
+// requirements.lock.yml for requirements.yml.
+func defaultLockFile(requirements string) string {
+	return strings.TrimSuffix(requirements, filepath.Ext(requirements)) + ".lock.yml"
+}
+
+// validateGalaxyLock checks that the lock inputs do not contradict each other.
+func validateGalaxyLock(lock, frozen bool) error {
+	if lock && frozen {
+		return fmt.Errorf("%w: galaxy-lock and galaxy-frozen cannot be combined", ErrInvalidParameter)
+	}
+	return nil
+}
+
+// installedPaths returns the directories ansible-galaxy installed collections
+// and roles to: the cache entry, the configured paths, or else the first
+// entry of the search paths set in the environment, in ansible.cfg or by
+// Ansible's defaults, with "~" expanded.
+func (g *galaxyInstall) installedPaths() (collections, roles string) {
+	if g.entry != "" {
+		return filepath.Join(g.entry, "collections"), filepath.Join(g.entry, "roles")
+	}
+	collections, roles = g.collectionsPath, g.rolesPath
+	if collections == "" {
+		collections = firstPath(collectionsSearchPath(g.configFile))
+	}
+	if roles == "" {
+		roles = firstPath(rolesSearchPath(g.configFile))
+	}
+	return expandHome(collections), expandHome(roles)
+}
+
+// collectionsSearchPath returns the collections path Ansible uses.
+func collectionsSearchPath(configFile string) string {
+	return ansiblePathSetting(configFile, []string{"ANSIBLE_COLLECTIONS_PATH", "ANSIBLE_COLLECTIONS_PATHS"},
+		[]string{"collections_path", "collections_paths"}, defaultCollectionsPath)
+}
+
+// rolesSearchPath returns the roles path Ansible uses.
+func rolesSearchPath(configFile string) string {
+	return ansiblePathSetting(configFile, []string{"ANSIBLE_ROLES_PATH"}, []string{"roles_path"}, defaultRolesPath)
+}
+
+// installedContent finds the collections and roles in g's install paths. It
+// fails if there are none although the requirements file lists some, e.g.
+// because they went to a path the wrapper does not know about, so that checks
+// of the installed content cannot pass without looking at any.
+func (g *galaxyInstall) installedContent() ([]installedPackage, error) {
+	collections, roles := g.installedPaths()
+	packages, err := installedPackages(collections, roles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read installed Galaxy content: %w", err)
+	}
+	if len(packages) == 0 && g.expectsContent() {
+		return nil, fmt.Errorf("no installed Galaxy content found in %s or %s, although %s lists some", collections, roles, g.file)
+	}
+	return packages, nil
+}
+
+// expectsContent reports whether g's requirements file lists any collection
+// or role. A file the wrapper cannot parse is assumed to list some.
+func (g *galaxyInstall) expectsContent() bool {
+	if g.file == "" {
+		return false
+	}
+	// #nosec G304 -- the requirements file is an input of the workflow.
+	data, err := os.ReadFile(g.file)
+	if err != nil {
+		return true
+	}
+	reqs, err := parseRequirements(data)
+	return err != nil || len(reqs) > 0
+}
+
+// firstPath returns the first entry of the first non-empty colon-separated
+// path list.
+func firstPath(lists ...string) string {
+	for _, list := range lists {
+		if first, _, _ := strings.Cut(list, ":"); first != "" {
+			return first
+		}
+	}
+	return ""
+}
+
+// collectionInfo is the part of a collection's MANIFEST.json, or of its
+// galaxy.yml, that identifies it.
+type collectionInfo struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+}
+
+// installedPackage is a collection or role found in an install path,
+// together with the directory it was installed to.
+type installedPackage struct {
+	lockedContent
+	Dir string
+}
+
+// readInstalledContent lists the collections and roles installed in g's
+// install paths, including transitive dependencies, sorted by kind and name.
+// Like installedContent, it fails if nothing is installed although the
+// requirements file lists content, so a lock is never written or checked
+// against an empty set by mistake.
+func (g *galaxyInstall) readInstalledContent() ([]lockedContent, error) {
+	packages, err := g.installedContent()
+	if err != nil {
+		return nil, err
+	}
+	content := make([]lockedContent, 0, len(packages))
+	for _, p := range packages {
+		content = append(content, p.lockedContent)
+	}
+	return content, nil
+}
+
+// installedPackages finds the collections and roles in the given directories,
+// sorted by kind and name. Collections are described by their MANIFEST.json,
+// or by galaxy.yml when they were installed from a source checkout; roles
+// only count when ansible-galaxy recorded installing them.
+func installedPackages(collectionsDir, rolesDir string) ([]installedPackage, error) {
+	if filepath.Base(collectionsDir) != "ansible_collections" {
+		collectionsDir = filepath.Join(collectionsDir, "ansible_collections")
+	}
+	dirs, err := filepath.Glob(filepath.Join(collectionsDir, "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	var packages []installedPackage
+	for _, dir := range dirs {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+		var info collectionInfo
+		manifestPath := filepath.Join(dir, "MANIFEST.json")
+		// #nosec G304 -- the manifest lies in the collections install path.
+		data, err := os.ReadFile(manifestPath)
+		switch {
+		case err == nil:
+			var manifest struct {
+				CollectionInfo collectionInfo `json:"collection_info"`
+			}
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", manifestPath, err)
+			}
+			info = manifest.CollectionInfo
+		case os.IsNotExist(err):
+			galaxyYML := filepath.Join(dir, "galaxy.yml")
+			info.Namespace = readFlatYAMLValue(galaxyYML, "namespace")
+			info.Name = readFlatYAMLValue(galaxyYML, "name")
+			info.Version = readFlatYAMLValue(galaxyYML, "version")
+		default:
+			return nil, fmt.Errorf("failed to read %s: %w", manifestPath, err)
+		}
+		if info.Namespace == "" || info.Name == "" {
+			continue
+		}
+		name := info.Namespace + "." + info.Name
+		packages = append(packages, installedPackage{
+			lockedContent: lockedContent{
+				Kind:    galaxyLockCollections,
+				Name:    name,
+				Version: info.Version,
+				Source:  readFlatYAMLValue(filepath.Join(collectionsDir, name+"-"+info.Version+".info", "GALAXY.yml"), "server"),
+			},
+			Dir: dir,
+		})
+	}
+
+	infos, err := filepath.Glob(filepath.Join(rolesDir, "*", "meta", ".galaxy_install_info"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range infos {
+		dir := filepath.Dir(filepath.Dir(path))
+		packages = append(packages, installedPackage{
+			lockedContent: lockedContent{
+				Kind:    galaxyLockRoles,
+				Name:    filepath.Base(dir),
+				Version: readFlatYAMLValue(path, "version"),
+			},
+			Dir: dir,
+		})
+	}
+	slices.SortFunc(packages, func(a, b installedPackage) int {
+		return compareLockedContent(a.lockedContent, b.lockedContent)
+	})
+	return packages, nil
+}
+
+// readFlatYAMLValue returns the value of a top-level key in a flat YAML file
+// such as GALAXY.yml or .galaxy_install_info, or "" if the file or key is
+// missing.
+func readFlatYAMLValue(path, key string) string {
+	// #nosec G304 -- the file lies in an install path of ansible-galaxy.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, key+":"); ok {
+			return strings.Trim(strings.TrimSpace(v), `'"`)
+		}
+	}
+	return ""
+}
+
+// sortLockedContent orders collections before roles, each by name.
+func sortLockedContent(content []lockedContent) {
+	slices.SortFunc(content, compareLockedContent)
+}
+
+// compareLockedContent orders collections before roles, each by name.
+func compareLockedContent(a, b lockedContent) int {
+	if a.Kind != b.Kind {
+		return strings.Compare(a.Kind, b.Kind)
+	}
+	return strings.Compare(a.Name, b.Name)
+}
+
+// hashRequirements returns the SHA-256 of the requirements file.
+func hashRequirements(path string) (string, error) {
+	// #nosec G304 -- the requirements file is an input of the workflow.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read galaxy file: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// marshal renders the lock as a requirements file that pins every installed
+// collection and role, so it can also be installed from directly.
+func (l *galaxyLock) marshal(requirements string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Generated from %s by arillso/action.playbook. Do not edit.\n", filepath.Base(requirements))
+	b.WriteString(galaxyLockHashPrefix + l.RequirementsHash + "\n")
+	for _, kind := range []string{galaxyLockCollections, galaxyLockRoles} {
+		var items []lockedContent
+		for _, c := range l.Content {
+			if c.Kind == kind {
+				items = append(items, c)
+			}
+		}
+		if len(items) == 0 {
+			fmt.Fprintf(&b, "%s: []\n", kind)
+			continue
+		}
+		fmt.Fprintf(&b, "%s:\n", kind)
+		for _, c := range items {
+			fmt.Fprintf(&b, "  - name: %s\n    version: %s\n", strconv.Quote(c.Name), strconv.Quote(c.Version))
+			if c.Source != "" {
+				fmt.Fprintf(&b, "    source: %s\n", strconv.Quote(c.Source))
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+// parseGalaxyLock reads a lock file written by marshal.
+func parseGalaxyLock(data []byte) (*galaxyLock, error) {
+	lock := &galaxyLock{}
+	kind := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if hash, ok := strings.CutPrefix(line, galaxyLockHashPrefix); ok {
+			lock.RequirementsHash = strings.TrimSpace(hash)
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if k, rest, ok := strings.Cut(line, ":"); ok && (k == galaxyLockCollections || k == galaxyLockRoles) {
+			if rest = strings.TrimSpace(rest); rest != "" && rest != "[]" {
+				return nil, fmt.Errorf("line %d: unexpected value for %s", n, k)
+			}
+			kind = k
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(trimmed, "- "), ":")
+		if kind == "" || !ok {
+			return nil, fmt.Errorf("line %d: unexpected content %q", n, trimmed)
+		}
+		value, err := strconv.Unquote(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s must be a quoted string", n, key)
+		}
+		if strings.HasPrefix(trimmed, "- ") {
+			lock.Content = append(lock.Content, lockedContent{Kind: kind})
+		} else if len(lock.Content) == 0 {
+			return nil, fmt.Errorf("line %d: %s outside of an entry", n, key)
+		}
+		c := &lock.Content[len(lock.Content)-1]
+		switch key {
+		case "name":
+			c.Name = value
+		case "version":
+			c.Version = value
+		case "source":
+			c.Source = value
+		default:
+			return nil, fmt.Errorf("line %d: unknown key %q", n, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sortLockedContent(lock.Content)
+	return lock, nil
+}
+
+// lockDifferences describes how installed differs from locked, one line per
+// collection or role that was added, removed or changed.
+func lockDifferences(locked, installed []lockedContent) []string {
+	key := func(c lockedContent) string { return c.Kind + " " + c.Name }
+	want := make(map[string]lockedContent, len(locked))
+	for _, c := range locked {
+		want[key(c)] = c
+	}
+	var diffs []string
+	for _, c := range installed {
+		l, ok := want[key(c)]
+		delete(want, key(c))
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%s %s %s is not in the lock file", strings.TrimSuffix(c.Kind, "s"), c.Name, c.Version))
+		case l.Version != c.Version:
+			diffs = append(diffs, fmt.Sprintf("%s %s is %s, locked at %s", strings.TrimSuffix(c.Kind, "s"), c.Name, c.Version, l.Version))
+		case l.Source != c.Source:
+			diffs = append(diffs, fmt.Sprintf("%s %s comes from %s, locked to %s", strings.TrimSuffix(c.Kind, "s"), c.Name, c.Source, l.Source))
+		}
+	}
+	for _, c := range locked {
+		if _, missing := want[key(c)]; missing {
+			diffs = append(diffs, fmt.Sprintf("%s %s %s is locked but not installed", strings.TrimSuffix(c.Kind, "s"), c.Name, c.Version))
+		}
+	}
+	return diffs
+}
+
+// withLockedSources returns installed with the source of every vendored
+// collection or role taken from locked. Content installed from an archive
+// records no Galaxy server, so its source cannot be compared with a lock
+// written online; its name and version still are.
+func withLockedSources(installed, locked []lockedContent, vendored []vendoredArtifact) []lockedContent {
+	if len(vendored) == 0 {
+		return installed
+	}
+	sources := make(map[string]string, len(locked))
+	for _, c := range locked {
+		sources[c.Kind+" "+c.Name] = c.Source
+	}
+	result := slices.Clone(installed)
+	for _, a := range vendored {
+		key := a.req.Kind + " " + a.installedName()
+		for i, c := range result {
+			if source, ok := sources[key]; ok && c.Kind+" "+c.Name == key {
+				result[i].Source = source
+			}
+		}
+	}
+	return result
+}
+
+// applyLock writes the lock file in lock mode, or checks the installed
+// content against it in frozen mode.
+func (g *galaxyInstall) applyLock() error {
+	if !g.lock && !g.frozen {
+		return nil
+	}
+	hash, err := hashRequirements(g.file)
+	if err != nil {
+		return err
+	}
+	installed, err := g.readInstalledContent()
+	if err != nil {
+		return err
+	}
+
+	if g.lock {
+		lock := &galaxyLock{RequirementsHash: hash, Content: installed}
+		if err := writeArtifactFile(g.lockFile, lock.marshal(g.file)); err != nil {
+			return fmt.Errorf("could not write Galaxy lock file: %w", err)
+		}
+		log.Printf("Galaxy lock file with %d collection(s) and role(s) written to %s", len(installed), g.lockFile)
+		return nil
+	}
+
+	// #nosec G304 -- the lock file is an input of the workflow.
+	data, err := os.ReadFile(g.lockFile)
+	if err != nil {
+		return fmt.Errorf("galaxy-frozen requires a lock file: %w", err)
+	}
+	lock, err := parseGalaxyLock(data)
+	if err != nil {
+		return fmt.Errorf("invalid Galaxy lock file %s: %w", g.lockFile, err)
+	}
+	if lock.RequirementsHash != hash {
+		return fmt.Errorf("%s changed since %s was written; update it with galaxy-lock", g.file, g.lockFile)
+	}
+	installed = withLockedSources(installed, lock.Content, g.vendored)
+	if diffs := lockDifferences(lock.Content, installed); len(diffs) > 0 {
+		return fmt.Errorf("installed Galaxy content differs from %s: %s", g.lockFile, joinLimited(diffs, maxLockDifferences))
+	}
+	log.Printf("Installed Galaxy content matches %s", g.lockFile)
+	return nil
+}
+
+// joinLimited joins the first limit items with "; " and counts the rest.
+func joinLimited(items []string, limit int) string {
+	if len(items) <= limit {
+		return strings.Join(items, "; ")
+	}
+	return fmt.Sprintf("%s; and %d more", strings.Join(items[:limit], "; "), len(items)-limit)
+}
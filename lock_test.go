@@ -0,0 +1,228 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// installFakeContent lays out collections and roles the way ansible-galaxy
+// installs them.
+func installFakeContent(t *testing.T, root string, collections map[string]string, roles map[string]string) {
+	t.Helper()
+	for name, version := range collections {
+		ns, coll, _ := strings.Cut(name, ".")
+		dir := filepath.Join(root, "collections", "ansible_collections", ns, coll)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		manifest := `{"collection_info": {"namespace": "` + ns + `", "name": "` + coll + `", "version": "` + version + `"}}`
+		if err := os.WriteFile(filepath.Join(dir, "MANIFEST.json"), []byte(manifest), 0600); err != nil {
+			t.Fatal(err)
+		}
+		info := filepath.Join(root, "collections", "ansible_collections", name+"-"+version+".info")
+		if err := os.MkdirAll(info, 0755); err != nil {
+			t.Fatal(err)
+		}
+		galaxy := "format_version: 1.0.0\nname: " + coll + "\nserver: https://galaxy.ansible.com/api/\nversion: " + version + "\n"
+		if err := os.WriteFile(filepath.Join(info, "GALAXY.yml"), []byte(galaxy), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, version := range roles {
+		dir := filepath.Join(root, "roles", name, "meta")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		info := "install_date: 'Mon Jan  1 00:00:00 2026'\nversion: '" + version + "'\n"
+		if err := os.WriteFile(filepath.Join(dir, ".galaxy_install_info"), []byte(info), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDefaultLockFile(t *testing.T) {
+	for in, want := range map[string]string{
+		"requirements.yml":             "requirements.lock.yml",
+		"collections/requirements.yml": "collections/requirements.lock.yml",
+		"galaxy.yaml":                  "galaxy.lock.yml",
+	} {
+		if got := defaultLockFile(in); got != want {
+			t.Errorf("defaultLockFile(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestReadInstalledContent(t *testing.T) {
+	root := t.TempDir()
+	installFakeContent(t, root,
+		map[string]string{"community.general": "8.6.0", "ansible.posix": "1.5.4"},
+		map[string]string{"geerlingguy.docker": "7.1.0"})
+	// Roles that were not installed by ansible-galaxy are ignored.
+	if err := os.MkdirAll(filepath.Join(root, "roles", "local", "tasks"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &galaxyInstall{collectionsPath: filepath.Join(root, "collections"), rolesPath: filepath.Join(root, "roles")}
+	got, err := g.readInstalledContent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []lockedContent{
+		{Kind: galaxyLockCollections, Name: "ansible.posix", Version: "1.5.4", Source: "https://galaxy.ansible.com/api/"},
+		{Kind: galaxyLockCollections, Name: "community.general", Version: "8.6.0", Source: "https://galaxy.ansible.com/api/"},
+		{Kind: galaxyLockRoles, Name: "geerlingguy.docker", Version: "7.1.0"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected content:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestGalaxyLock_RoundTrip(t *testing.T) {
+	lock := &galaxyLock{
+		RequirementsHash: "abc123",
+		Content: []lockedContent{
+			{Kind: galaxyLockCollections, Name: "community.general", Version: "8.6.0", Source: "https://galaxy.ansible.com/api/"},
+		},
+	}
+	data := lock.marshal("requirements.yml")
+	for _, want := range []string{
+		"# requirements-sha256: abc123\n",
+		"collections:\n  - name: \"community.general\"\n    version: \"8.6.0\"\n    source: \"https://galaxy.ansible.com/api/\"\n",
+		"roles: []\n",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected %q in lock file:\n%s", want, data)
+		}
+	}
+
+	parsed, err := parseGalaxyLock(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, lock) {
+		t.Errorf("round trip changed the lock:\n got %+v\nwant %+v", parsed, lock)
+	}
+}
+
+func TestParseGalaxyLock_Invalid(t *testing.T) {
+	for _, tt := range []struct {
+		data string
+		want string
+	}{
+		{"collections:\n  - name: \"a.b\"\n    checksum: \"x\"\n", `line 3: unknown key "checksum"`},
+		{"roles:\n  - name: unquoted\n", "line 2: name must be a quoted string"},
+		{"  - name: \"a.b\"\n", "line 1: unexpected content"},
+	} {
+		if _, err := parseGalaxyLock([]byte(tt.data)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("expected %q, got %v", tt.want, err)
+		}
+	}
+}
+
+func TestLockDifferences(t *testing.T) {
+	locked := []lockedContent{
+		{Kind: galaxyLockCollections, Name: "community.general", Version: "8.6.0"},
+		{Kind: galaxyLockCollections, Name: "ansible.posix", Version: "1.5.4"},
+		{Kind: galaxyLockRoles, Name: "geerlingguy.docker", Version: "7.1.0"},
+	}
+	installed := []lockedContent{
+		{Kind: galaxyLockCollections, Name: "community.general", Version: "9.0.0"},
+		{Kind: galaxyLockCollections, Name: "community.docker", Version: "3.10.0"},
+		{Kind: galaxyLockRoles, Name: "geerlingguy.docker", Version: "7.1.0"},
+	}
+	want := []string{
+		"collection community.general is 9.0.0, locked at 8.6.0",
+		"collection community.docker 3.10.0 is not in the lock file",
+		"collection ansible.posix 1.5.4 is locked but not installed",
+	}
+	if got := lockDifferences(locked, installed); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected differences:\n got %q\nwant %q", got, want)
+	}
+	if got := lockDifferences(locked, locked); len(got) != 0 {
+		t.Errorf("expected no differences, got %q", got)
+	}
+}
+
+func TestApplyLock_WriteThenFrozen(t *testing.T) {
+	dir := t.TempDir()
+	requirements := filepath.Join(dir, "requirements.yml")
+	if err := os.WriteFile(requirements, []byte("collections:\n  - community.general\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	entry := filepath.Join(dir, "entry")
+	installFakeContent(t, entry, map[string]string{"community.general": "8.6.0"}, nil)
+
+	g := &galaxyInstall{file: requirements, lockFile: defaultLockFile(requirements), entry: entry, lock: true}
+	if err := g.applyLock(); err != nil {
+		t.Fatalf("unexpected error writing the lock file: %v", err)
+	}
+
+	g.lock, g.frozen = false, true
+	if err := g.applyLock(); err != nil {
+		t.Fatalf("expected the installed content to match the lock file: %v", err)
+	}
+
+	installFakeContent(t, entry, map[string]string{"community.general": "9.0.0"}, nil)
+	if err := os.RemoveAll(filepath.Join(entry, "collections", "ansible_collections", "community.general-8.6.0.info")); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.applyLock(); err == nil || !strings.Contains(err.Error(), "collection community.general is 9.0.0, locked at 8.6.0") {
+		t.Errorf("expected a version mismatch, got %v", err)
+	}
+
+	if err := os.WriteFile(requirements, []byte("collections:\n  - community.docker\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.applyLock(); err == nil || !strings.Contains(err.Error(), "changed since") {
+		t.Errorf("expected changed requirements to be rejected, got %v", err)
+	}
+}
+
+func TestApplyLock_FrozenWithoutLockFile(t *testing.T) {
+	dir := t.TempDir()
+	requirements := filepath.Join(dir, "requirements.yml")
+	if err := os.WriteFile(requirements, []byte("roles: []\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	g := &galaxyInstall{file: requirements, lockFile: defaultLockFile(requirements), entry: dir, frozen: true}
+	if err := g.applyLock(); err == nil || !strings.Contains(err.Error(), "requires a lock file") {
+		t.Errorf("expected a missing lock file error, got %v", err)
+	}
+}
+
+func TestApplyLock_NothingInstalled(t *testing.T) {
+	dir := t.TempDir()
+	requirements := createTempFile(t, dir, "requirements.yml", "collections:\n  - community.general\n")
+	createTempFile(t, dir, "requirements.lock.yml", "# requirements_sha256: x\ncollections: []\nroles: []\n")
+	empty := filepath.Join(dir, "empty")
+	for _, g := range []*galaxyInstall{
+		{file: requirements, lockFile: filepath.Join(dir, "new.lock.yml"), entry: empty, lock: true},
+		{file: requirements, lockFile: defaultLockFile(requirements), entry: empty, frozen: true},
+	} {
+		if err := g.applyLock(); err == nil || !strings.Contains(err.Error(), "no installed Galaxy content found") {
+			t.Errorf("expected lock=%t frozen=%t to fail without installed content, got %v", g.lock, g.frozen, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new.lock.yml")); !os.IsNotExist(err) {
+		t.Errorf("expected no empty lock file to be written, got %v", err)
+	}
+
+	// A requirements file without content needs nothing installed.
+	none := createTempFile(t, dir, "none.yml", "roles: []\n")
+	g := &galaxyInstall{file: none, lockFile: filepath.Join(dir, "none.lock.yml"), entry: empty, lock: true}
+	if err := g.applyLock(); err != nil {
+		t.Errorf("unexpected error for empty requirements: %v", err)
+	}
+}
+
+func TestValidateGalaxyLock(t *testing.T) {
+	if err := validateGalaxyLock(true, true); err == nil {
+		t.Error("expected galaxy-lock and galaxy-frozen to be rejected together")
+	}
+	if err := validateGalaxyLock(true, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -5,13 +5,19 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -27,6 +33,13 @@ var (
 	ErrPlaybookExecution = errors.New("playbook execution failed")
 	ErrConfigLoad        = errors.New("failed to load configuration")
 	ErrInvalidParameter  = errors.New("invalid parameter provided")
+	ErrNotIdempotent     = errors.New("playbook is not idempotent")
+	ErrDriftDetected     = errors.New("configuration drift detected")
+	ErrPlanMismatch      = errors.New("plan does not match the current inputs")
+	ErrCancelled         = errors.New("run cancelled")
+	ErrTimedOut          = errors.New("execution timeout reached")
+	ErrGalaxyFailed      = errors.New("galaxy requirements installation failed")
+	ErrPipFailed         = errors.New("python requirements installation failed")
 )
 
 // appFlags defines all CLI flags for the application.
@@ -38,6 +51,32 @@ var appFlags = []cli.Flag{
 		Value:   30,
 		Sources: cli.EnvVars("ANSIBLE_EXECUTION_TIMEOUT", "INPUT_EXECUTION_TIMEOUT", "PLUGIN_EXECUTION_TIMEOUT"),
 	},
+	&cli.IntFlag{
+		Name:    "lint-timeout",
+		Usage:   "Timeout in minutes for ansible-lint (0 = bounded by execution-timeout only)",
+		Sources: cli.EnvVars("ANSIBLE_LINT_TIMEOUT", "INPUT_LINT_TIMEOUT", "PLUGIN_LINT_TIMEOUT"),
+	},
+	&cli.IntFlag{
+		Name:    "galaxy-install-timeout",
+		Usage:   "Timeout in minutes for installing Galaxy requirements (0 = bounded by execution-timeout only)",
+		Sources: cli.EnvVars("ANSIBLE_GALAXY_INSTALL_TIMEOUT", "INPUT_GALAXY_INSTALL_TIMEOUT", "PLUGIN_GALAXY_INSTALL_TIMEOUT"),
+	},
+	&cli.IntFlag{
+		Name:    "pip-install-timeout",
+		Usage:   "Timeout in minutes for installing Python requirements (0 = bounded by execution-timeout only)",
+		Sources: cli.EnvVars("ANSIBLE_PIP_INSTALL_TIMEOUT", "INPUT_PIP_INSTALL_TIMEOUT", "PLUGIN_PIP_INSTALL_TIMEOUT"),
+	},
+	&cli.IntFlag{
+		Name:    "playbook-timeout",
+		Usage:   "Timeout in minutes for each playbook attempt (0 = bounded by execution-timeout only)",
+		Sources: cli.EnvVars("ANSIBLE_PLAYBOOK_TIMEOUT", "INPUT_PLAYBOOK_TIMEOUT", "PLUGIN_PLAYBOOK_TIMEOUT"),
+	},
+	&cli.IntFlag{
+		Name:    "cancel-grace-period",
+		Usage:   "Seconds to wait for ansible-playbook to stop after SIGINT before killing it",
+		Value:   10,
+		Sources: cli.EnvVars("ANSIBLE_CANCEL_GRACE_PERIOD", "INPUT_CANCEL_GRACE_PERIOD", "PLUGIN_CANCEL_GRACE_PERIOD"),
+	},
 	// Galaxy-related options
 	&cli.StringFlag{
 		Name:    "galaxy-file",
@@ -129,6 +168,62 @@ var appFlags = []cli.Flag{
 		Usage:   "Disable automatic dependency resolution for Galaxy",
 		Sources: cli.EnvVars("ANSIBLE_GALAXY_NO_DEPS"),
 	},
+	&cli.IntFlag{
+		Name:    "galaxy-retries",
+		Usage:   "Number of times to retry a failed Galaxy install (0 = no retries)",
+		Sources: cli.EnvVars("ANSIBLE_GALAXY_RETRIES", "INPUT_GALAXY_RETRIES", "PLUGIN_GALAXY_RETRIES"),
+	},
+	&cli.StringFlag{
+		Name:    "galaxy-cache-dir",
+		Usage:   "Directory to cache installed Galaxy requirements in, keyed by the requirements file and Ansible version",
+		Sources: cli.EnvVars("ANSIBLE_GALAXY_CACHE_DIR", "INPUT_GALAXY_CACHE_DIR", "PLUGIN_GALAXY_CACHE_DIR"),
+	},
+	&cli.StringFlag{
+		Name:    "galaxy-vendor-dir",
+		Usage:   "Directory of .tar.gz archives to install Galaxy requirements from, without network access",
+		Sources: cli.EnvVars("ANSIBLE_GALAXY_VENDOR_DIR", "INPUT_GALAXY_VENDOR_DIR", "PLUGIN_GALAXY_VENDOR_DIR"),
+	},
+	&cli.BoolFlag{
+		Name:    "galaxy-lock",
+		Usage:   "Write a lock file pinning every installed collection and role after the Galaxy install",
+		Sources: cli.EnvVars("ANSIBLE_GALAXY_LOCK", "INPUT_GALAXY_LOCK", "PLUGIN_GALAXY_LOCK"),
+	},
+	&cli.BoolFlag{
+		Name:    "galaxy-frozen",
+		Usage:   "Fail if the installed collections and roles differ from the lock file",
+		Sources: cli.EnvVars("ANSIBLE_GALAXY_FROZEN", "INPUT_GALAXY_FROZEN", "PLUGIN_GALAXY_FROZEN"),
+	},
+	&cli.StringFlag{
+		Name:    "galaxy-lock-file",
+		Usage:   "Path to the Galaxy lock file (default: <requirements>.lock.yml next to the requirements file)",
+		Sources: cli.EnvVars("ANSIBLE_GALAXY_LOCK_FILE", "INPUT_GALAXY_LOCK_FILE", "PLUGIN_GALAXY_LOCK_FILE"),
+	},
+	&cli.StringSliceFlag{
+		Name:    "galaxy-allowed-namespaces",
+		Usage:   "Namespaces installed collections and roles, including dependencies, must be from",
+		Sources: cli.EnvVars("ANSIBLE_GALAXY_ALLOWED_NAMESPACES", "INPUT_GALAXY_ALLOWED_NAMESPACES", "PLUGIN_GALAXY_ALLOWED_NAMESPACES"),
+	},
+	&cli.StringSliceFlag{
+		Name:    "galaxy-allowed-licenses",
+		Usage:   "Licenses installed collections and roles, including dependencies, may declare",
+		Sources: cli.EnvVars("ANSIBLE_GALAXY_ALLOWED_LICENSES", "INPUT_GALAXY_ALLOWED_LICENSES", "PLUGIN_GALAXY_ALLOWED_LICENSES"),
+	},
+	&cli.StringFlag{
+		Name:    "sbom-file",
+		Usage:   "Path to write a CycloneDX JSON SBOM of ansible-core and the installed collections and roles to",
+		Sources: cli.EnvVars("ANSIBLE_SBOM_FILE", "INPUT_SBOM_FILE", "PLUGIN_SBOM_FILE"),
+	},
+	// Python dependency options
+	&cli.StringFlag{
+		Name:    "pip-requirements",
+		Usage:   "Path to a pip requirements file to install into a virtualenv for the playbook run",
+		Sources: cli.EnvVars("ANSIBLE_PIP_REQUIREMENTS", "INPUT_PIP_REQUIREMENTS", "PLUGIN_PIP_REQUIREMENTS"),
+	},
+	&cli.StringFlag{
+		Name:    "pip-cache-dir",
+		Usage:   "Directory to cache the virtualenv in, keyed by the requirements file and Python version",
+		Sources: cli.EnvVars("ANSIBLE_PIP_CACHE_DIR", "INPUT_PIP_CACHE_DIR", "PLUGIN_PIP_CACHE_DIR"),
+	},
 	// Inventory and playbook options
 	&cli.StringSliceFlag{
 		Name:     "inventory",
@@ -195,6 +290,34 @@ var appFlags = []cli.Flag{
 		Usage:   "Enable both check and diff mode for a dry run",
 		Sources: cli.EnvVars("ANSIBLE_DRY_RUN", "INPUT_DRY_RUN", "PLUGIN_DRY_RUN"),
 	},
+	&cli.BoolFlag{
+		Name:    "idempotence-check",
+		Usage:   "Run the playbooks a second time and fail if any task reports a change",
+		Sources: cli.EnvVars("ANSIBLE_IDEMPOTENCE_CHECK", "INPUT_IDEMPOTENCE_CHECK", "PLUGIN_IDEMPOTENCE_CHECK"),
+	},
+	&cli.BoolFlag{
+		Name:    "drift-detect",
+		Usage:   "Run in check and diff mode and report whether any task would change",
+		Sources: cli.EnvVars("ANSIBLE_DRIFT_DETECT", "INPUT_DRIFT_DETECT", "PLUGIN_DRIFT_DETECT"),
+	},
+	&cli.StringFlag{
+		Name:    "drift-policy",
+		Usage:   "What drift-detect does on drift: fail the step or only warn",
+		Value:   driftPolicyFail,
+		Sources: cli.EnvVars("ANSIBLE_DRIFT_POLICY", "INPUT_DRIFT_POLICY", "PLUGIN_DRIFT_POLICY"),
+	},
+	&cli.StringFlag{
+		Name:    "mode",
+		Usage:   "Run mode: run, plan (check and diff, write plan-file) or apply (verify plan-file, then run)",
+		Value:   modeRun,
+		Sources: cli.EnvVars("ANSIBLE_MODE", "INPUT_MODE", "PLUGIN_MODE"),
+	},
+	&cli.StringFlag{
+		Name:    "plan-file",
+		Usage:   "Plan file written in plan mode and verified in apply mode",
+		Value:   "ansible-plan.json",
+		Sources: cli.EnvVars("ANSIBLE_PLAN_FILE", "INPUT_PLAN_FILE", "PLUGIN_PLAN_FILE"),
+	},
 	&cli.BoolFlag{
 		Name:    "flush-cache",
 		Usage:   "Clear the fact cache for all hosts in the inventory",
@@ -384,6 +507,16 @@ var appFlags = []cli.Flag{
 		Usage:   "Timeout (in seconds) for fact caching",
 		Sources: cli.EnvVars("ANSIBLE_FACT_CACHING_TIMEOUT", "INPUT_FACT_CACHING_TIMEOUT", "PLUGIN_FACT_CACHING_TIMEOUT"),
 	},
+	&cli.StringSliceFlag{
+		Name:    "export-facts",
+		Usage:   "Fact names to export after the run, or 'all'",
+		Sources: cli.EnvVars("ANSIBLE_EXPORT_FACTS", "INPUT_EXPORT_FACTS", "PLUGIN_EXPORT_FACTS"),
+	},
+	&cli.StringFlag{
+		Name:    "facts-file",
+		Usage:   "Path to write the exported facts to as JSON",
+		Sources: cli.EnvVars("ANSIBLE_FACTS_FILE", "INPUT_FACTS_FILE", "PLUGIN_FACTS_FILE"),
+	},
 	&cli.StringFlag{
 		Name:  "callbacks-enabled",
 		Usage: "Comma-separated list of enabled callback plugins",
@@ -439,6 +572,34 @@ var appFlags = []cli.Flag{
 		Value:   0,
 		Sources: cli.EnvVars("ANSIBLE_RETRIES", "INPUT_RETRIES", "PLUGIN_RETRIES"),
 	},
+	&cli.StringSliceFlag{
+		Name:    "retry-on",
+		Usage:   "Failure classes to retry: any, unreachable, host-failed or timeout",
+		Value:   []string{retryOnAny},
+		Sources: cli.EnvVars("ANSIBLE_RETRY_ON", "INPUT_RETRY_ON", "PLUGIN_RETRY_ON"),
+	},
+	&cli.StringFlag{
+		Name:    "retry-backoff",
+		Usage:   "Delay between retries: fixed or exponential",
+		Value:   retryBackoffFixed,
+		Sources: cli.EnvVars("ANSIBLE_RETRY_BACKOFF", "INPUT_RETRY_BACKOFF", "PLUGIN_RETRY_BACKOFF"),
+	},
+	&cli.IntFlag{
+		Name:    "retry-max-delay",
+		Usage:   "Maximum delay in seconds between retries (0 = no cap)",
+		Value:   600,
+		Sources: cli.EnvVars("ANSIBLE_RETRY_MAX_DELAY", "INPUT_RETRY_MAX_DELAY", "PLUGIN_RETRY_MAX_DELAY"),
+	},
+	&cli.IntFlag{
+		Name:    "retry-jitter",
+		Usage:   "Percentage of each retry delay that is randomly subtracted (0-100)",
+		Sources: cli.EnvVars("ANSIBLE_RETRY_JITTER", "INPUT_RETRY_JITTER", "PLUGIN_RETRY_JITTER"),
+	},
+	&cli.BoolFlag{
+		Name:    "retry-failed-hosts",
+		Usage:   "Limit retries to the hosts that failed or were unreachable",
+		Sources: cli.EnvVars("ANSIBLE_RETRY_FAILED_HOSTS", "INPUT_RETRY_FAILED_HOSTS", "PLUGIN_RETRY_FAILED_HOSTS"),
+	},
 	&cli.IntFlag{
 		Name:    "retry-delay",
 		Usage:   "Delay in seconds between retries",
@@ -450,6 +611,43 @@ var appFlags = []cli.Flag{
 		Usage:   "Run ansible-lint on playbooks before execution",
 		Sources: cli.EnvVars("ANSIBLE_LINT", "INPUT_LINT", "PLUGIN_LINT"),
 	},
+	&cli.StringFlag{
+		Name:    "junit-file",
+		Usage:   "Write a JUnit XML report of task results to this file",
+		Sources: cli.EnvVars("ANSIBLE_JUNIT_FILE", "INPUT_JUNIT_FILE", "PLUGIN_JUNIT_FILE"),
+	},
+	&cli.StringFlag{
+		Name:    "diff-markdown-file",
+		Usage:   "Write the diffs of changed tasks as PR-ready markdown to this file",
+		Sources: cli.EnvVars("ANSIBLE_DIFF_MARKDOWN_FILE", "INPUT_DIFF_MARKDOWN_FILE", "PLUGIN_DIFF_MARKDOWN_FILE"),
+	},
+	&cli.BoolFlag{
+		Name:    "pr-comment",
+		Usage:   "Create or update a pull request comment with the run result on pull_request events",
+		Sources: cli.EnvVars("ANSIBLE_PR_COMMENT", "INPUT_PR_COMMENT", "PLUGIN_PR_COMMENT"),
+	},
+	&cli.StringFlag{
+		Name:    "pr-comment-id",
+		Usage:   "Identifier that tells apart the comments of several jobs on one pull request",
+		Sources: cli.EnvVars("ANSIBLE_PR_COMMENT_ID", "INPUT_PR_COMMENT_ID", "PLUGIN_PR_COMMENT_ID"),
+	},
+	&cli.StringFlag{
+		Name:    "github-token",
+		Usage:   "Token used to post the pull request comment",
+		Sources: cli.EnvVars("ANSIBLE_GITHUB_TOKEN", "INPUT_GITHUB_TOKEN", "PLUGIN_GITHUB_TOKEN", "GITHUB_TOKEN"),
+	},
+	&cli.StringFlag{
+		Name:    "github-api-url",
+		Usage:   "Base URL of the GitHub REST API",
+		Value:   defaultGitHubAPIURL,
+		Sources: cli.EnvVars("ANSIBLE_GITHUB_API_URL", "INPUT_GITHUB_API_URL", "PLUGIN_GITHUB_API_URL", "GITHUB_API_URL"),
+	},
+	&cli.StringFlag{
+		Name:    "log-groups",
+		Usage:   "Fold the Actions log into groups per play or task: none, play or task",
+		Value:   logGroupsPlay,
+		Sources: cli.EnvVars("ANSIBLE_LOG_GROUPS", "INPUT_LOG_GROUPS", "PLUGIN_LOG_GROUPS"),
+	},
 	&cli.StringFlag{
 		Name:    "output-file",
 		Usage:   "Save Ansible stdout to a file (useful for capturing diff output)",
@@ -475,7 +673,12 @@ func main() {
 		Action: run,
 	}
 
-	if err := cmd.Run(context.Background(), os.Args); err != nil {
+	// Trap SIGINT and SIGTERM so that a cancelled job interrupts Ansible
+	// gracefully and the wrapper still cleans up and writes its outputs.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := cmd.Run(ctx, os.Args)
+	stop()
+	if err != nil {
 		var ansibleErr *ansible.AnsibleError
 		if errors.As(err, &ansibleErr) {
 			if ansibleErr.ExitCode != 0 {
@@ -862,15 +1065,36 @@ func createVaultPasswordFile(password string) (string, error) {
 	return path, nil
 }
 
-// execWithRetry runs fn up to (1 + retries) times with a delay between attempts.
-// It returns nil on the first successful call, or the last error if all attempts fail.
-func execWithRetry(ctx context.Context, retries int, delay time.Duration, fn func(ctx context.Context) error) error {
+// writeArtifactFile writes a report requested through an action input (e.g.
+// junit-file), creating missing parent directories. The path is chosen by the
+// workflow author on purpose.
+func writeArtifactFile(path string, data []byte) error {
+	// #nosec G301 -- report directories live in the workspace and must stay
+	// readable by later steps (artifact upload, test reporters).
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+	// #nosec G306 -- reports are meant to be read by later workflow steps,
+	// which may run as a different user than the container.
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// execWithRetry runs fn up to (1 + retries) times, waiting between attempts as
+// the policy's backoff says. It stops early when an attempt fails in a way the
+// policy does not retry. It returns nil on the first successful call, or the
+// last error if all attempts fail.
+func execWithRetry(ctx context.Context, policy retryPolicy, fn func(ctx context.Context) error) error {
+	retries := policy.retries
 	if retries < 0 {
 		retries = 0
 	}
 	var err error
 	for attempt := 0; attempt <= retries; attempt++ {
 		if attempt > 0 {
+			delay := policy.delayBefore(attempt)
 			log.Printf("Retry %d/%d after %v delay...", attempt, retries, delay)
 			select {
 			case <-ctx.Done():
@@ -884,6 +1108,14 @@ func execWithRetry(ctx context.Context, retries int, delay time.Duration, fn fun
 			return nil
 		}
 		log.Printf("Attempt %d failed: %v", attempt+1, err)
+		if attempt < retries && !policy.retryable(err) {
+			class := failureClass(err)
+			if class == "" {
+				class = "other"
+			}
+			log.Printf("Not retrying: failure class %q is not in retry-on (%s)", class, strings.Join(policy.on, ", "))
+			return err
+		}
 	}
 	return err
 }
@@ -926,6 +1158,11 @@ type numericBound struct {
 // own context and must be at least 1 (its default is 30); forks defaults to 5.
 var numericBounds = []numericBound{
 	{flag: "execution-timeout", min: 1, max: 1440, warnAbove: 360},    // minutes (<= 24h)
+	{flag: "lint-timeout", min: 0, max: 1440},                         // minutes (0 = execution-timeout)
+	{flag: "galaxy-install-timeout", min: 0, max: 1440},               // minutes (0 = execution-timeout)
+	{flag: "pip-install-timeout", min: 0, max: 1440},                  // minutes (0 = execution-timeout)
+	{flag: "playbook-timeout", min: 0, max: 1440},                     // minutes (0 = execution-timeout)
+	{flag: "cancel-grace-period", min: 0, max: 600, warnAbove: 120},   // seconds
 	{flag: "forks", min: 1, max: 1000, warnAbove: 100},                // parallelism (default 5)
 	{flag: "timeout", min: 0, max: 3600, warnAbove: 600},              // connection seconds (0 = ansible default)
 	{flag: "galaxy-timeout", min: 0, max: 3600, warnAbove: 600},       // seconds (0 = ansible default)
@@ -934,6 +1171,9 @@ var numericBounds = []numericBound{
 	{flag: "poll-interval", min: 0, max: 3600},                        // seconds (0 = ansible default)
 	{flag: "retries", min: 0, max: 100, warnAbove: 20},                // attempts (0 = no retries)
 	{flag: "retry-delay", min: 0, max: 3600, warnAbove: 600},          // seconds
+	{flag: "retry-max-delay", min: 0, max: 86400, warnAbove: 3600},    // seconds (0 = no cap)
+	{flag: "retry-jitter", min: 0, max: 100},                          // percent
+	{flag: "galaxy-retries", min: 0, max: 20},                         // attempts (0 = no retries)
 	{flag: "verbose", min: 0, max: 4},                                 // -v .. -vvvv
 	{flag: "max-fail-percentage", min: 0, max: 100},                   // percent
 	{flag: "galaxy-required-valid-signature-count", min: 0, max: 100}, // GPG signatures (0 = unset)
@@ -957,17 +1197,69 @@ func validateNumericInputs(c *cli.Command) error {
 	return nil
 }
 
+// choiceInputs lists the string inputs that only accept a fixed set of values.
+var choiceInputs = []struct {
+	flag    string
+	choices []string
+}{
+	{flag: "log-groups", choices: []string{logGroupsNone, logGroupsPlay, logGroupsTask}},
+	{flag: "drift-policy", choices: []string{driftPolicyFail, driftPolicyWarn}},
+	{flag: "mode", choices: []string{modeRun, modePlan, modeApply}},
+	{flag: "retry-backoff", choices: []string{retryBackoffFixed, retryBackoffExponential}},
+}
+
+// validateChoiceInputs checks every input in choiceInputs against its allowed
+// values.
+func validateChoiceInputs(c *cli.Command) error {
+	for _, in := range choiceInputs {
+		v := c.String(in.flag)
+		if !slices.Contains(in.choices, v) {
+			return fmt.Errorf("%w: invalid value for --%s: %q (must be one of %s)",
+				ErrInvalidParameter, in.flag, v, strings.Join(in.choices, ", "))
+		}
+	}
+	return nil
+}
+
+// validateModes rejects combinations of run modes that contradict each other,
+// such as checking idempotence in check mode.
+func validateModes(c *cli.Command) error {
+	checkMode := c.Bool("check") || c.Bool("dry-run") || c.Bool("drift-detect")
+	switch mode := c.String("mode"); {
+	case c.Bool("idempotence-check") && (checkMode || mode == modePlan):
+		return fmt.Errorf("%w: idempotence-check cannot be combined with check, dry-run, drift-detect or plan mode", ErrInvalidParameter)
+	case mode == modePlan && c.Bool("drift-detect"):
+		return fmt.Errorf("%w: plan mode cannot be combined with drift-detect", ErrInvalidParameter)
+	case mode == modeApply && checkMode:
+		return fmt.Errorf("%w: apply mode cannot be combined with check, dry-run or drift-detect", ErrInvalidParameter)
+	case mode != modeRun && c.String("plan-file") == "":
+		return fmt.Errorf("%w: %s mode requires plan-file", ErrInvalidParameter, mode)
+	}
+	return nil
+}
+
 func run(ctx context.Context, c *cli.Command) (execErr error) {
-	defer func() { writeActionOutputs(execErr) }()
+	report := newRunReport()
+	defer func() {
+		writeActionOutputs(execErr, report)
+		if inGitHubActions() {
+			writeAnnotations(os.Stdout, report, execErr)
+		}
+	}()
 
 	// Normalize slice flags once to support both comma-separated and multiline inputs.
 	inventories := normalizeSlice(c.StringSlice("inventory"))
 	playbooks := normalizeSlice(c.StringSlice("playbook"))
 	extraVars := normalizeSlice(c.StringSlice("extra-vars"))
 	modulePath := normalizeSlice(c.StringSlice("module-path"))
+	exportFacts := normalizeSlice(c.StringSlice("export-facts"))
+	retryOn := normalizeSlice(c.StringSlice("retry-on"))
 
 	// Auto-detect Galaxy file if not explicitly provided.
 	galaxyFile := c.String("galaxy-file")
+	if galaxyFile == "" {
+		galaxyFile = c.String("galaxy-requirements-file")
+	}
 	if galaxyFile == "" {
 		galaxyFile = detectGalaxyFile(".")
 	}
@@ -976,27 +1268,98 @@ func run(ctx context.Context, c *cli.Command) (execErr error) {
 	if err := validateParameters(inventories, playbooks, galaxyFile); err != nil {
 		return err
 	}
+	if galaxyFile != "" {
+		if err := checkRequirementsFile(galaxyFile, report); err != nil {
+			return err
+		}
+	}
+	if pipFile := c.String("pip-requirements"); pipFile != "" {
+		if _, err := os.Stat(pipFile); os.IsNotExist(err) {
+			return fmt.Errorf("%w: pip-requirements file does not exist: %s", ErrInvalidParameter, pipFile)
+		}
+	}
 
 	// Validate numeric inputs (bounds, non-negative, sane maxima).
 	if err := validateNumericInputs(c); err != nil {
 		return err
 	}
+	if err := validateChoiceInputs(c); err != nil {
+		return err
+	}
+	if err := validateModes(c); err != nil {
+		return err
+	}
+	if err := validateRetryOn(retryOn); err != nil {
+		return err
+	}
+	if err := validateFactExport(exportFacts, c.String("facts-file"), c.String("fact-caching")); err != nil {
+		return err
+	}
+	if err := validateGalaxyCache(c.String("galaxy-cache-dir"), c.String("galaxy-collections-path")); err != nil {
+		return err
+	}
+	if err := validateGalaxyLock(c.Bool("galaxy-lock"), c.Bool("galaxy-frozen")); err != nil {
+		return err
+	}
 
-	// Run ansible-lint if requested.
-	if c.Bool("lint") {
-		if err := runAnsibleLint(ctx, playbooks); err != nil {
+	// In plan and apply mode, bind the plan to the commit and the inputs. An
+	// apply only runs if they still match what was planned.
+	mode := c.String("mode")
+	var inputs planInputs
+	var applied *planSummary
+	if mode != modeRun {
+		var err error
+		if inputs, err = collectPlanInputs(c, inventories, playbooks, extraVars, galaxyFile); err != nil {
+			return err
+		}
+	}
+	if mode == modeApply {
+		plan, err := readPlanFile(c.String("plan-file"))
+		if err != nil {
+			return err
+		}
+		if err := verifyPlan(plan, inputs); err != nil {
 			return err
 		}
+		applied = &planSummary{Mode: modeApply, File: c.String("plan-file"), GitSHA: plan.GitSHA, Changes: plan.changes()}
+		log.Printf("Plan %s verified against commit %s", c.String("plan-file"), shortSHA(plan.GitSHA))
 	}
 
 	// Set execution timeout based on flag. validateNumericInputs guarantees a
 	// minimum of 1 minute, so the context can never be created already-expired.
+	// Lint, the Galaxy and pip installs and every playbook attempt may have
+	// shorter timeouts of their own.
 	timeoutDuration := time.Duration(c.Int("execution-timeout")) * time.Minute
 	log.Printf("Setting execution timeout to %d minute(s)", c.Int("execution-timeout"))
+	for _, flag := range []string{"lint-timeout", "galaxy-install-timeout", "pip-install-timeout", "playbook-timeout"} {
+		if c.Int(flag) > c.Int("execution-timeout") {
+			log.Printf("Warning: --%s (%d minutes) exceeds --execution-timeout (%d minutes) and is capped by it", flag, c.Int(flag), c.Int("execution-timeout"))
+		}
+	}
 
 	// Create context with timeout.
-	ctx, cancel := context.WithTimeout(ctx, timeoutDuration)
+	ctx, cancel := context.WithTimeoutCause(ctx, timeoutDuration, &timeoutError{phase: phaseExecution, timeout: timeoutDuration})
 	defer cancel()
+	start := time.Now()
+	gracePeriod := time.Duration(c.Int("cancel-grace-period")) * time.Second
+
+	// failPhase finishes a run that failed before the playbooks started, so
+	// the step summary still says why.
+	failPhase := func(phaseCtx context.Context, err error) error {
+		err = interruptedError(phaseCtx, err)
+		writeStepSummary(playbooks, err, time.Since(start), report)
+		return err
+	}
+
+	// Run ansible-lint if requested.
+	if c.Bool("lint") {
+		lintCtx, cancelLint := phaseContext(ctx, phaseLint, time.Duration(c.Int("lint-timeout"))*time.Minute)
+		err := runAnsibleLint(lintCtx, playbooks)
+		cancelLint()
+		if err != nil {
+			return failPhase(lintCtx, err)
+		}
+	}
 
 	// Write known_hosts if provided.
 	if knownHosts := c.String("known-hosts"); knownHosts != "" {
@@ -1043,30 +1406,106 @@ func run(ctx context.Context, c *cli.Command) (execErr error) {
 		log.Printf("Vault password written to temporary file")
 	}
 
+	// Stream task-level events from the embedded callback plugin into the
+	// run report.
+	events, err := startEventStream(report)
+	if err != nil {
+		return fmt.Errorf("could not start playbook event stream: %w", err)
+	}
+	defer events.close()
+	for k, v := range events.env(c.String("config-file")) {
+		extraEnv[k] = v
+	}
+
+	// Exported facts are read back from a jsonfile fact cache in a private
+	// directory once the playbooks have run.
+	factCaching := c.String("fact-caching")
+	var facts *factCache
+	if len(exportFacts) > 0 {
+		if facts, err = newFactCache(); err != nil {
+			return err
+		}
+		defer facts.close()
+		for k, v := range facts.env() {
+			extraEnv[k] = v
+		}
+		factCaching = "jsonfile"
+	}
+
+	// Retries can be limited to the hosts listed in Ansible's retry files.
+	var failedOnly *failedHostRetry
+	if c.Bool("retry-failed-hosts") && c.Int("retries") > 0 {
+		if failedOnly, err = newFailedHostRetry(c.String("limit")); err != nil {
+			return err
+		}
+		defer failedOnly.close()
+		for k, v := range failedOnly.env() {
+			extraEnv[k] = v
+		}
+	}
+
+	policy := retryPolicy{
+		retries:  c.Int("retries"),
+		delay:    time.Duration(c.Int("retry-delay")) * time.Second,
+		backoff:  c.String("retry-backoff"),
+		maxDelay: time.Duration(c.Int("retry-max-delay")) * time.Second,
+		jitter:   c.Int("retry-jitter"),
+		on:       retryOn,
+	}
+
+	// Install Galaxy requirements once, before the first attempt. A failed
+	// install is retried on its own, with the delays of the playbook retries.
+	galaxy := newGalaxyInstall(c, galaxyFile)
+	if galaxyFile != "" {
+		galaxyPolicy := policy
+		galaxyPolicy.retries = c.Int("galaxy-retries")
+		galaxyPolicy.on = nil
+		galaxyCtx, cancelGalaxy := phaseContext(ctx, phaseGalaxy, time.Duration(c.Int("galaxy-install-timeout"))*time.Minute)
+		err := installGalaxyRequirements(galaxyCtx, galaxy, galaxyPolicy, galaxyEnv(c, extraEnv), gracePeriod,
+			inGitHubActions() && c.String("log-groups") != logGroupsNone, report)
+		cancelGalaxy()
+		if err != nil {
+			return failPhase(galaxyCtx, err)
+		}
+	} else if c.String("galaxy-cache-dir") != "" || c.String("galaxy-vendor-dir") != "" || c.Bool("galaxy-lock") || c.Bool("galaxy-frozen") ||
+		len(galaxy.allowedNamespaces) > 0 || len(galaxy.allowedLicenses) > 0 {
+		log.Printf("Warning: galaxy-cache-dir, galaxy-vendor-dir, galaxy-lock, galaxy-frozen or a galaxy-allowed-* list is set but there is no Galaxy requirements file; ignoring")
+	}
+	// The playbooks find the content where it was installed, or in
+	// galaxy-collections-path even without requirements to install.
+	for k, v := range galaxy.env() {
+		extraEnv[k] = v
+	}
+
+	// Install Python requirements into a virtualenv whose interpreter runs
+	// the modules on localhost.
+	if c.String("pip-requirements") != "" {
+		pip := newPipInstall(c)
+		defer pip.close()
+		pipCtx, cancelPip := phaseContext(ctx, phasePip, time.Duration(c.Int("pip-install-timeout"))*time.Minute)
+		err := installPipRequirements(pipCtx, pip, extraEnv, gracePeriod,
+			inGitHubActions() && c.String("log-groups") != logGroupsNone, report)
+		cancelPip()
+		if err != nil {
+			return failPhase(pipCtx, err)
+		}
+		inventories = append(inventories, pip.inventory)
+	} else if c.String("pip-cache-dir") != "" {
+		log.Printf("Warning: pip-cache-dir is set but there is no pip-requirements file; ignoring")
+	}
+
+	// The SBOM lists the content installed above, or already present in the
+	// install paths when there are no requirements.
+	if sbomFile := c.String("sbom-file"); sbomFile != "" {
+		if err := writeSBOMFile(ctx, sbomFile, galaxy); err != nil {
+			return err
+		}
+	}
+
 	log.Printf("Starting Ansible playbook execution with %d playbooks", len(playbooks))
 
 	playbook := &ansible.Playbook{
 		Config: ansible.Config{
-			// Galaxy-related configuration.
-			GalaxyFile:                        galaxyFile,
-			GalaxyForce:                       c.Bool("galaxy-force"),
-			GalaxyAPIKey:                      c.String("galaxy-api-key"),
-			GalaxyAPIServerURL:                c.String("galaxy-api-server-url"),
-			GalaxyCollectionsPath:             c.String("galaxy-collections-path"),
-			GalaxyDisableGPGVerify:            c.Bool("galaxy-disable-gpg-verify"),
-			GalaxyForceWithDeps:               c.Bool("galaxy-force-with-deps"),
-			GalaxyIgnoreCerts:                 c.Bool("galaxy-ignore-certs"),
-			GalaxyIgnoreSignatureStatusCodes:  c.StringSlice("galaxy-ignore-signature-status-codes"),
-			GalaxyKeyring:                     c.String("galaxy-keyring"),
-			GalaxyOffline:                     c.Bool("galaxy-offline"),
-			GalaxyPre:                         c.Bool("galaxy-pre"),
-			GalaxyRequiredValidSignatureCount: c.Int("galaxy-required-valid-signature-count"),
-			GalaxyRequirementsFile:            c.String("galaxy-requirements-file"),
-			GalaxySignature:                   c.String("galaxy-signature"),
-			GalaxyTimeout:                     c.Int("galaxy-timeout"),
-			GalaxyUpgrade:                     c.Bool("galaxy-upgrade"),
-			GalaxyNoDeps:                      c.Bool("galaxy-no-deps"),
-
 			// Inventory and playbook configuration.
 			Inventories:   inventories,
 			Playbooks:     playbooks,
@@ -1076,8 +1515,8 @@ func run(ctx context.Context, c *cli.Command) (execErr error) {
 			Tags:          c.String("tags"),
 			ExtraVars:     extraVars,
 			ModulePath:    modulePath,
-			Check:         c.Bool("check") || c.Bool("dry-run"),
-			Diff:          c.Bool("diff") || c.Bool("dry-run"),
+			Check:         c.Bool("check") || c.Bool("dry-run") || c.Bool("drift-detect") || mode == modePlan,
+			Diff:          c.Bool("diff") || c.Bool("dry-run") || c.Bool("drift-detect") || mode == modePlan,
 			FlushCache:    c.Bool("flush-cache"),
 			ForceHandlers: c.Bool("force-handlers"),
 			ListHosts:     c.Bool("list-hosts"),
@@ -1111,9 +1550,9 @@ func run(ctx context.Context, c *cli.Command) (execErr error) {
 			VaultPasswordFile:  vaultPasswordFile,
 			AskVaultPass:       c.Bool("ask-vault-pass"),
 			FactPath:           c.String("fact-path"),
-			FactCaching:        c.String("fact-caching"),
+			FactCaching:        factCaching,
 			FactCachingTimeout: c.Int("fact-caching-timeout"),
-			CallbacksEnabled:   c.String("callbacks-enabled"),
+			CallbacksEnabled:   enabledCallbacks(c.String("callbacks-enabled"), c.String("config-file"), eventsCallbackName),
 			PollInterval:       c.Int("poll-interval"),
 			GatherSubset:       c.String("gather-subset"),
 			GatherTimeout:      c.Int("gather-timeout"),
@@ -1126,6 +1565,24 @@ func run(ctx context.Context, c *cli.Command) (execErr error) {
 		},
 	}
 
+	// Feed Ansible's stdout through the output parser so the play recap and
+	// failed tasks can be published as action outputs and in the step summary,
+	// and stderr through the diagnostic parser for errors and warnings.
+	parser := newOutputParser(report)
+	stdoutLines := newLineWriter(parser.handleLine)
+	diagnostics := newDiagnosticParser(report)
+	stderrLines := newLineWriter(diagnostics.handleLine)
+
+	// On GitHub Actions, fold the console log into groups per play or task.
+	// Only the console copy gets workflow commands; output-file stays clean.
+	var console io.Writer = os.Stdout
+	logGroups := newLogGroupWriter(os.Stdout, c.String("log-groups"))
+	if inGitHubActions() && c.String("log-groups") != logGroupsNone {
+		console = logGroups
+	}
+	playbook.Stdout = io.MultiWriter(console, stdoutLines)
+	playbook.Stderr = io.MultiWriter(os.Stderr, stderrLines)
+
 	// If output-file is set, tee stdout and stderr to a file for later use (e.g., PR comments).
 	if outputFile := c.String("output-file"); outputFile != "" {
 		f, err := os.Create(outputFile)
@@ -1137,39 +1594,228 @@ func run(ctx context.Context, c *cli.Command) (execErr error) {
 				fmt.Fprintf(os.Stderr, "warning: failed to close output file: %v\n", cerr)
 			}
 		}()
-		playbook.Stdout = io.MultiWriter(os.Stdout, f)
-		playbook.Stderr = io.MultiWriter(os.Stderr, f)
+		playbook.Stdout = io.MultiWriter(console, f, stdoutLines)
+		playbook.Stderr = io.MultiWriter(os.Stderr, f, stderrLines)
 		fmt.Fprintf(os.Stderr, "Ansible output will be saved to %s\n", outputFile)
 	}
 
-	retries := c.Int("retries")
-	retryDelay := time.Duration(c.Int("retry-delay")) * time.Second
+	playbookTimeout := time.Duration(c.Int("playbook-timeout")) * time.Minute
+	runPlaybook := func(ctx context.Context) error {
+		ctx, cancel := phaseContext(ctx, phasePlaybook, playbookTimeout)
+		defer cancel()
+		defer logGroups.Flush()
+		defer stdoutLines.Flush()
+		defer diagnostics.Flush()
+		defer stderrLines.Flush()
+		defer events.wait()
+		return execGracefully(ctx, gracePeriod, events.playbookPID, playbook.Exec)
+	}
+	var retryHosts []string
+	attempt := func(ctx context.Context) error {
+		// Only the last attempt's recap is reported, except for the hosts a
+		// retry limited to the failed hosts left out.
+		if retryHosts != nil {
+			report.forgetHosts(retryHosts)
+		} else {
+			report.reset()
+		}
+		parser.reset()
+		err := runPlaybook(ctx)
+		if failedOnly != nil {
+			retryHosts = failedOnly.next(&playbook.Config.Limit, err, report.hosts())
+		}
+		return err
+	}
+	execErr = execWithRetry(ctx, policy, func(ctx context.Context) error {
+		started := time.Now()
+		err := attempt(ctx)
+		report.recordAttempt(attemptRecord{ExitCode: exitCode(err), Class: failureClass(err), Duration: time.Since(started)})
+		return err
+	})
+	execErr = interruptedError(ctx, execErr)
+	if execErr == nil && c.Bool("idempotence-check") {
+		execErr = checkIdempotence(ctx, report, attempt)
+	}
+	if execErr == nil && c.Bool("drift-detect") {
+		execErr = checkDrift(report, c.String("drift-policy"))
+	}
+	if applied != nil {
+		report.recordPlan(*applied)
+	}
+	if execErr == nil && mode == modePlan {
+		plan := newExecutionPlan(inputs, report)
+		if err := writePlanFile(c.String("plan-file"), plan); err != nil {
+			execErr = err
+		} else {
+			report.recordPlan(planSummary{Mode: modePlan, File: c.String("plan-file"), GitSHA: plan.GitSHA, Changes: plan.changes()})
+		}
+	}
+	if facts != nil {
+		if err := exportHostFacts(facts, exportFacts, c.String("facts-file"), report); err != nil {
+			if execErr == nil {
+				execErr = err
+			} else {
+				log.Printf("Warning: %v", err)
+			}
+		}
+	}
+	writeStepSummary(playbooks, execErr, time.Since(start), report)
 
-	start := time.Now()
-	execErr = execWithRetry(ctx, retries, retryDelay, playbook.Exec)
-	writeStepSummary(playbooks, execErr, time.Since(start))
+	// A report file that cannot be written fails an otherwise successful run,
+	// but only once the other reports are written.
+	var reportErr error
+	if diffFile := c.String("diff-markdown-file"); diffFile != "" {
+		if err := writeDiffMarkdown(diffFile, report); err != nil {
+			log.Printf("Warning: %v", err)
+			reportErr = errors.Join(reportErr, err)
+		}
+	}
+	if c.Bool("pr-comment") {
+		client := newGitHubClient(c.String("github-api-url"), c.String("github-token"))
+		postPRComment(ctx, client, commentMarker(c.String("pr-comment-id")), playbooks, execErr, report)
+	}
+	if junitFile := c.String("junit-file"); junitFile != "" {
+		if err := writeJUnitFile(junitFile, report); err != nil {
+			log.Printf("Warning: %v", err)
+			reportErr = errors.Join(reportErr, err)
+		}
+	}
+	if execErr == nil {
+		return reportErr
+	}
 	return execErr
 }
 
-// writeActionOutputs writes status and exit_code to $GITHUB_OUTPUT.
-func writeActionOutputs(execErr error) {
+// exitCode returns ansible-playbook's exit code for err, 1 for errors that did
+// not come from ansible-playbook and 0 for nil.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ansibleErr *ansible.AnsibleError
+	if errors.As(err, &ansibleErr) {
+		return ansibleErr.ExitCode
+	}
+	return 1
+}
+
+// actionOutputs assembles an $GITHUB_OUTPUT document and remembers which keys
+// it holds.
+type actionOutputs struct {
+	b    strings.Builder
+	keys map[string]bool
+}
+
+// set adds a string output. Values spanning several lines use the heredoc
+// syntax with a random delimiter that cannot occur in the value. The value is
+// written unchanged, followed by a newline GitHub drops before the delimiter,
+// so a trailing newline of the value survives.
+func (o *actionOutputs) set(key, value string) {
+	if o.keys == nil {
+		o.keys = make(map[string]bool)
+	}
+	if !strings.ContainsAny(value, "\r\n") {
+		fmt.Fprintf(&o.b, "%s=%s\n", key, value)
+		o.keys[key] = true
+		return
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("Warning: could not encode action output %s: %v", key, err)
+		return
+	}
+	delimiter := "ghadelimiter_" + hex.EncodeToString(buf)
+	if strings.Contains(value, delimiter) {
+		log.Printf("Warning: could not encode action output %s: value contains its delimiter", key)
+		return
+	}
+	fmt.Fprintf(&o.b, "%s<<%s\n%s\n%s\n", key, delimiter, value, delimiter)
+	o.keys[key] = true
+}
+
+// setJSON adds an output holding the JSON encoding of v.
+func (o *actionOutputs) setJSON(key string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Warning: could not encode action output %s: %v", key, err)
+		return
+	}
+	o.set(key, string(data))
+}
+
+// has reports whether key was already set.
+func (o *actionOutputs) has(key string) bool {
+	return o.keys[key]
+}
+
+// writeActionOutputs writes status, exit_code, the play recap and the
+// playbooks' set_stats data to $GITHUB_OUTPUT. Host lists and counters are
+// JSON-encoded so workflows can read them with fromJSON().
+func writeActionOutputs(execErr error, report *runReport) {
 	outputFile := os.Getenv("GITHUB_OUTPUT")
 	if outputFile == "" {
 		return
 	}
 
 	status := "success"
-	exitCode := 0
 	if execErr != nil {
 		status = "failed"
-		var ansibleErr *ansible.AnsibleError
-		if errors.As(execErr, &ansibleErr) {
-			exitCode = ansibleErr.ExitCode
-		} else {
-			exitCode = 1
+		switch {
+		case errors.Is(execErr, ErrCancelled):
+			status = "cancelled"
+		case errors.Is(execErr, ErrTimedOut):
+			status = "timed_out"
+		case errors.Is(execErr, ErrGalaxyFailed):
+			status = "galaxy_failed"
+		case errors.Is(execErr, ErrPipFailed):
+			status = "pip_failed"
+		case errors.Is(execErr, ErrNotIdempotent):
+			status = "not_idempotent"
+		case errors.Is(execErr, ErrDriftDetected):
+			status = "drift_detected"
+		case errors.Is(execErr, ErrPlanMismatch):
+			status = "plan_mismatch"
 		}
 	}
 
+	var out actionOutputs
+	out.set("status", status)
+	out.set("exit_code", strconv.Itoa(exitCode(execErr)))
+	if report == nil {
+		report = newRunReport()
+	}
+	changedHosts := report.changedHosts()
+	out.set("changed", strconv.FormatBool(len(changedHosts) > 0))
+	out.setJSON("changed_hosts", changedHosts)
+	out.setJSON("failed_hosts", report.failedHosts())
+	out.setJSON("unreachable_hosts", report.unreachableHosts())
+	out.setJSON("host_stats", report.hostStats())
+	out.setJSON("totals", report.totals())
+	idempotenceChanges, _ := report.idempotence()
+	out.setJSON("idempotence_changes", idempotenceChanges)
+	// Drift outputs are only published when drift detection ran, so an empty
+	// value never claims that a host is in sync.
+	if driftChanges, checked := report.drift(); checked {
+		out.set("drift", strconv.FormatBool(len(driftChanges) > 0))
+		out.setJSON("drifted_hosts", hostsOf(driftChanges))
+		out.setJSON("drift_changes", driftChanges)
+	}
+	if md := report.diffMarkdownText(); md != "" {
+		out.set("diff_markdown", md)
+	}
+	if facts := report.exportedFacts(); facts != nil {
+		out.setJSON("facts", facts)
+	}
+	if g := report.galaxyRecord(); g != nil && g.CacheKey != "" {
+		out.set("galaxy_cache_key", g.CacheKey)
+		out.set("galaxy_cache_hit", strconv.FormatBool(g.CacheHit))
+	}
+	if p := report.pipRecord(); p != nil && p.CacheKey != "" {
+		out.set("pip_cache_key", p.CacheKey)
+		out.set("pip_cache_hit", strconv.FormatBool(p.CacheHit))
+	}
+	writeCustomStatsOutputs(&out, report.customStats())
+
 	// The path comes from $GITHUB_OUTPUT, set by the Actions runner; 0644 is
 	// required so the runner can read the file back. The matching gosec rules
 	// are excluded in .golangci.yml.
@@ -1183,48 +1829,44 @@ func writeActionOutputs(execErr error) {
 			log.Printf("Warning: could not close action outputs file: %v", cerr)
 		}
 	}()
-	if _, err := fmt.Fprintf(f, "status=%s\nexit_code=%d\n", status, exitCode); err != nil {
+	if _, err := fmt.Fprint(f, out.b.String()); err != nil {
 		log.Printf("Warning: could not write action outputs: %v", err)
 	}
 }
 
-// writeStepSummary writes a markdown summary to $GITHUB_STEP_SUMMARY.
-func writeStepSummary(playbooks []string, execErr error, duration time.Duration) {
-	summaryFile := os.Getenv("GITHUB_STEP_SUMMARY")
-	if summaryFile == "" {
-		return
-	}
-
-	status := "✅ Success"
-	if execErr != nil {
-		var ansibleErr *ansible.AnsibleError
-		if errors.As(execErr, &ansibleErr) {
-			status = fmt.Sprintf("❌ Failed (exit code %d)", ansibleErr.ExitCode)
+// customOutputName matches set_stats keys that can be published as outputs of
+// their own.
+var customOutputName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// writeCustomStatsOutputs publishes set_stats data: all of it as JSON in
+// custom_stats, and each key set with per_host: false as an output of its own.
+// String values are written as-is, anything else as JSON. Keys that are not
+// valid output names or that clash with an output of the wrapper are skipped.
+func writeCustomStatsOutputs(out *actionOutputs, custom map[string]map[string]json.RawMessage) {
+	out.setJSON("custom_stats", custom)
+
+	run := custom["_run"]
+	keys := make([]string, 0, len(run))
+	for key := range run {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		switch {
+		case !customOutputName.MatchString(key):
+			log.Printf("Warning: set_stats key %q is not a valid output name; skipping it", key)
+			continue
+		case out.has(key):
+			log.Printf("Warning: set_stats key %q clashes with a built-in output; skipping it", key)
+			continue
+		}
+		var str string
+		if err := json.Unmarshal(run[key], &str); err == nil {
+			out.set(key, str)
 		} else {
-			status = fmt.Sprintf("❌ Failed: %v", execErr)
+			out.set(key, string(run[key]))
 		}
 	}
-
-	escaped := make([]string, len(playbooks))
-	for i, p := range playbooks {
-		escaped[i] = strings.ReplaceAll(p, "|", `\|`)
-	}
-	playbookList := "`" + strings.Join(escaped, "`, `") + "`"
-	summary := fmt.Sprintf("## Ansible Playbook Results\n\n| | |\n|---|---|\n| **Playbooks** | %s |\n| **Status** | %s |\n| **Duration** | %s |\n",
-		playbookList, status, formatDuration(duration))
-
-	// The path comes from $GITHUB_STEP_SUMMARY, set by the Actions runner; 0644
-	// is required so the runner can read the file back. The matching gosec
-	// rules are excluded in .golangci.yml.
-	f, err := os.OpenFile(summaryFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Printf("Warning: could not write step summary: %v", err)
-		return
-	}
-	defer func() { _ = f.Close() }()
-	if _, err := fmt.Fprint(f, summary); err != nil {
-		log.Printf("Warning: could not write step summary: %v", err)
-	}
 }
 
 // formatDuration formats a duration as "Xm Ys" or "Xs".
@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -571,7 +573,7 @@ func TestWriteActionOutputs_Success(t *testing.T) {
 	tmpFile := filepath.Join(t.TempDir(), "output")
 	t.Setenv("GITHUB_OUTPUT", tmpFile)
 
-	writeActionOutputs(nil)
+	writeActionOutputs(nil, nil)
 
 	data, err := os.ReadFile(tmpFile)
 	if err != nil {
@@ -590,7 +592,7 @@ func TestWriteActionOutputs_Failed(t *testing.T) {
 	tmpFile := filepath.Join(t.TempDir(), "output")
 	t.Setenv("GITHUB_OUTPUT", tmpFile)
 
-	writeActionOutputs(fmt.Errorf("some error"))
+	writeActionOutputs(fmt.Errorf("some error"), nil)
 
 	data, _ := os.ReadFile(tmpFile)
 	content := string(data)
@@ -606,7 +608,7 @@ func TestWriteActionOutputs_AnsibleError(t *testing.T) {
 	tmpFile := filepath.Join(t.TempDir(), "output")
 	t.Setenv("GITHUB_OUTPUT", tmpFile)
 
-	writeActionOutputs(&ansible.AnsibleError{ExitCode: 2})
+	writeActionOutputs(&ansible.AnsibleError{ExitCode: 2}, nil)
 
 	data, _ := os.ReadFile(tmpFile)
 	content := string(data)
@@ -618,16 +620,226 @@ func TestWriteActionOutputs_AnsibleError(t *testing.T) {
 	}
 }
 
+func TestWriteActionOutputs_Interrupted(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("%w: %w", ErrCancelled, &ansible.AnsibleError{ExitCode: 99}), "status=cancelled\nexit_code=99\n"},
+		{fmt.Errorf("%w: %w", ErrTimedOut, context.DeadlineExceeded), "status=timed_out\nexit_code=1\n"},
+		{fmt.Errorf("%w: %w", ErrGalaxyFailed, errors.New("exit status 1")), "status=galaxy_failed\nexit_code=1\n"},
+		{fmt.Errorf("%w: %w", ErrPipFailed, errors.New("exit status 1")), "status=pip_failed\nexit_code=1\n"},
+	} {
+		tmpFile := filepath.Join(t.TempDir(), "output")
+		t.Setenv("GITHUB_OUTPUT", tmpFile)
+		writeActionOutputs(tt.err, nil)
+		data, _ := os.ReadFile(tmpFile)
+		if !strings.HasPrefix(string(data), tt.want) {
+			t.Errorf("expected outputs to start with %q, got: %s", tt.want, data)
+		}
+	}
+}
+
 func TestWriteActionOutputs_NoEnvVar(t *testing.T) {
 	t.Setenv("GITHUB_OUTPUT", "")
-	writeActionOutputs(nil)
+	writeActionOutputs(nil, nil)
+}
+
+func TestWriteActionOutputs_Recap(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "output")
+	t.Setenv("GITHUB_OUTPUT", tmpFile)
+
+	report := newRunReport()
+	report.recordStats("web1", hostStats{Ok: 3, Changed: 2})
+	report.recordStats("web2", hostStats{Ok: 1, Failed: 1})
+	report.recordStats("db1", hostStats{Unreachable: 1})
+	writeActionOutputs(&ansible.AnsibleError{ExitCode: 2}, report)
+
+	data, _ := os.ReadFile(tmpFile)
+	content := string(data)
+	for _, want := range []string{
+		"changed=true\n",
+		`changed_hosts=["web1"]`,
+		`failed_hosts=["web2"]`,
+		`unreachable_hosts=["db1"]`,
+		`"web1":{"ok":3,"changed":2,`,
+		`totals={"ok":4,"changed":2,"unreachable":1,"failed":1,`,
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("expected %q in outputs, got: %s", want, content)
+		}
+	}
+}
+
+func TestWriteActionOutputs_NotIdempotent(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "output")
+	t.Setenv("GITHUB_OUTPUT", tmpFile)
+
+	report := newRunReport()
+	report.recordIdempotence([]taskChange{{Host: "web1", Play: "Web", Task: "Render config"}})
+	writeActionOutputs(fmt.Errorf("%w: 1 task result(s) changed", ErrNotIdempotent), report)
+
+	data, _ := os.ReadFile(tmpFile)
+	content := string(data)
+	for _, want := range []string{
+		"status=not_idempotent\n",
+		"exit_code=1\n",
+		`idempotence_changes=[{"host":"web1","play":"Web","task":"Render config"}]`,
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("expected %q in outputs, got: %s", want, content)
+		}
+	}
+}
+
+func TestWriteActionOutputs_Drift(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "output")
+	t.Setenv("GITHUB_OUTPUT", tmpFile)
+
+	report := newRunReport()
+	report.recordDrift([]taskChange{{Host: "web2", Task: "A"}, {Host: "web1", Task: "B"}, {Host: "web2", Task: "C"}})
+	writeActionOutputs(nil, report)
+
+	data, _ := os.ReadFile(tmpFile)
+	content := string(data)
+	for _, want := range []string{
+		"status=success\n",
+		"drift=true\n",
+		`drifted_hosts=["web1","web2"]`,
+		`drift_changes=[{"host":"web2","task":"A"},`,
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("expected %q in outputs, got: %s", want, content)
+		}
+	}
+}
+
+func TestWriteActionOutputs_DiffMarkdown(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "output")
+	t.Setenv("GITHUB_OUTPUT", tmpFile)
+
+	report := newRunReport()
+	report.recordDiffMarkdown("## Ansible diff\n\n```diff\n-a\n+b\n```\n")
+	writeActionOutputs(nil, report)
+
+	data, _ := os.ReadFile(tmpFile)
+	m := regexp.MustCompile(`(?s)diff_markdown<<(ghadelimiter_[0-9a-f]{32})\n(.*)\n(ghadelimiter_[0-9a-f]{32})\n`).FindStringSubmatch(string(data))
+	if m == nil || m[1] != m[3] {
+		t.Fatalf("expected a heredoc diff_markdown output, got:\n%s", data)
+	}
+	if m[2] != "## Ansible diff\n\n```diff\n-a\n+b\n```\n" {
+		t.Errorf("unexpected diff_markdown value: %q", m[2])
+	}
+}
+
+func TestWriteActionOutputs_CustomStats(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "output")
+	t.Setenv("GITHUB_OUTPUT", tmpFile)
+
+	report := newRunReport()
+	report.recordCustomStats(map[string]map[string]json.RawMessage{
+		"_run": {
+			"version":   json.RawMessage(`"1.2.3"`),
+			"endpoints": json.RawMessage(`["a","b"]`),
+			"notes":     json.RawMessage(`"line 1\nline 2\n"`),
+			"status":    json.RawMessage(`"shadowed"`),
+			"bad key":   json.RawMessage(`1`),
+		},
+		"web1": {"port": json.RawMessage(`8080`)},
+	})
+	writeActionOutputs(nil, report)
+
+	data, _ := os.ReadFile(tmpFile)
+	content := string(data)
+	for _, want := range []string{
+		"version=1.2.3\n",
+		`endpoints=["a","b"]` + "\n",
+		`"web1":{"port":8080}`,
+		"status=success\n",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("expected %q in outputs, got: %s", want, content)
+		}
+	}
+	for _, unwanted := range []string{"status=shadowed", "\nbad key"} {
+		if strings.Contains(content, unwanted) {
+			t.Errorf("expected %q to be skipped, got: %s", unwanted, content)
+		}
+	}
+	m := regexp.MustCompile(`(?s)notes<<(ghadelimiter_[0-9a-f]{32})\n(.*?)\n(ghadelimiter_[0-9a-f]{32})\n`).FindStringSubmatch(content)
+	if m == nil || m[1] != m[3] || m[2] != "line 1\nline 2\n" {
+		t.Errorf("expected a heredoc notes output, got:\n%s", content)
+	}
+}
+
+func TestWriteActionOutputs_Facts(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "output")
+	t.Setenv("GITHUB_OUTPUT", tmpFile)
+
+	report := newRunReport()
+	report.recordFacts(map[string]map[string]any{"web1": {"kernel": "6.1.0"}})
+	writeActionOutputs(nil, report)
+
+	data, _ := os.ReadFile(tmpFile)
+	if want := `facts={"web1":{"kernel":"6.1.0"}}` + "\n"; !strings.Contains(string(data), want) {
+		t.Errorf("expected %q in outputs, got: %s", want, data)
+	}
+}
+
+func TestWriteActionOutputs_GalaxyCache(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "output")
+	t.Setenv("GITHUB_OUTPUT", tmpFile)
+
+	report := newRunReport()
+	report.recordGalaxy(galaxyPhase{Attempts: 1, CacheKey: "galaxy-abc"})
+	writeActionOutputs(nil, report)
+
+	data, _ := os.ReadFile(tmpFile)
+	if want := "galaxy_cache_key=galaxy-abc\ngalaxy_cache_hit=false\n"; !strings.Contains(string(data), want) {
+		t.Errorf("expected %q in outputs, got: %s", want, data)
+	}
+}
+
+func TestWriteActionOutputs_PipCache(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "output")
+	t.Setenv("GITHUB_OUTPUT", tmpFile)
+
+	report := newRunReport()
+	report.recordPip(pipPhase{CacheKey: "pip-abc", CacheHit: true})
+	writeActionOutputs(nil, report)
+
+	data, _ := os.ReadFile(tmpFile)
+	if want := "pip_cache_key=pip-abc\npip_cache_hit=true\n"; !strings.Contains(string(data), want) {
+		t.Errorf("expected %q in outputs, got: %s", want, data)
+	}
+}
+
+func TestWriteActionOutputs_EmptyRecap(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "output")
+	t.Setenv("GITHUB_OUTPUT", tmpFile)
+
+	writeActionOutputs(nil, nil)
+
+	data, _ := os.ReadFile(tmpFile)
+	content := string(data)
+	for _, want := range []string{"changed=false\n", "changed_hosts=[]\n", "host_stats={}\n", "idempotence_changes=[]\n", "custom_stats={}\n"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("expected %q in outputs, got: %s", want, content)
+		}
+	}
+	if strings.Contains(content, "drift") {
+		t.Errorf("expected no drift outputs without drift detection, got: %s", content)
+	}
+	if strings.Contains(content, "facts=") {
+		t.Errorf("expected no facts output without export-facts, got: %s", content)
+	}
 }
 
 func TestWriteStepSummary_Success(t *testing.T) {
 	tmpFile := filepath.Join(t.TempDir(), "summary.md")
 	t.Setenv("GITHUB_STEP_SUMMARY", tmpFile)
 
-	writeStepSummary([]string{"site.yml", "deploy.yml"}, nil, 2*time.Minute+35*time.Second)
+	writeStepSummary([]string{"site.yml", "deploy.yml"}, nil, 2*time.Minute+35*time.Second, nil)
 
 	data, err := os.ReadFile(tmpFile)
 	if err != nil {
@@ -648,14 +860,14 @@ func TestWriteStepSummary_Success(t *testing.T) {
 func TestWriteStepSummary_NoEnvVar(t *testing.T) {
 	t.Setenv("GITHUB_STEP_SUMMARY", "")
 	// Should not panic or error.
-	writeStepSummary([]string{"test.yml"}, nil, time.Second)
+	writeStepSummary([]string{"test.yml"}, nil, time.Second, nil)
 }
 
 func TestWriteStepSummary_Failure(t *testing.T) {
 	tmpFile := filepath.Join(t.TempDir(), "summary.md")
 	t.Setenv("GITHUB_STEP_SUMMARY", tmpFile)
 
-	writeStepSummary([]string{"site.yml"}, errors.New("something went wrong"), 5*time.Second)
+	writeStepSummary([]string{"site.yml"}, errors.New("something went wrong"), 5*time.Second, nil)
 
 	data, err := os.ReadFile(tmpFile)
 	if err != nil {
@@ -765,7 +977,7 @@ func TestCreateVaultPasswordFile(t *testing.T) {
 
 func TestExecWithRetry_SuccessFirst(t *testing.T) {
 	calls := 0
-	err := execWithRetry(context.Background(), 3, time.Millisecond, func(_ context.Context) error {
+	err := execWithRetry(context.Background(), retryPolicy{retries: 3, delay: time.Millisecond}, func(_ context.Context) error {
 		calls++
 		return nil
 	})
@@ -779,7 +991,7 @@ func TestExecWithRetry_SuccessFirst(t *testing.T) {
 
 func TestExecWithRetry_SuccessAfterRetries(t *testing.T) {
 	calls := 0
-	err := execWithRetry(context.Background(), 3, time.Millisecond, func(_ context.Context) error {
+	err := execWithRetry(context.Background(), retryPolicy{retries: 3, delay: time.Millisecond}, func(_ context.Context) error {
 		calls++
 		if calls < 3 {
 			return fmt.Errorf("attempt %d failed", calls)
@@ -796,7 +1008,7 @@ func TestExecWithRetry_SuccessAfterRetries(t *testing.T) {
 
 func TestExecWithRetry_AllFail(t *testing.T) {
 	calls := 0
-	err := execWithRetry(context.Background(), 2, time.Millisecond, func(_ context.Context) error {
+	err := execWithRetry(context.Background(), retryPolicy{retries: 2, delay: time.Millisecond}, func(_ context.Context) error {
 		calls++
 		return fmt.Errorf("fail %d", calls)
 	})
@@ -810,7 +1022,7 @@ func TestExecWithRetry_AllFail(t *testing.T) {
 
 func TestExecWithRetry_NoRetries(t *testing.T) {
 	calls := 0
-	err := execWithRetry(context.Background(), 0, time.Millisecond, func(_ context.Context) error {
+	err := execWithRetry(context.Background(), retryPolicy{retries: 0, delay: time.Millisecond}, func(_ context.Context) error {
 		calls++
 		return fmt.Errorf("fail")
 	})
@@ -825,7 +1037,7 @@ func TestExecWithRetry_NoRetries(t *testing.T) {
 func TestExecWithRetry_ContextCancelled(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	calls := 0
-	err := execWithRetry(ctx, 5, time.Second, func(_ context.Context) error {
+	err := execWithRetry(ctx, retryPolicy{retries: 5, delay: time.Second}, func(_ context.Context) error {
 		calls++
 		cancel() // cancel before retry delay
 		return fmt.Errorf("fail")
@@ -840,7 +1052,7 @@ func TestExecWithRetry_ContextCancelled(t *testing.T) {
 
 func TestExecWithRetry_NegativeRetries(t *testing.T) {
 	calls := 0
-	err := execWithRetry(context.Background(), -1, time.Millisecond, func(_ context.Context) error {
+	err := execWithRetry(context.Background(), retryPolicy{retries: -1, delay: time.Millisecond}, func(_ context.Context) error {
 		calls++
 		return fmt.Errorf("fail")
 	})
@@ -853,6 +1065,35 @@ func TestExecWithRetry_NegativeRetries(t *testing.T) {
 	}
 }
 
+func TestExecWithRetry_StopsOnUnretryableFailure(t *testing.T) {
+	calls := 0
+	policy := retryPolicy{retries: 3, delay: time.Millisecond, on: []string{retryOnUnreachable}}
+	err := execWithRetry(context.Background(), policy, func(_ context.Context) error {
+		calls++
+		if calls == 1 {
+			return &ansible.AnsibleError{ExitCode: 4}
+		}
+		return &ansible.AnsibleError{ExitCode: 2}
+	})
+	if calls != 2 {
+		t.Errorf("expected the unreachable failure to be retried once, got %d calls", calls)
+	}
+	var ansibleErr *ansible.AnsibleError
+	if !errors.As(err, &ansibleErr) || ansibleErr.ExitCode != 2 {
+		t.Errorf("expected the host failure to be returned, got %v", err)
+	}
+}
+
+func TestRun_InvalidRetryOn(t *testing.T) {
+	tmpDir := t.TempDir()
+	pb := createTempFile(t, tmpDir, "pb.yml", "---\n- hosts: all\n")
+	inv := createTempFile(t, tmpDir, "inv.yml", "all:\n  hosts:\n    localhost:\n")
+	err := runWithArgs(t, []string{"test", "--playbook", pb, "--inventory", inv, "--retry-on", "unreachable,flaky"})
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Fatalf("expected ErrInvalidParameter for an unknown retry-on class, got %v", err)
+	}
+}
+
 func TestRunAnsibleLint_NotInstalled(t *testing.T) {
 	// Use empty PATH so ansible-lint is not found.
 	t.Setenv("PATH", t.TempDir())
@@ -1333,3 +1574,140 @@ func TestRun_KnownHostsWritten(t *testing.T) {
 		t.Errorf("known_hosts missing the supplied entry, got:\n%s", string(data))
 	}
 }
+
+// TestRun_InvalidLogGroups verifies run() rejects an unknown log-groups value
+// before attempting any execution.
+func TestRun_InvalidLogGroups(t *testing.T) {
+	tmpDir := t.TempDir()
+	pb := createTempFile(t, tmpDir, "pb.yml", "---\n- hosts: all\n")
+	inv := createTempFile(t, tmpDir, "inv.yml", "all:\n  hosts:\n    localhost:\n")
+	err := runWithArgs(t, []string{"test", "--playbook", pb, "--inventory", inv, "--log-groups", "host"})
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Fatalf("expected ErrInvalidParameter for an unknown log-groups value, got %v", err)
+	}
+}
+
+// TestRun_WritesJUnitFileOnError verifies the JUnit report is written even
+// when ansible-playbook fails, so test reporters can still pick it up.
+func TestRun_WritesJUnitFileOnError(t *testing.T) {
+	tmpDir := t.TempDir()
+	pb := createTempFile(t, tmpDir, "pb.yml", "---\n- hosts: all\n")
+	inv := createTempFile(t, tmpDir, "inv.yml", "all:\n  hosts:\n    localhost:\n")
+	junitFile := filepath.Join(tmpDir, "reports", "junit.xml")
+	err := runWithArgs(t, []string{"test", "--playbook", pb, "--inventory", inv, "--junit-file", junitFile})
+	if err == nil {
+		t.Fatal("expected run() to fail at ansible exec, got nil")
+	}
+	data, readErr := os.ReadFile(junitFile)
+	if readErr != nil {
+		t.Fatalf("expected JUnit report to be written, got: %v", readErr)
+	}
+	if !strings.Contains(string(data), "<testsuites") {
+		t.Errorf("expected a testsuites element, got:\n%s", data)
+	}
+}
+
+// TestRun_IdempotenceCheckRejectsCheckMode verifies idempotence-check cannot
+// be combined with check mode, where nothing would ever change.
+func TestRun_IdempotenceCheckRejectsCheckMode(t *testing.T) {
+	tmpDir := t.TempDir()
+	pb := createTempFile(t, tmpDir, "pb.yml", "---\n- hosts: all\n")
+	inv := createTempFile(t, tmpDir, "inv.yml", "all:\n  hosts:\n    localhost:\n")
+	err := runWithArgs(t, []string{"test", "--playbook", pb, "--inventory", inv, "--idempotence-check", "--dry-run"})
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Fatalf("expected ErrInvalidParameter for idempotence-check with dry-run, got %v", err)
+	}
+}
+
+// TestRun_InvalidDriftPolicy verifies run() rejects an unknown drift-policy
+// value before attempting any execution.
+func TestRun_InvalidDriftPolicy(t *testing.T) {
+	tmpDir := t.TempDir()
+	pb := createTempFile(t, tmpDir, "pb.yml", "---\n- hosts: all\n")
+	inv := createTempFile(t, tmpDir, "inv.yml", "all:\n  hosts:\n    localhost:\n")
+	err := runWithArgs(t, []string{"test", "--playbook", pb, "--inventory", inv, "--drift-detect", "--drift-policy", "ignore"})
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Fatalf("expected ErrInvalidParameter for an unknown drift-policy value, got %v", err)
+	}
+}
+
+func TestRun_ExportFactsRejectsOtherCache(t *testing.T) {
+	tmpDir := t.TempDir()
+	pb := createTempFile(t, tmpDir, "pb.yml", "---\n- hosts: all\n")
+	inv := createTempFile(t, tmpDir, "inv.yml", "all:\n  hosts:\n    localhost:\n")
+	err := runWithArgs(t, []string{"test", "--playbook", pb, "--inventory", inv, "--export-facts", "kernel", "--fact-caching", "redis"})
+	if !errors.Is(err, ErrInvalidParameter) {
+		t.Fatalf("expected ErrInvalidParameter for export-facts with a redis fact cache, got %v", err)
+	}
+}
+
+// TestRun_RejectsInvalidRequirements verifies a broken requirements file
+// fails the run before ansible-galaxy is called.
+func TestRun_RejectsInvalidRequirements(t *testing.T) {
+	tmpDir := t.TempDir()
+	pb := createTempFile(t, tmpDir, "pb.yml", "---\n- hosts: all\n")
+	inv := createTempFile(t, tmpDir, "inv.yml", "all:\n  hosts:\n    localhost:\n")
+	req := createTempFile(t, tmpDir, "requirements.yml", "collections:\n  - name: community.general\n    version: latest\n")
+	logFile := fakeGalaxy(t, "exit 0")
+
+	err := runWithArgs(t, []string{"test", "--playbook", pb, "--inventory", inv, "--galaxy-file", req})
+	if !errors.Is(err, ErrInvalidParameter) || !strings.Contains(err.Error(), req+`:3: invalid version specifier "latest"`) {
+		t.Fatalf("expected the invalid version to be reported, got %v", err)
+	}
+	if _, err := os.Stat(logFile); !os.IsNotExist(err) {
+		t.Error("expected ansible-galaxy not to run")
+	}
+}
+
+func TestRun_RejectsMissingPipRequirements(t *testing.T) {
+	tmpDir := t.TempDir()
+	pb := createTempFile(t, tmpDir, "pb.yml", "---\n- hosts: all\n")
+	inv := createTempFile(t, tmpDir, "inv.yml", "all:\n  hosts:\n    localhost:\n")
+	missing := filepath.Join(tmpDir, "requirements.txt")
+
+	err := runWithArgs(t, []string{"test", "--playbook", pb, "--inventory", inv, "--pip-requirements", missing})
+	if !errors.Is(err, ErrInvalidParameter) || !strings.Contains(err.Error(), "pip-requirements file does not exist: "+missing) {
+		t.Fatalf("expected the missing file to be reported, got %v", err)
+	}
+}
+
+// TestRun_ApplyRejectsMismatchedPlan verifies apply mode refuses to run when
+// the plan was made from another commit, and reports plan_mismatch.
+func TestRun_ApplyRejectsMismatchedPlan(t *testing.T) {
+	tmpDir := t.TempDir()
+	outFile := filepath.Join(tmpDir, "github_output")
+	t.Setenv("GITHUB_OUTPUT", outFile)
+	t.Setenv("GITHUB_SHA", "new-commit")
+	pb := createTempFile(t, tmpDir, "pb.yml", "---\n- hosts: all\n")
+	inv := createTempFile(t, tmpDir, "inv.yml", "all:\n  hosts:\n    localhost:\n")
+	planFile := createTempFile(t, tmpDir, "plan.json", `{"version":1,"git_sha":"old-commit","inventories":["`+inv+`"],"playbooks":["`+pb+`"]}`)
+
+	err := runWithArgs(t, []string{"test", "--playbook", pb, "--inventory", inv, "--mode", "apply", "--plan-file", planFile})
+	if !errors.Is(err, ErrPlanMismatch) {
+		t.Fatalf("expected ErrPlanMismatch, got %v", err)
+	}
+	data, _ := os.ReadFile(outFile)
+	if !strings.Contains(string(data), "status=plan_mismatch\n") {
+		t.Errorf("expected status=plan_mismatch, got:\n%s", data)
+	}
+}
+
+// TestRun_InvalidModeCombinations verifies contradicting run modes are
+// rejected before anything runs.
+func TestRun_InvalidModeCombinations(t *testing.T) {
+	tmpDir := t.TempDir()
+	pb := createTempFile(t, tmpDir, "pb.yml", "---\n- hosts: all\n")
+	inv := createTempFile(t, tmpDir, "inv.yml", "all:\n  hosts:\n    localhost:\n")
+	for _, extra := range [][]string{
+		{"--mode", "deploy"},
+		{"--mode", "apply", "--check"},
+		{"--mode", "plan", "--drift-detect"},
+		{"--mode", "plan", "--idempotence-check"},
+		{"--mode", "plan", "--plan-file", ""},
+	} {
+		args := append([]string{"test", "--playbook", pb, "--inventory", inv}, extra...)
+		if err := runWithArgs(t, args); !errors.Is(err, ErrInvalidParameter) {
+			t.Errorf("%v: expected ErrInvalidParameter, got %v", extra, err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	cli "github.com/urfave/cli/v3"
+)
+
+const (
+	// pipCacheKeyPrefix starts every pip cache key and the name of every
+	// cache entry.
+	pipCacheKeyPrefix = "pip-"
+	// pipCacheComplete marks a cache entry whose install finished.
+	pipCacheComplete = ".complete"
+)
+
+// pipSeedPackages are installed into every virtualenv by venv itself and are
+// left out of the step summary.
+var pipSeedPackages = map[string]bool{"pip": true, "setuptools": true}
+
+// pipInstall holds the settings of the pip-* inputs. The wrapper installs the
+// requirements into a virtualenv that sees the system site-packages, so
+// Ansible itself stays importable, and makes its interpreter the one of
+// localhost.
+type pipInstall struct {
+	file     string
+	cacheDir string
+
+	// venv is the virtualenv the requirements were installed into; temp is
+	// set when it was created for this run only and is removed by close.
+	venv string
+	temp bool
+	// inventory is the temporary inventory that sets localhost's
+	// ansible_python_interpreter to the virtualenv's.
+	inventory string
+}
+
+// pythonPackage is a package installed into the virtualenv, as listed by
+// "pip list".
+type pythonPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// pipPhase describes the pip install for the step summary. CacheKey is set
+// when pip-cache-dir is, and CacheHit when the install was skipped.
+type pipPhase struct {
+	Duration time.Duration
+	Failed   bool
+	CacheKey string
+	CacheHit bool
+	Packages []pythonPackage
+}
+
+// newPipInstall reads the pip-* inputs.
+func newPipInstall(c *cli.Command) *pipInstall {
+	return &pipInstall{
+		file:     c.String("pip-requirements"),
+		cacheDir: c.String("pip-cache-dir"),
+	}
+}
+
+// installPipRequirements installs p's requirements, inside a log group if
+// group is set, and records the installed packages and how long it took in
+// report. A failed install is reported as ErrPipFailed, so it is not mistaken
+// for a playbook failure.
+func installPipRequirements(ctx context.Context, p *pipInstall, env map[string]string, grace time.Duration, group bool, report *runReport) error {
+	if group {
+		fmt.Println("::group::Install Python requirements")
+		defer fmt.Println("::endgroup::")
+	}
+	start := time.Now()
+	phase := pipPhase{}
+	err := p.install(ctx, env, grace, &phase)
+	if err == nil {
+		err = p.writeInventory()
+	}
+	if err == nil {
+		phase.Packages, err = p.packages(ctx)
+	}
+	phase.Duration = time.Since(start)
+	phase.Failed = err != nil
+	report.recordPip(phase)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPipFailed, err)
+	}
+	if !phase.CacheHit {
+		log.Printf("Python requirements installed in %s", formatDuration(phase.Duration))
+	}
+	return nil
+}
+
+// install creates the virtualenv and installs the requirements into it. With
+// a cache directory, it looks the requirements up in the cache first and
+// otherwise builds a new entry, which replaces the entries of older
+// requirements.
+func (p *pipInstall) install(ctx context.Context, env map[string]string, grace time.Duration, phase *pipPhase) error {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		return fmt.Errorf("python3 is not installed: %w", err)
+	}
+	if p.cacheDir == "" {
+		dir, err := os.MkdirTemp("", "ansible-venv-")
+		if err != nil {
+			return fmt.Errorf("failed to create virtualenv directory: %w", err)
+		}
+		p.venv, p.temp = dir, true
+		return p.create(ctx, python, env, grace)
+	}
+
+	cacheDir, err := filepath.Abs(p.cacheDir)
+	if err != nil {
+		return fmt.Errorf("invalid pip-cache-dir: %w", err)
+	}
+	out, err := exec.CommandContext(ctx, python, "--version").Output()
+	if err != nil {
+		return fmt.Errorf("could not determine the Python version: %w", err)
+	}
+	key, err := p.cacheKey(string(bytes.TrimSpace(out)), cacheDir)
+	if err != nil {
+		return err
+	}
+	phase.CacheKey = key
+	entry := filepath.Join(cacheDir, key)
+	p.venv = entry
+	if _, err := os.Stat(filepath.Join(entry, pipCacheComplete)); err == nil {
+		log.Printf("pip cache hit: %s", key)
+		phase.CacheHit = true
+		return nil
+	}
+	log.Printf("pip cache miss: %s", key)
+
+	// A virtualenv cannot be moved once created, so the entry is built in
+	// place and only marked complete at the end; an entry without the marker
+	// is left over from a failed or cancelled install and is rebuilt.
+	if err := os.RemoveAll(entry); err != nil {
+		return fmt.Errorf("failed to replace pip cache entry: %w", err)
+	}
+	// #nosec G301 -- the cache lives in the workspace and is saved by a later
+	// step, e.g. actions/cache, which may run as a different user.
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return fmt.Errorf("failed to create pip-cache-dir: %w", err)
+	}
+	if err := p.create(ctx, python, env, grace); err != nil {
+		return err
+	}
+	// #nosec G306 -- the marker is saved with the rest of the cache.
+	if err := os.WriteFile(filepath.Join(entry, pipCacheComplete), []byte(string(bytes.TrimSpace(out))+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to complete pip cache entry: %w", err)
+	}
+	pruneCache(cacheDir, pipCacheKeyPrefix, key)
+	return nil
+}
+
+// create makes the virtualenv with python and installs the requirements.
+func (p *pipInstall) create(ctx context.Context, python string, env map[string]string, grace time.Duration) error {
+	log.Printf("Installing Python requirements from %s into %s", p.file, p.venv)
+	if err := runCommand(ctx, env, grace, python, "-m", "venv", "--system-site-packages", p.venv); err != nil {
+		return fmt.Errorf("failed to create virtualenv: %w", err)
+	}
+	if err := runCommand(ctx, env, grace, p.python(), "-m", "pip", "install",
+		"--disable-pip-version-check", "--no-input", "-r", p.file); err != nil {
+		return fmt.Errorf("pip install failed: %w", err)
+	}
+	return nil
+}
+
+// runCommand runs name with the wrapper's output and env added to the
+// environment. Cancelling ctx interrupts the command and, after grace, kills
+// it.
+func runCommand(ctx context.Context, env map[string]string, grace time.Duration, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	if grace > 0 {
+		cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+		cmd.WaitDelay = grace
+	}
+	return cmd.Run()
+}
+
+// python returns the interpreter of the virtualenv.
+func (p *pipInstall) python() string {
+	return filepath.Join(p.venv, "bin", "python")
+}
+
+// writeInventory writes an inventory without hosts whose host_vars set
+// ansible_python_interpreter of localhost to the virtualenv's interpreter.
+// Ansible reads the host_vars of every inventory source for every host, the
+// implicit localhost included, so adding it to the run changes nothing else;
+// remote hosts and the controller keep their interpreters.
+func (p *pipInstall) writeInventory() error {
+	dir, err := os.MkdirTemp("", "ansible-venv-inventory-")
+	if err != nil {
+		return fmt.Errorf("failed to create the virtualenv inventory: %w", err)
+	}
+	p.inventory = dir
+	hostVars := filepath.Join(dir, "host_vars")
+	if err := os.Mkdir(hostVars, 0700); err != nil {
+		return fmt.Errorf("failed to create the virtualenv inventory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "hosts"), []byte("# Hosts come from the other inventories.\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write the virtualenv inventory: %w", err)
+	}
+	vars := fmt.Sprintf("ansible_python_interpreter: %s\n", strconv.Quote(p.python()))
+	if err := os.WriteFile(filepath.Join(hostVars, "localhost.yml"), []byte(vars), 0600); err != nil {
+		return fmt.Errorf("failed to write the virtualenv inventory: %w", err)
+	}
+	return nil
+}
+
+// packages lists the packages installed into the virtualenv, without those of
+// the system site-packages and those venv installs itself.
+func (p *pipInstall) packages(ctx context.Context) ([]pythonPackage, error) {
+	out, err := exec.CommandContext(ctx, p.python(), "-m", "pip", "list",
+		"--local", "--format=json", "--disable-pip-version-check").Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not list the installed Python packages: %w", err)
+	}
+	var all []pythonPackage
+	if err := json.Unmarshal(out, &all); err != nil {
+		return nil, fmt.Errorf("could not parse the installed Python packages: %w", err)
+	}
+	var packages []pythonPackage
+	for _, pkg := range all {
+		if !pipSeedPackages[strings.ToLower(pkg.Name)] {
+			packages = append(packages, pkg)
+		}
+	}
+	return packages, nil
+}
+
+// cacheKey hashes the requirements file together with the Python version,
+// the platform and the cache directory: a virtualenv only works with the
+// interpreter it was created from and at the path it was created at.
+func (p *pipInstall) cacheKey(version, cacheDir string) (string, error) {
+	// #nosec G304 -- the requirements file is an input of the workflow.
+	data, err := os.ReadFile(p.file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read pip-requirements: %w", err)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s/%s\n%s\n\n", version, runtime.GOOS, runtime.GOARCH, cacheDir)
+	h.Write(data)
+	return pipCacheKeyPrefix + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// close removes the inventory and a virtualenv that was created for this run
+// only.
+func (p *pipInstall) close() {
+	if p.inventory != "" {
+		_ = os.RemoveAll(p.inventory)
+	}
+	if p.temp && p.venv != "" {
+		_ = os.RemoveAll(p.venv)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePython puts a python3 on PATH that logs its arguments to the returned
+// file, runs body and then mimics venv and pip: "-m venv" creates the
+// virtualenv with a copy of the script as its interpreter and "-m pip list"
+// prints netaddr next to pip.
+func fakePython(t *testing.T, body string) string {
+	t.Helper()
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "calls.log")
+	script := `#!/bin/sh
+echo "$*" >> ` + logFile + `
+` + body + `
+case "$1" in
+--version) echo "Python 3.12.3" ;;
+-m)
+	if [ "$2" = venv ]; then mkdir -p "$4/bin" && cp "$0" "$4/bin/python"; fi
+	if [ "$2" = pip ] && [ "$3" = list ]; then echo '[{"name": "pip", "version": "24.0"}, {"name": "netaddr", "version": "1.3.0"}]'; fi
+	;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(dir, "python3"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":/usr/bin:/bin")
+	return logFile
+}
+
+func TestInstallPipRequirements(t *testing.T) {
+	file := createTempFile(t, t.TempDir(), "requirements.txt", "netaddr==1.3.0\n")
+	logFile := fakePython(t, "")
+
+	p := &pipInstall{file: file}
+	report := newRunReport()
+	if err := installPipRequirements(context.Background(), p, nil, time.Second, false, report); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	calls, _ := os.ReadFile(logFile)
+	for _, want := range []string{
+		"-m venv --system-site-packages " + p.venv + "\n",
+		"-m pip install --disable-pip-version-check --no-input -r " + file + "\n",
+	} {
+		if !strings.Contains(string(calls), want) {
+			t.Errorf("expected %q in calls:\n%s", want, calls)
+		}
+	}
+	phase := report.pipRecord()
+	if want := []pythonPackage{{Name: "netaddr", Version: "1.3.0"}}; phase == nil || !reflect.DeepEqual(phase.Packages, want) {
+		t.Errorf("expected only the requested packages, got %+v", phase)
+	}
+
+	vars, err := os.ReadFile(filepath.Join(p.inventory, "host_vars", "localhost.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `ansible_python_interpreter: "` + filepath.Join(p.venv, "bin", "python") + "\"\n"; string(vars) != want {
+		t.Errorf("expected localhost to use the virtualenv's interpreter, got %q", vars)
+	}
+	if _, err := os.Stat(filepath.Join(p.inventory, "hosts")); err != nil {
+		t.Errorf("expected an inventory file without hosts: %v", err)
+	}
+
+	p.close()
+	for _, dir := range []string{p.venv, p.inventory} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", dir, err)
+		}
+	}
+}
+
+func TestInstallPipRequirements_Cache(t *testing.T) {
+	dir := t.TempDir()
+	file := createTempFile(t, dir, "requirements.txt", "boto3\n")
+	cacheDir := filepath.Join(dir, "cache")
+	stale := filepath.Join(cacheDir, pipCacheKeyPrefix+"old")
+	if err := os.MkdirAll(stale, 0755); err != nil {
+		t.Fatal(err)
+	}
+	logFile := fakePython(t, "")
+
+	// A miss builds the virtualenv in the entry and removes older entries.
+	miss := &pipInstall{file: file, cacheDir: cacheDir}
+	report := newRunReport()
+	if err := installPipRequirements(context.Background(), miss, nil, time.Second, false, report); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	phase := report.pipRecord()
+	if phase.CacheHit || !strings.HasPrefix(phase.CacheKey, pipCacheKeyPrefix) || miss.venv != filepath.Join(cacheDir, phase.CacheKey) {
+		t.Fatalf("expected a cache miss into the entry, got %+v (venv %s)", phase, miss.venv)
+	}
+	if _, err := os.Stat(filepath.Join(miss.venv, pipCacheComplete)); err != nil {
+		t.Errorf("expected a completed cache entry: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected the stale entry to be pruned, got %v", err)
+	}
+	miss.close()
+	if _, err := os.Stat(miss.venv); err != nil {
+		t.Errorf("expected the cached virtualenv to be kept: %v", err)
+	}
+
+	// A hit skips the install but still lists the packages.
+	if err := os.Remove(logFile); err != nil {
+		t.Fatal(err)
+	}
+	hit := &pipInstall{file: file, cacheDir: cacheDir}
+	defer hit.close()
+	if err := installPipRequirements(context.Background(), hit, nil, time.Second, false, report); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if phase := report.pipRecord(); !phase.CacheHit || len(phase.Packages) != 1 {
+		t.Errorf("expected a cache hit with packages, got %+v", phase)
+	}
+	if calls, _ := os.ReadFile(logFile); strings.Contains(string(calls), "install") {
+		t.Errorf("expected no install on a cache hit:\n%s", calls)
+	}
+}
+
+func TestInstallPipRequirements_Failure(t *testing.T) {
+	file := createTempFile(t, t.TempDir(), "requirements.txt", "no-such-package\n")
+	fakePython(t, `if [ "$3" = install ]; then exit 1; fi`)
+
+	p := &pipInstall{file: file}
+	defer p.close()
+	report := newRunReport()
+	err := installPipRequirements(context.Background(), p, nil, time.Second, false, report)
+	if !errors.Is(err, ErrPipFailed) || !strings.Contains(err.Error(), "pip install failed") {
+		t.Fatalf("expected a pip failure, got %v", err)
+	}
+	if phase := report.pipRecord(); phase == nil || !phase.Failed {
+		t.Errorf("expected a failed pip phase, got %+v", phase)
+	}
+}
+
+func TestPipInstall_CacheKey(t *testing.T) {
+	file := createTempFile(t, t.TempDir(), "requirements.txt", "netaddr\n")
+	p := &pipInstall{file: file}
+	key, err := p.cacheKey("Python 3.12.3", "/cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := p.cacheKey("Python 3.12.3", "/cache"); again != key {
+		t.Error("expected the same key for the same inputs")
+	}
+	if other, _ := p.cacheKey("Python 3.13.0", "/cache"); other == key {
+		t.Error("expected the Python version to change the key")
+	}
+	if other, _ := p.cacheKey("Python 3.12.3", "/elsewhere"); other == key {
+		t.Error("expected the cache directory to change the key")
+	}
+}
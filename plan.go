@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	cli "github.com/urfave/cli/v3"
+)
+
+// Run modes. In plan mode the playbooks run in check and diff mode and the
+// expected changes are written to a plan file; apply mode verifies that plan
+// file against the current inputs before running for real.
+const (
+	modeRun   = "run"
+	modePlan  = "plan"
+	modeApply = "apply"
+)
+
+// planVersion is the format version of plan files written by this wrapper.
+const planVersion = 1
+
+// planBoundFlags are the inputs besides inventories, playbooks and extra vars
+// that decide what a run does, so changing them invalidates a plan. Secrets
+// such as vault passwords and private keys are left out.
+var planBoundFlags = []string{
+	"limit", "tags", "skip-tags", "start-at-task", "module-path",
+	"user", "connection", "become", "become-method", "become-user",
+	"check", "diff", "vault-id", "vault-password-file", "config-file",
+	"forks", "strategy-plugin", "max-fail-percentage", "any-errors-fatal",
+	"force-handlers", "flush-cache", "timeout", "private-key-file",
+	"ssh-common-args", "ssh-extra-args", "sftp-extra-args", "scp-extra-args",
+	"ssh-transfer-method", "gather-subset", "gather-timeout", "fact-path",
+	"galaxy-api-server-url", "galaxy-collections-path", "galaxy-force",
+	"galaxy-force-with-deps", "galaxy-no-deps", "galaxy-pre", "galaxy-upgrade",
+	"galaxy-vendor-dir", "pip-requirements",
+}
+
+// executionPlan is the plan file written in plan mode and verified in apply
+// mode.
+type executionPlan struct {
+	Version       int                     `json:"version"`
+	CreatedAt     time.Time               `json:"created_at"`
+	GitSHA        string                  `json:"git_sha,omitempty"`
+	InputsHash    string                  `json:"inputs_hash"`
+	ExtraVarsHash string                  `json:"extra_vars_hash"`
+	Inventories   []string                `json:"inventories"`
+	Playbooks     []string                `json:"playbooks"`
+	Hosts         map[string]*plannedHost `json:"hosts"`
+}
+
+// plannedHost lists the changes check mode expects on one host.
+type plannedHost struct {
+	Changes []plannedChange `json:"changes"`
+}
+
+// plannedChange is one task check mode reported as changed, with its diff.
+type plannedChange struct {
+	Play   string `json:"play"`
+	Task   string `json:"task"`
+	Module string `json:"module,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Diff   string `json:"diff,omitempty"`
+}
+
+// planInputs is what a plan is bound to: the commit and hashes of everything
+// that decides what the playbooks do.
+type planInputs struct {
+	GitSHA        string
+	InputsHash    string
+	ExtraVarsHash string
+	Inventories   []string
+	Playbooks     []string
+}
+
+// planSummary is what the step summary shows about a plan.
+type planSummary struct {
+	Mode    string
+	File    string
+	GitSHA  string
+	Changes []taskChange
+}
+
+// collectPlanInputs hashes the inventories, playbooks, Galaxy requirements
+// and lock file, pip requirements, ansible.cfg and run-shaping inputs and,
+// separately, the extra vars so their values never end up in the plan.
+func collectPlanInputs(c *cli.Command, inventories, playbooks, extraVars []string, galaxyFile string) (planInputs, error) {
+	h := sha256.New()
+	type hashedFiles struct {
+		name  string
+		paths []string
+	}
+	files := []hashedFiles{{"inventory", inventories}, {"playbook", playbooks}}
+	if galaxyFile != "" {
+		files = append(files, hashedFiles{"galaxy-requirements", []string{galaxyFile}})
+	}
+	if pipFile := c.String("pip-requirements"); pipFile != "" {
+		files = append(files, hashedFiles{"pip-requirements", []string{pipFile}})
+	}
+	if cfg := ansibleConfigPath(c.String("config-file")); cfg != "" {
+		files = append(files, hashedFiles{"config", []string{cfg}})
+	}
+	for _, group := range files {
+		for _, p := range group.paths {
+			if err := hashPath(h, group.name, p); err != nil {
+				return planInputs{}, err
+			}
+		}
+	}
+	// The lock file may only be written by this run, so a missing one is
+	// hashed as such.
+	if galaxyFile != "" {
+		lockFile := newGalaxyInstall(c, galaxyFile).lockFile
+		if _, err := os.Stat(lockFile); err == nil {
+			if err := hashPath(h, "galaxy-lock", lockFile); err != nil {
+				return planInputs{}, err
+			}
+		} else {
+			fmt.Fprintf(h, "galaxy-lock\x00%s\x00missing\x00", filepath.ToSlash(lockFile))
+		}
+	}
+	for _, name := range planBoundFlags {
+		fmt.Fprintf(h, "flag\x00%s\x00%v\x00", name, c.Value(name))
+	}
+
+	ev := sha256.New()
+	for _, v := range extraVars {
+		fmt.Fprintf(ev, "%s\x00", v)
+		// "@file" references are hashed by content, like inventories.
+		if path, ok := strings.CutPrefix(v, "@"); ok {
+			if err := hashPath(ev, "extra-vars", path); err != nil {
+				return planInputs{}, err
+			}
+		}
+	}
+
+	return planInputs{
+		GitSHA:        currentGitSHA(),
+		InputsHash:    "sha256:" + hex.EncodeToString(h.Sum(nil)),
+		ExtraVarsHash: "sha256:" + hex.EncodeToString(ev.Sum(nil)),
+		Inventories:   inventories,
+		Playbooks:     playbooks,
+	}, nil
+}
+
+// hashPath feeds the name and content of a file, or of every file below a
+// directory in lexical order, into h.
+func hashPath(h hash.Hash, kind, path string) error {
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to hash %s %s: %w", kind, p, err)
+		}
+		if d.IsDir() {
+			return nil
+		}
+		// #nosec G304 -- p lies below a configured inventory, playbook or
+		// extra-vars file.
+		f, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s %s: %w", kind, p, err)
+		}
+		defer func() { _ = f.Close() }()
+		fmt.Fprintf(h, "%s\x00%s\x00", kind, filepath.ToSlash(p))
+		if _, err := io.Copy(h, f); err != nil {
+			return fmt.Errorf("failed to hash %s %s: %w", kind, p, err)
+		}
+		_, _ = h.Write([]byte{0})
+		return nil
+	})
+}
+
+// currentGitSHA returns the commit being run: $GITHUB_SHA on Actions runners,
+// otherwise HEAD of the repository in the working directory, or "" outside a
+// repository.
+func currentGitSHA() string {
+	if sha := os.Getenv("GITHUB_SHA"); sha != "" {
+		return sha
+	}
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newExecutionPlan builds a plan from a check-mode run: every host in the
+// recap, each with the tasks that reported a change and their diffs.
+func newExecutionPlan(inputs planInputs, report *runReport) *executionPlan {
+	plan := &executionPlan{
+		Version:       planVersion,
+		CreatedAt:     time.Now().UTC(),
+		GitSHA:        inputs.GitSHA,
+		InputsHash:    inputs.InputsHash,
+		ExtraVarsHash: inputs.ExtraVarsHash,
+		Inventories:   inputs.Inventories,
+		Playbooks:     inputs.Playbooks,
+		Hosts:         make(map[string]*plannedHost),
+	}
+	for _, host := range report.hosts() {
+		plan.Hosts[host] = &plannedHost{Changes: []plannedChange{}}
+	}
+	for _, r := range report.taskResults() {
+		if r.Status != "changed" {
+			continue
+		}
+		ph, ok := plan.Hosts[r.Host]
+		if !ok {
+			ph = &plannedHost{}
+			plan.Hosts[r.Host] = ph
+		}
+		ph.Changes = append(ph.Changes, plannedChange{Play: r.Play, Task: r.Task, Module: r.Module, Path: r.Path, Diff: r.Diff})
+	}
+	return plan
+}
+
+// changes flattens the plan into one taskChange per planned change, ordered
+// by host.
+func (p *executionPlan) changes() []taskChange {
+	hosts := make([]string, 0, len(p.Hosts))
+	for host := range p.Hosts {
+		hosts = append(hosts, host)
+	}
+	slices.Sort(hosts)
+	changes := []taskChange{}
+	for _, host := range hosts {
+		for _, ch := range p.Hosts[host].Changes {
+			changes = append(changes, taskChange{Host: host, Play: ch.Play, Task: ch.Task, Path: ch.Path})
+		}
+	}
+	return changes
+}
+
+// writePlanFile writes plan as indented JSON to path.
+func writePlanFile(path string, plan *executionPlan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode plan: %w", err)
+	}
+	if err := writeArtifactFile(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("could not write plan file: %w", err)
+	}
+	log.Printf("Plan written to %s", path)
+	return nil
+}
+
+// readPlanFile loads a plan file written in plan mode.
+func readPlanFile(path string) (*executionPlan, error) {
+	// #nosec G304 -- path is the configured plan-file input.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not read plan file: %v", ErrInvalidParameter, err)
+	}
+	var plan executionPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("%w: plan file %s is not valid JSON: %v", ErrInvalidParameter, path, err)
+	}
+	if plan.Version != planVersion {
+		return nil, fmt.Errorf("%w: plan file %s has unsupported version %d", ErrInvalidParameter, path, plan.Version)
+	}
+	return &plan, nil
+}
+
+// verifyPlan checks that plan was made from the same commit and inputs as the
+// current run, and lists every difference if not.
+func verifyPlan(plan *executionPlan, current planInputs) error {
+	var mismatches []string
+	if plan.GitSHA != current.GitSHA {
+		mismatches = append(mismatches, fmt.Sprintf("commit %s, now %s", shortSHA(plan.GitSHA), shortSHA(current.GitSHA)))
+	}
+	if !slices.Equal(plan.Inventories, current.Inventories) {
+		mismatches = append(mismatches, fmt.Sprintf("inventories %v, now %v", plan.Inventories, current.Inventories))
+	}
+	if !slices.Equal(plan.Playbooks, current.Playbooks) {
+		mismatches = append(mismatches, fmt.Sprintf("playbooks %v, now %v", plan.Playbooks, current.Playbooks))
+	}
+	if plan.InputsHash != current.InputsHash {
+		mismatches = append(mismatches, "inventory, playbook or option contents changed")
+	}
+	if plan.ExtraVarsHash != current.ExtraVarsHash {
+		mismatches = append(mismatches, "extra vars changed")
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%w: planned with %s", ErrPlanMismatch, strings.Join(mismatches, "; "))
+	}
+	return nil
+}
+
+// shortSHA abbreviates a commit SHA for messages.
+func shortSHA(sha string) string {
+	if sha == "" {
+		return "(unknown)"
+	}
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cli "github.com/urfave/cli/v3"
+)
+
+// planInputsFor collects plan inputs as run() would for the given arguments.
+func planInputsFor(t *testing.T, inventories, playbooks, extraVars []string, args ...string) planInputs {
+	t.Helper()
+	return planInputsWithGalaxy(t, inventories, playbooks, extraVars, "", args...)
+}
+
+// planInputsWithGalaxy is planInputsFor with a Galaxy requirements file.
+func planInputsWithGalaxy(t *testing.T, inventories, playbooks, extraVars []string, galaxyFile string, args ...string) planInputs {
+	t.Helper()
+	var inputs planInputs
+	cmd := newTestCommand(func(ctx context.Context, c *cli.Command) error {
+		var err error
+		inputs, err = collectPlanInputs(c, inventories, playbooks, extraVars, galaxyFile)
+		return err
+	})
+	if err := cmd.Run(context.Background(), append([]string{"test"}, args...)); err != nil {
+		t.Fatalf("collectPlanInputs: %v", err)
+	}
+	return inputs
+}
+
+func TestCollectPlanInputs(t *testing.T) {
+	t.Setenv("GITHUB_SHA", "0123456789abcdef")
+	dir := t.TempDir()
+	pb := createTempFile(t, dir, "site.yml", "---\n- hosts: all\n")
+	invDir := filepath.Join(dir, "inventory")
+	if err := os.Mkdir(invDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	createTempFile(t, invDir, "hosts.yml", "all:\n  hosts:\n    web1:\n")
+	vars := createTempFile(t, dir, "vars.yml", "version: 1\n")
+	extraVars := []string{"env=prod", "@" + vars}
+
+	base := planInputsFor(t, []string{invDir}, []string{pb}, extraVars)
+	if base.GitSHA != "0123456789abcdef" || !strings.HasPrefix(base.InputsHash, "sha256:") || !strings.HasPrefix(base.ExtraVarsHash, "sha256:") {
+		t.Fatalf("unexpected plan inputs: %+v", base)
+	}
+	if again := planInputsFor(t, []string{invDir}, []string{pb}, extraVars); again.InputsHash != base.InputsHash || again.ExtraVarsHash != base.ExtraVarsHash {
+		t.Errorf("expected stable hashes, got %+v and %+v", base, again)
+	}
+
+	if got := planInputsFor(t, []string{invDir}, []string{pb}, extraVars, "--limit", "web1"); got.InputsHash == base.InputsHash {
+		t.Error("expected a different limit to change the inputs hash")
+	}
+
+	createTempFile(t, invDir, "group_vars.yml", "x: 1\n")
+	if got := planInputsFor(t, []string{invDir}, []string{pb}, extraVars); got.InputsHash == base.InputsHash || got.ExtraVarsHash != base.ExtraVarsHash {
+		t.Errorf("expected only the inputs hash to change with the inventory, got %+v", got)
+	}
+
+	createTempFile(t, dir, "vars.yml", "version: 2\n")
+	if got := planInputsFor(t, []string{invDir}, []string{pb}, extraVars); got.ExtraVarsHash == base.ExtraVarsHash {
+		t.Error("expected an extra-vars file change to change the extra vars hash")
+	}
+}
+
+func TestCollectPlanInputs_BoundInputs(t *testing.T) {
+	t.Setenv("GITHUB_SHA", "0123456789abcdef")
+	t.Setenv("ANSIBLE_CONFIG", "")
+	dir := t.TempDir()
+	pb := createTempFile(t, dir, "site.yml", "---\n- hosts: all\n")
+	inv := createTempFile(t, dir, "hosts.yml", "all:\n  hosts:\n    web1:\n")
+	requirements := createTempFile(t, dir, "requirements.yml", "collections:\n  - community.general\n")
+	cfg := createTempFile(t, dir, "ansible.cfg", "[defaults]\nforks = 5\n")
+	inputs := func(args ...string) string {
+		return planInputsWithGalaxy(t, []string{inv}, []string{pb}, nil, requirements, append([]string{"--config-file", cfg}, args...)...).InputsHash
+	}
+	base := inputs()
+
+	for _, args := range [][]string{
+		{"--check"},
+		{"--diff"},
+		{"--vault-id", "prod@vault.txt"},
+		{"--tags", "deploy"},
+		{"--skip-tags", "slow"},
+		{"--forks", "20"},
+		{"--galaxy-upgrade"},
+	} {
+		if got := inputs(args...); got == base {
+			t.Errorf("expected %v to change the inputs hash", args)
+		}
+	}
+
+	createTempFile(t, dir, "requirements.yml", "collections:\n  - ansible.posix\n")
+	changed := inputs()
+	if changed == base {
+		t.Error("expected a requirements file change to change the inputs hash")
+	}
+	createTempFile(t, dir, "requirements.lock.yml", "collections: []\n")
+	locked := inputs()
+	if locked == changed {
+		t.Error("expected a lock file to change the inputs hash")
+	}
+	createTempFile(t, dir, "requirements.lock.yml", "collections:\n  - name: ansible.posix\n")
+	relocked := inputs()
+	if relocked == locked {
+		t.Error("expected a lock file change to change the inputs hash")
+	}
+	createTempFile(t, dir, "ansible.cfg", "[defaults]\nforks = 50\n")
+	if got := inputs(); got == relocked {
+		t.Error("expected an ansible.cfg change to change the inputs hash")
+	}
+}
+
+func TestNewExecutionPlan(t *testing.T) {
+	report := newRunReport()
+	report.setStreaming()
+	report.recordStats("web1", hostStats{Ok: 2, Changed: 1})
+	report.recordStats("db1", hostStats{Ok: 1})
+	report.recordResult(taskResult{Host: "web1", Play: "Web", Task: "Render config", Module: "template", Path: "site.yml:4", Status: "changed", Diff: "-a\n+b\n"})
+	report.recordResult(taskResult{Host: "web1", Play: "Web", Task: "Ping", Status: "ok"})
+
+	plan := newExecutionPlan(planInputs{GitSHA: "abc", InputsHash: "sha256:1", ExtraVarsHash: "sha256:2"}, report)
+	if plan.Version != planVersion || plan.GitSHA != "abc" || len(plan.Hosts) != 2 {
+		t.Fatalf("unexpected plan: %+v", plan)
+	}
+	if got := plan.Hosts["db1"].Changes; got == nil || len(got) != 0 {
+		t.Errorf("expected an empty change list for db1, got %#v", got)
+	}
+	want := plannedChange{Play: "Web", Task: "Render config", Module: "template", Path: "site.yml:4", Diff: "-a\n+b\n"}
+	if got := plan.Hosts["web1"].Changes; len(got) != 1 || got[0] != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if got := plan.changes(); len(got) != 1 || got[0] != (taskChange{Host: "web1", Play: "Web", Task: "Render config", Path: "site.yml:4"}) {
+		t.Errorf("unexpected flattened changes: %+v", got)
+	}
+}
+
+func TestPlanFile_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plans", "plan.json")
+	inputs := planInputs{GitSHA: "abc", InputsHash: "sha256:1", ExtraVarsHash: "sha256:2", Inventories: []string{"hosts.yml"}, Playbooks: []string{"site.yml"}}
+	if err := writePlanFile(path, newExecutionPlan(inputs, newRunReport())); err != nil {
+		t.Fatalf("writePlanFile: %v", err)
+	}
+	plan, err := readPlanFile(path)
+	if err != nil {
+		t.Fatalf("readPlanFile: %v", err)
+	}
+	if err := verifyPlan(plan, inputs); err != nil {
+		t.Errorf("expected the plan to verify against its own inputs, got %v", err)
+	}
+}
+
+func TestReadPlanFile_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"garbage.json": "not json",
+		"future.json":  `{"version": 99}`,
+	} {
+		if _, err := readPlanFile(createTempFile(t, dir, name, content)); !errors.Is(err, ErrInvalidParameter) {
+			t.Errorf("%s: expected ErrInvalidParameter, got %v", name, err)
+		}
+	}
+	if _, err := readPlanFile(filepath.Join(dir, "missing.json")); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("expected ErrInvalidParameter for a missing plan, got %v", err)
+	}
+}
+
+func TestVerifyPlan_Mismatch(t *testing.T) {
+	plan := &executionPlan{Version: planVersion, GitSHA: "0123456789abcdef0123", InputsHash: "sha256:1", ExtraVarsHash: "sha256:2", Inventories: []string{"hosts.yml"}, Playbooks: []string{"site.yml"}}
+	current := planInputs{GitSHA: "fedcba9876543210fedc", InputsHash: "sha256:x", ExtraVarsHash: "sha256:y", Inventories: []string{"hosts.yml"}, Playbooks: []string{"deploy.yml"}}
+
+	err := verifyPlan(plan, current)
+	if !errors.Is(err, ErrPlanMismatch) {
+		t.Fatalf("expected ErrPlanMismatch, got %v", err)
+	}
+	for _, want := range []string{"commit 0123456789ab, now fedcba987654", "playbooks [site.yml], now [deploy.yml]", "option contents changed", "extra vars changed"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "inventories") {
+		t.Errorf("expected matching inventories not to be reported, got %q", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// licenseFileEntry prefixes the galaxy-allowed-licenses entry that allows a
+// collection declaring its license only in a license_file.
+const licenseFileEntry = "license_file:"
+
+// checkPolicy fails if an installed collection or role, including transitive
+// dependencies, is from a namespace outside galaxy-allowed-namespaces or
+// declares a license outside galaxy-allowed-licenses.
+func (g *galaxyInstall) checkPolicy() error {
+	if len(g.allowedNamespaces) == 0 && len(g.allowedLicenses) == 0 {
+		return nil
+	}
+	packages, err := g.installedContent()
+	if err != nil {
+		return err
+	}
+	if violations := policyViolations(packages, g.allowedNamespaces, g.allowedLicenses); len(violations) > 0 {
+		return fmt.Errorf("installed Galaxy content violates the allow-list policy: %s", joinLimited(violations, maxLockDifferences))
+	}
+	log.Printf("Installed Galaxy content (%d collection(s) and role(s)) passes the allow-list policy", len(packages))
+	return nil
+}
+
+// policyViolations lists every package whose namespace is not in namespaces,
+// or with a license not in licenses. An empty list allows anything. Every
+// license a package declares must be allowed, and a package without a
+// namespace or license fails the respective check. A collection that declares
+// its license only in a license_file must be allowed by name, as
+// "license_file:namespace.name", since the file can hold any license.
+// Licenses are compared case-insensitively.
+func policyViolations(packages []installedPackage, namespaces, licenses []string) []string {
+	var violations []string
+	for _, p := range packages {
+		kind := strings.TrimSuffix(p.Kind, "s")
+		if len(namespaces) > 0 {
+			switch ns := packageNamespace(p); {
+			case ns == "":
+				violations = append(violations, fmt.Sprintf("%s %s has no namespace", kind, p.Name))
+			case !slices.Contains(namespaces, ns):
+				violations = append(violations, fmt.Sprintf("%s %s is from namespace %q, which is not allowed", kind, p.Name, ns))
+			}
+		}
+		if len(licenses) > 0 {
+			declared := packageLicenses(p)
+			if len(declared) == 0 {
+				file := packageLicenseFile(p)
+				switch {
+				case file == "":
+					violations = append(violations, fmt.Sprintf("%s %s declares no license", kind, p.Name))
+				case !slices.ContainsFunc(licenses, func(allowed string) bool { return strings.EqualFold(allowed, licenseFileEntry+p.Name) }):
+					violations = append(violations, fmt.Sprintf("%s %s declares its license only in %s; allow it with %q", kind, p.Name, file, licenseFileEntry+p.Name))
+				}
+			}
+			for _, l := range declared {
+				if !slices.ContainsFunc(licenses, func(allowed string) bool { return strings.EqualFold(allowed, l) }) {
+					violations = append(violations, fmt.Sprintf("%s %s has license %q, which is not allowed", kind, p.Name, l))
+				}
+			}
+		}
+	}
+	return violations
+}
+
+// packageNamespace returns the namespace of a collection, or of a role named
+// namespace.role. Other roles, e.g. from Git, fall back to the namespace in
+// their meta/main.yml.
+func packageNamespace(p installedPackage) string {
+	if ns, _, ok := strings.Cut(p.Name, "."); ok {
+		return ns
+	}
+	if p.Kind == galaxyLockRoles {
+		if ns := readYAMLList(filepath.Join(p.Dir, "meta", "main.yml"), "namespace"); len(ns) == 1 {
+			return ns[0]
+		}
+	}
+	return ""
+}
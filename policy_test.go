@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPolicyViolations(t *testing.T) {
+	root := t.TempDir()
+	installFakeContent(t, root,
+		map[string]string{"community.general": "8.6.0", "acme.tools": "1.0.0"},
+		map[string]string{"geerlingguy.docker": "7.1.0", "nginx": "1.0.0"})
+	collections := filepath.Join(root, "collections", "ansible_collections")
+	writePackageFile(t, filepath.Join(collections, "community", "general"), "MANIFEST.json",
+		`{"collection_info": {"namespace": "community", "name": "general", "version": "8.6.0", "license": ["GPL-3.0-or-later"]}}`)
+	writePackageFile(t, filepath.Join(collections, "acme", "tools"), "MANIFEST.json",
+		`{"collection_info": {"namespace": "acme", "name": "tools", "version": "1.0.0", "license": ["mit", "Proprietary"]}}`)
+	writePackageFile(t, filepath.Join(root, "roles", "geerlingguy.docker", "meta"), "main.yml", "galaxy_info:\n  license: MIT\n")
+	writePackageFile(t, filepath.Join(root, "roles", "nginx", "meta"), "main.yml", "galaxy_info:\n  namespace: acme\n")
+
+	packages, err := installedPackages(filepath.Join(root, "collections"), filepath.Join(root, "roles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := policyViolations(packages, []string{"community", "geerlingguy"}, []string{"GPL-3.0-or-later", "MIT"})
+	want := []string{
+		`collection acme.tools is from namespace "acme", which is not allowed`,
+		`collection acme.tools has license "Proprietary", which is not allowed`,
+		`role nginx is from namespace "acme", which is not allowed`,
+		`role nginx declares no license`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected violations:\n got %q\nwant %q", got, want)
+	}
+	if got := policyViolations(packages, nil, nil); len(got) != 0 {
+		t.Errorf("expected empty lists to allow anything, got %q", got)
+	}
+}
+
+func TestPolicyViolations_LicenseFile(t *testing.T) {
+	root := t.TempDir()
+	installFakeContent(t, root, map[string]string{"acme.tools": "1.0.0", "acme.docs": "2.0.0"}, nil)
+	collections := filepath.Join(root, "collections", "ansible_collections")
+	writePackageFile(t, filepath.Join(collections, "acme", "tools"), "MANIFEST.json",
+		`{"collection_info": {"namespace": "acme", "name": "tools", "version": "1.0.0", "license": [], "license_file": "LICENSE"}}`)
+	writePackageFile(t, filepath.Join(collections, "acme", "docs"), "MANIFEST.json",
+		`{"collection_info": {"namespace": "acme", "name": "docs", "version": "2.0.0", "license": [], "license_file": "COPYING"}}`)
+
+	packages, err := installedPackages(filepath.Join(root, "collections"), filepath.Join(root, "roles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := policyViolations(packages, nil, []string{"MIT", "License_File:acme.tools"})
+	want := []string{`collection acme.docs declares its license only in COPYING; allow it with "license_file:acme.docs"`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected violations:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestPackageNamespace(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		p    installedPackage
+		want string
+	}{
+		{installedPackage{lockedContent: lockedContent{Kind: galaxyLockCollections, Name: "community.general"}}, "community"},
+		{installedPackage{lockedContent: lockedContent{Kind: galaxyLockRoles, Name: "geerlingguy.docker"}}, "geerlingguy"},
+		{installedPackage{lockedContent: lockedContent{Kind: galaxyLockRoles, Name: "docker"}, Dir: dir}, ""},
+	} {
+		if got := packageNamespace(tt.p); got != tt.want {
+			t.Errorf("packageNamespace(%s) = %q, want %q", tt.p.Name, got, tt.want)
+		}
+	}
+}
+
+func TestInstallGalaxyRequirements_PolicyViolation(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "requirements.yml")
+	if err := os.WriteFile(file, []byte("collections:\n  - acme.tools\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fakeGalaxy(t, "")
+	installFakeContent(t, dir, map[string]string{"acme.tools": "1.0.0"}, nil)
+
+	g := &galaxyInstall{
+		file:              file,
+		collectionsPath:   filepath.Join(dir, "collections"),
+		rolesPath:         filepath.Join(dir, "roles"),
+		lock:              true,
+		lockFile:          defaultLockFile(file),
+		allowedNamespaces: []string{"community"},
+	}
+	report := newRunReport()
+	err := installGalaxyRequirements(context.Background(), g, retryPolicy{}, nil, 0, false, report)
+	if !errors.Is(err, ErrGalaxyFailed) || !strings.Contains(err.Error(), `collection acme.tools is from namespace "acme"`) {
+		t.Fatalf("expected a policy violation, got %v", err)
+	}
+	if phase := report.galaxyRecord(); phase == nil || !phase.Failed {
+		t.Errorf("expected a failed Galaxy phase, got %+v", phase)
+	}
+	if _, err := os.Stat(g.lockFile); !os.IsNotExist(err) {
+		t.Errorf("expected no lock file for content that violates the policy, got %v", err)
+	}
+}
+
+func TestCheckPolicy_ConfigInstallPath(t *testing.T) {
+	dir := t.TempDir()
+	file := createTempFile(t, dir, "requirements.yml", "collections:\n  - acme.tools\n")
+	cfg := createTempFile(t, dir, "ansible.cfg", "[defaults]\ncollections_path = ./vendor/collections\nroles_path = ./vendor/roles\n")
+	t.Setenv("ANSIBLE_COLLECTIONS_PATH", "")
+	t.Setenv("ANSIBLE_ROLES_PATH", "")
+
+	// Content installed to the ansible.cfg path is found and checked.
+	g := &galaxyInstall{file: file, configFile: cfg, allowedNamespaces: []string{"community"}}
+	installFakeContent(t, filepath.Join(dir, "vendor"), map[string]string{"acme.tools": "1.0.0"}, nil)
+	if err := g.checkPolicy(); err == nil || !strings.Contains(err.Error(), `collection acme.tools is from namespace "acme"`) {
+		t.Errorf("expected the content in the ansible.cfg path to be checked, got %v", err)
+	}
+
+	// Nothing installed for a requirements file that lists content fails
+	// instead of passing unchecked.
+	empty := &galaxyInstall{file: file, collectionsPath: filepath.Join(dir, "nowhere"), rolesPath: filepath.Join(dir, "nowhere"), allowedNamespaces: []string{"acme"}}
+	if err := empty.checkPolicy(); err == nil || !strings.Contains(err.Error(), "no installed Galaxy content found") {
+		t.Errorf("expected missing content to fail the policy check, got %v", err)
+	}
+}
@@ -0,0 +1,897 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outputTailLines is the number of trailing output lines kept for the step
+// summary.
+const outputTailLines = 40
+
+// hostStats holds the PLAY RECAP counters Ansible reports for a single host.
+type hostStats struct {
+	Ok          int `json:"ok"`
+	Changed     int `json:"changed"`
+	Unreachable int `json:"unreachable"`
+	Failed      int `json:"failed"`
+	Skipped     int `json:"skipped"`
+	Rescued     int `json:"rescued"`
+	Ignored     int `json:"ignored"`
+}
+
+// add accumulates the counters of o into s.
+func (s *hostStats) add(o hostStats) {
+	s.Ok += o.Ok
+	s.Changed += o.Changed
+	s.Unreachable += o.Unreachable
+	s.Failed += o.Failed
+	s.Skipped += o.Skipped
+	s.Rescued += o.Rescued
+	s.Ignored += o.Ignored
+}
+
+// taskFailure describes a single failed task result on one host.
+type taskFailure struct {
+	Host   string
+	Play   string
+	Task   string
+	Module string
+	Path   string
+	Item   string
+	Msg    string
+}
+
+// Kinds of diagnostics Ansible prints outside of task results.
+const (
+	diagnosticError       = "error"
+	diagnosticWarning     = "warning"
+	diagnosticDeprecation = "deprecation"
+	// diagnosticRequirements is a problem the wrapper found in the Galaxy
+	// requirements file before installing it.
+	diagnosticRequirements = "requirements"
+)
+
+// diagnostic is an error, warning or deprecation warning printed by Ansible
+// itself, e.g. a syntax error or "[WARNING]: ...". File and Line are set when
+// Ansible names the offending location.
+type diagnostic struct {
+	Kind  string
+	Msg   string
+	File  string
+	Line  int
+	Col   int
+	Count int
+}
+
+// taskResult is the outcome of one task on one host, as reported by the
+// embedded event stream. Diff holds the unified diff Ansible rendered for the
+// result when diff mode is on, and Files the same diff split by file.
+type taskResult struct {
+	Host     string
+	Play     string
+	Task     string
+	Module   string
+	Path     string
+	Status   string
+	Msg      string
+	Diff     string
+	Files    []fileDiff
+	Duration time.Duration
+}
+
+// fileDiff is the part of a task's diff that belongs to one file. Path is
+// empty for diffs Ansible reports without a file, e.g. of a package list.
+type fileDiff struct {
+	Path string `json:"path"`
+	Diff string `json:"diff"`
+}
+
+// taskChange is a task that reported a change on one host where none was
+// expected, e.g. on an idempotence check's second run. Play, Task and Path are
+// empty when the event stream was unavailable and only the recap is known.
+type taskChange struct {
+	Host string `json:"host"`
+	Play string `json:"play,omitempty"`
+	Task string `json:"task,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+// taskTiming records how long a task took across all hosts.
+type taskTiming struct {
+	Play     string
+	Task     string
+	Duration time.Duration
+}
+
+// attemptRecord describes one attempt of the playbook run. Class is the
+// failure class the retry policy saw, or "" for a success or an unclassified
+// failure.
+type attemptRecord struct {
+	ExitCode int
+	Class    string
+	Duration time.Duration
+}
+
+// runReport collects what the wrapper learns about a playbook run while it
+// executes, either from the embedded event stream or — when that is not
+// available — from the default callback's stdout. It is safe for concurrent
+// use because stdout, stderr and the event stream are consumed from separate
+// goroutines.
+type runReport struct {
+	mu          sync.Mutex
+	streaming   bool
+	stats       map[string]*hostStats
+	results     []taskResult
+	failures    []taskFailure
+	unreachable map[string]string
+	timings     []taskTiming
+	diagnostics []diagnostic
+	tail        []string
+
+	idempotenceChecked bool
+	idempotenceChanges []taskChange
+	driftChecked       bool
+	driftChanges       []taskChange
+	plan               *planSummary
+	diffMarkdown       string
+	custom             map[string]map[string]json.RawMessage
+	facts              map[string]map[string]any
+
+	// attempts, galaxy and pip span all attempts and are therefore not
+	// cleared by reset.
+	attempts []attemptRecord
+	galaxy   *galaxyPhase
+	pip      *pipPhase
+}
+
+// newRunReport returns an empty runReport.
+func newRunReport() *runReport {
+	r := &runReport{}
+	r.reset()
+	return r
+}
+
+// reset discards everything recorded so far. It is called before every
+// attempt so that a retried run reports only the outcome of its last attempt.
+func (r *runReport) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.streaming = false
+	r.stats = make(map[string]*hostStats)
+	r.results = nil
+	r.failures = nil
+	r.unreachable = make(map[string]string)
+	r.timings = nil
+	r.diagnostics = nil
+	r.tail = nil
+	r.idempotenceChecked = false
+	r.idempotenceChanges = nil
+	r.driftChecked = false
+	r.driftChanges = nil
+	r.plan = nil
+	r.diffMarkdown = ""
+	r.custom = make(map[string]map[string]json.RawMessage)
+	r.facts = nil
+}
+
+// forgetHosts discards what was recorded about hosts before a retry that is
+// limited to them, so the report shows their new outcome next to the results
+// of the other hosts from earlier attempts. Timings, diagnostics and the
+// output tail always describe the last attempt.
+func (r *runReport) forgetHosts(hosts []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	forget := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		forget[host] = true
+		delete(r.stats, host)
+		delete(r.unreachable, host)
+	}
+	r.results = slices.DeleteFunc(r.results, func(res taskResult) bool { return forget[res.Host] })
+	r.failures = slices.DeleteFunc(r.failures, func(f taskFailure) bool { return forget[f.Host] })
+	r.timings = nil
+	r.diagnostics = nil
+	r.tail = nil
+}
+
+// snapshot returns a copy of everything recorded so far, which restore can
+// put back after another pass of the playbooks.
+func (r *runReport) snapshot() *runReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := &runReport{
+		streaming:          r.streaming,
+		stats:              make(map[string]*hostStats, len(r.stats)),
+		results:            append([]taskResult(nil), r.results...),
+		failures:           append([]taskFailure(nil), r.failures...),
+		unreachable:        make(map[string]string, len(r.unreachable)),
+		timings:            append([]taskTiming(nil), r.timings...),
+		diagnostics:        append([]diagnostic(nil), r.diagnostics...),
+		tail:               append([]string(nil), r.tail...),
+		idempotenceChecked: r.idempotenceChecked,
+		idempotenceChanges: append([]taskChange(nil), r.idempotenceChanges...),
+		driftChecked:       r.driftChecked,
+		driftChanges:       append([]taskChange(nil), r.driftChanges...),
+		plan:               r.plan,
+		diffMarkdown:       r.diffMarkdown,
+		custom:             copyCustomStats(r.custom),
+		facts:              r.facts,
+		attempts:           append([]attemptRecord(nil), r.attempts...),
+		galaxy:             r.galaxy,
+		pip:                r.pip,
+	}
+	for host, hs := range r.stats {
+		cp := *hs
+		c.stats[host] = &cp
+	}
+	for host, msg := range r.unreachable {
+		c.unreachable[host] = msg
+	}
+	return c
+}
+
+// restore replaces the recorded data with a snapshot taken earlier.
+func (r *runReport) restore(s *runReport) {
+	c := s.snapshot()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.streaming = c.streaming
+	r.stats = c.stats
+	r.results = c.results
+	r.failures = c.failures
+	r.unreachable = c.unreachable
+	r.timings = c.timings
+	r.diagnostics = c.diagnostics
+	r.tail = c.tail
+	r.idempotenceChecked = c.idempotenceChecked
+	r.idempotenceChanges = c.idempotenceChanges
+	r.driftChecked = c.driftChecked
+	r.driftChanges = c.driftChanges
+	r.plan = c.plan
+	r.diffMarkdown = c.diffMarkdown
+	r.custom = c.custom
+	r.facts = c.facts
+	r.attempts = c.attempts
+	r.galaxy = c.galaxy
+	r.pip = c.pip
+}
+
+// setStreaming marks the current attempt as covered by the event stream, which
+// from then on takes precedence over parsing stdout.
+func (r *runReport) setStreaming() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.streaming = true
+}
+
+// isStreaming reports whether the current attempt is covered by the event
+// stream.
+func (r *runReport) isStreaming() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.streaming
+}
+
+// recordResult appends a per-host task result.
+func (r *runReport) recordResult(res taskResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results = append(r.results, res)
+}
+
+// taskResults returns a copy of the per-host task results in arrival order.
+func (r *runReport) taskResults() []taskResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]taskResult(nil), r.results...)
+}
+
+// recordStats adds the recap counters for host. Counters for the same host are
+// summed, so recaps of several playbooks in one attempt add up.
+func (r *runReport) recordStats(host string, s hostStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hs, ok := r.stats[host]
+	if !ok {
+		hs = &hostStats{}
+		r.stats[host] = hs
+	}
+	hs.add(s)
+}
+
+// recordFailure appends a failed task result.
+func (r *runReport) recordFailure(f taskFailure) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = append(r.failures, f)
+}
+
+// ignoreLastFailure drops the most recent failure, for results Ansible reports
+// as "...ignoring" because of ignore_errors.
+func (r *runReport) ignoreLastFailure() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n := len(r.failures); n > 0 {
+		r.failures = r.failures[:n-1]
+	}
+}
+
+// recordUnreachable records the connection error reported for host.
+func (r *runReport) recordUnreachable(host, msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unreachable[host] = msg
+}
+
+// recordTiming appends the duration of a finished task.
+func (r *runReport) recordTiming(t taskTiming) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timings = append(r.timings, t)
+}
+
+// recordDiagnostic records an Ansible error or warning. Identical warnings are
+// counted instead of repeated; errors are always kept.
+func (r *runReport) recordDiagnostic(d diagnostic) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d.Kind == diagnosticWarning || d.Kind == diagnosticDeprecation {
+		for i := range r.diagnostics {
+			if r.diagnostics[i].Kind == d.Kind && r.diagnostics[i].Msg == d.Msg {
+				r.diagnostics[i].Count++
+				return
+			}
+		}
+	}
+	d.Count = 1
+	r.diagnostics = append(r.diagnostics, d)
+}
+
+// locateLastError attaches a file location to the most recent error, for
+// messages where Ansible prints the location after the error text.
+func (r *runReport) locateLastError(file string, line, col int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.diagnostics) - 1; i >= 0; i-- {
+		if r.diagnostics[i].Kind == diagnosticError {
+			if r.diagnostics[i].File == "" {
+				r.diagnostics[i].File, r.diagnostics[i].Line, r.diagnostics[i].Col = file, line, col
+			}
+			return
+		}
+	}
+}
+
+// diagnosticsOf returns copies of the recorded diagnostics of the given kinds,
+// in the order they were first seen.
+func (r *runReport) diagnosticsOf(kinds ...string) []diagnostic {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []diagnostic
+	for _, d := range r.diagnostics {
+		for _, k := range kinds {
+			if d.Kind == k {
+				out = append(out, d)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// appendTail keeps line in the bounded buffer of trailing output lines.
+func (r *runReport) appendTail(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tail = append(r.tail, line)
+	if len(r.tail) > outputTailLines {
+		r.tail = r.tail[len(r.tail)-outputTailLines:]
+	}
+}
+
+// failedTasks returns a copy of the recorded task failures in output order.
+func (r *runReport) failedTasks() []taskFailure {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]taskFailure(nil), r.failures...)
+}
+
+// unreachableErrors returns a copy of the host → connection error map.
+func (r *runReport) unreachableErrors() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string]string, len(r.unreachable))
+	for host, msg := range r.unreachable {
+		out[host] = msg
+	}
+	return out
+}
+
+// slowestTasks returns up to n task timings, longest first.
+func (r *runReport) slowestTasks(n int) []taskTiming {
+	r.mu.Lock()
+	timings := append([]taskTiming(nil), r.timings...)
+	r.mu.Unlock()
+	sort.SliceStable(timings, func(i, j int) bool { return timings[i].Duration > timings[j].Duration })
+	if len(timings) > n {
+		timings = timings[:n]
+	}
+	return timings
+}
+
+// outputTail returns a copy of the trailing output lines.
+func (r *runReport) outputTail() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.tail...)
+}
+
+// hostStats returns a copy of the per-host counters.
+func (r *runReport) hostStats() map[string]hostStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string]hostStats, len(r.stats))
+	for host, s := range r.stats {
+		out[host] = *s
+	}
+	return out
+}
+
+// hosts returns the names of all hosts in the recap, sorted.
+func (r *runReport) hosts() []string {
+	return r.hostsWhere(func(hostStats) bool { return true })
+}
+
+// hostsWhere returns the sorted names of the hosts whose counters match keep.
+func (r *runReport) hostsWhere(keep func(hostStats) bool) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hosts := []string{}
+	for host, s := range r.stats {
+		if keep(*s) {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// changedHosts returns the hosts with at least one changed task.
+func (r *runReport) changedHosts() []string {
+	return r.hostsWhere(func(s hostStats) bool { return s.Changed > 0 })
+}
+
+// failedHosts returns the hosts with at least one failed task.
+func (r *runReport) failedHosts() []string {
+	return r.hostsWhere(func(s hostStats) bool { return s.Failed > 0 })
+}
+
+// unreachableHosts returns the hosts Ansible could not connect to.
+func (r *runReport) unreachableHosts() []string {
+	return r.hostsWhere(func(s hostStats) bool { return s.Unreachable > 0 })
+}
+
+// totals returns the counters summed over all hosts.
+func (r *runReport) totals() hostStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var t hostStats
+	for _, s := range r.stats {
+		t.add(*s)
+	}
+	return t
+}
+
+// changedTasks returns the tasks that reported a change, one entry per task
+// and host. Without the event stream only the recap is known, so the result
+// then holds one entry per changed host without task details.
+func (r *runReport) changedTasks() []taskChange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changes := []taskChange{}
+	if r.streaming {
+		for _, res := range r.results {
+			if res.Status == "changed" {
+				changes = append(changes, taskChange{Host: res.Host, Play: res.Play, Task: res.Task, Path: res.Path})
+			}
+		}
+		return changes
+	}
+	for host, s := range r.stats {
+		if s.Changed > 0 {
+			changes = append(changes, taskChange{Host: host})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Host < changes[j].Host })
+	return changes
+}
+
+// hostsOf returns the sorted, distinct hosts of changes.
+func hostsOf(changes []taskChange) []string {
+	seen := make(map[string]bool)
+	hosts := []string{}
+	for _, ch := range changes {
+		if !seen[ch.Host] {
+			seen[ch.Host] = true
+			hosts = append(hosts, ch.Host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// recordIdempotence records the outcome of an idempotence check.
+func (r *runReport) recordIdempotence(changes []taskChange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.idempotenceChecked = true
+	r.idempotenceChanges = append([]taskChange{}, changes...)
+}
+
+// idempotence returns the changes reported by the idempotence check and
+// whether a check ran at all. The slice is never nil.
+func (r *runReport) idempotence() ([]taskChange, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]taskChange{}, r.idempotenceChanges...), r.idempotenceChecked
+}
+
+// recordDrift records the outcome of drift detection.
+func (r *runReport) recordDrift(changes []taskChange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.driftChecked = true
+	r.driftChanges = append([]taskChange{}, changes...)
+}
+
+// drift returns the changes check mode reported during drift detection and
+// whether drift detection ran at all. The slice is never nil.
+func (r *runReport) drift() ([]taskChange, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]taskChange{}, r.driftChanges...), r.driftChecked
+}
+
+// recordPlan records the plan written in plan mode or verified in apply mode.
+func (r *runReport) recordPlan(p planSummary) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.plan = &p
+}
+
+// planSummary returns the recorded plan, or nil outside plan and apply mode.
+func (r *runReport) planSummary() *planSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.plan
+}
+
+// recordDiffMarkdown records the rendered diff markdown for the action
+// outputs.
+func (r *runReport) recordDiffMarkdown(md string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.diffMarkdown = md
+}
+
+// diffMarkdownText returns the rendered diff markdown, or "" if none was written.
+func (r *runReport) diffMarkdownText() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.diffMarkdown
+}
+
+// recordCustomStats merges the data playbooks published with set_stats,
+// keyed by host or by "_run" for data not tied to a host. When several
+// playbooks set the same key, the later value wins.
+func (r *runReport) recordCustomStats(custom map[string]map[string]json.RawMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for scope, values := range custom {
+		if r.custom[scope] == nil {
+			r.custom[scope] = make(map[string]json.RawMessage, len(values))
+		}
+		for key, value := range values {
+			r.custom[scope][key] = value
+		}
+	}
+}
+
+// customStats returns a copy of the set_stats data recorded so far.
+func (r *runReport) customStats() map[string]map[string]json.RawMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copyCustomStats(r.custom)
+}
+
+// copyCustomStats returns a copy of custom that shares no maps with it.
+func copyCustomStats(custom map[string]map[string]json.RawMessage) map[string]map[string]json.RawMessage {
+	out := make(map[string]map[string]json.RawMessage, len(custom))
+	for scope, values := range custom {
+		out[scope] = make(map[string]json.RawMessage, len(values))
+		for key, value := range values {
+			out[scope][key] = value
+		}
+	}
+	return out
+}
+
+// recordAttempt appends the outcome of one attempt.
+func (r *runReport) recordAttempt(a attemptRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts = append(r.attempts, a)
+}
+
+// attemptHistory returns a copy of the recorded attempts in order.
+func (r *runReport) attemptHistory() []attemptRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]attemptRecord(nil), r.attempts...)
+}
+
+// recordGalaxy records the Galaxy install.
+func (r *runReport) recordGalaxy(p galaxyPhase) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.galaxy = &p
+}
+
+// galaxyRecord returns the recorded Galaxy install, or nil if none ran.
+func (r *runReport) galaxyRecord() *galaxyPhase {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.galaxy == nil {
+		return nil
+	}
+	p := *r.galaxy
+	return &p
+}
+
+// recordPip records the pip install.
+func (r *runReport) recordPip(p pipPhase) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pip = &p
+}
+
+// pipRecord returns the recorded pip install, or nil if none ran.
+func (r *runReport) pipRecord() *pipPhase {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pip == nil {
+		return nil
+	}
+	p := *r.pip
+	p.Packages = append([]pythonPackage(nil), r.pip.Packages...)
+	return &p
+}
+
+// recordFacts records the exported host facts for the action outputs.
+func (r *runReport) recordFacts(facts map[string]map[string]any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.facts = facts
+}
+
+// exportedFacts returns the exported host facts, or nil if none were exported.
+func (r *runReport) exportedFacts() map[string]map[string]any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.facts
+}
+
+// lineWriter is an io.Writer that splits the written stream into lines and
+// hands each complete line, without its trailing newline, to fn. A trailing
+// partial line is kept until the next Write or Flush.
+type lineWriter struct {
+	mu  sync.Mutex
+	buf []byte
+	fn  func(line string)
+}
+
+// newLineWriter returns a lineWriter calling fn for every line.
+func newLineWriter(fn func(line string)) *lineWriter {
+	return &lineWriter{fn: fn}
+}
+
+// Write implements io.Writer. It never fails.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSuffix(string(w.buf[:i]), "\r")
+		w.buf = w.buf[i+1:]
+		w.fn(line)
+	}
+	return len(p), nil
+}
+
+// Flush hands a pending partial line to fn.
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		line := string(w.buf)
+		w.buf = nil
+		w.fn(line)
+	}
+}
+
+// ansiEscape matches ANSI color and cursor sequences, which Ansible emits when
+// ANSIBLE_FORCE_COLOR is set.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// stripANSI removes ANSI escape sequences from s.
+func stripANSI(s string) string {
+	return ansiEscape.ReplaceAllString(s, "")
+}
+
+// recapLine matches a host line of the PLAY RECAP block, e.g.
+// "web1   : ok=3    changed=1    unreachable=0    failed=0 ...".
+var recapLine = regexp.MustCompile(`^(\S+)\s+:\s+((?:\w+=\d+\s*)+)$`)
+
+// headerLine matches the banners the default callback prints before each
+// play, task and handler, e.g. "TASK [Install nginx] *****".
+var headerLine = regexp.MustCompile(`^(PLAY|TASK|RUNNING HANDLER) \[(.*)\]\s*\**$`)
+
+// resultLine matches failed and unreachable results, e.g.
+// `fatal: [web1]: FAILED! => {"msg": "..."}` or
+// `failed: [web1] (item=nginx) => {"msg": "..."}`.
+var resultLine = regexp.MustCompile(`^(fatal|failed): \[([^\]]+)\](?:: (FAILED|UNREACHABLE)!)?(?: \(item=(.*)\))? => (.*)$`)
+
+// outputParser extracts structured results from Ansible's default stdout
+// callback output, line by line. It is the fallback for runs where the event
+// stream is unavailable; once the stream delivers events for an attempt, the
+// parser only maintains the output tail.
+type outputParser struct {
+	report    *runReport
+	now       func() time.Time
+	inRecap   bool
+	play      string
+	task      string
+	taskStart time.Time
+}
+
+// newOutputParser returns an outputParser recording into report.
+func newOutputParser(report *runReport) *outputParser {
+	return &outputParser{report: report, now: time.Now}
+}
+
+// reset forgets the current play and task before a new attempt.
+func (p *outputParser) reset() {
+	p.inRecap = false
+	p.play = ""
+	p.task = ""
+}
+
+// handleLine processes a single line of Ansible output.
+func (p *outputParser) handleLine(raw string) {
+	line := strings.TrimSpace(stripANSI(raw))
+	p.report.appendTail(strings.TrimRight(stripANSI(raw), " "))
+	if p.report.isStreaming() {
+		return
+	}
+
+	if strings.HasPrefix(line, "PLAY RECAP") {
+		p.finishTask()
+		p.inRecap = true
+		return
+	}
+	if m := headerLine.FindStringSubmatch(line); m != nil {
+		p.finishTask()
+		p.inRecap = false
+		if m[1] == "PLAY" {
+			p.play = m[2]
+			return
+		}
+		p.task = m[2]
+		p.taskStart = p.now()
+		return
+	}
+	if p.inRecap {
+		if host, stats, ok := parseRecapLine(line); ok {
+			p.report.recordStats(host, stats)
+		}
+		return
+	}
+	if line == "...ignoring" {
+		p.report.ignoreLastFailure()
+		return
+	}
+	if m := resultLine.FindStringSubmatch(line); m != nil {
+		host, _, _ := strings.Cut(m[2], " -> ")
+		msg := resultMessage(m[5])
+		if m[3] == "UNREACHABLE" {
+			p.report.recordUnreachable(host, msg)
+			return
+		}
+		p.report.recordFailure(taskFailure{
+			Host: host,
+			Play: p.play,
+			Task: p.task,
+			Item: m[4],
+			Msg:  msg,
+		})
+	}
+}
+
+// finishTask records the duration of the task currently in progress, if any.
+func (p *outputParser) finishTask() {
+	if p.task == "" {
+		return
+	}
+	p.report.recordTiming(taskTiming{Play: p.play, Task: p.task, Duration: p.now().Sub(p.taskStart)})
+	p.task = ""
+}
+
+// resultMessage extracts a human-readable message from the JSON result the
+// default callback prints after "=>". It falls back to the raw text when the
+// result is not valid JSON (e.g. with a non-default stdout callback).
+func resultMessage(raw string) string {
+	var result map[string]any
+	if err := json.Unmarshal([]byte(raw), &result); err != nil {
+		return strings.TrimSpace(raw)
+	}
+	for _, key := range []string{"msg", "reason", "stderr", "module_stderr"} {
+		v, ok := result[key]
+		if !ok || v == nil {
+			continue
+		}
+		if s, ok := v.(string); ok {
+			if s = strings.TrimSpace(s); s != "" {
+				return s
+			}
+			continue
+		}
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// parseRecapLine parses a single host line of the PLAY RECAP block.
+func parseRecapLine(line string) (string, hostStats, bool) {
+	m := recapLine.FindStringSubmatch(line)
+	if m == nil {
+		return "", hostStats{}, false
+	}
+	var s hostStats
+	for _, field := range strings.Fields(m[2]) {
+		key, value, _ := strings.Cut(field, "=")
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		switch key {
+		case "ok":
+			s.Ok = n
+		case "changed":
+			s.Changed = n
+		case "unreachable":
+			s.Unreachable = n
+		case "failed":
+			s.Failed = n
+		case "skipped":
+			s.Skipped = n
+		case "rescued":
+			s.Rescued = n
+		case "ignored":
+			s.Ignored = n
+		}
+	}
+	return m[1], s, true
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRecapLine(t *testing.T) {
+	host, stats, ok := parseRecapLine("web1.example.com           : ok=5    changed=2    unreachable=0    failed=1    skipped=3    rescued=0    ignored=1   ")
+	if !ok {
+		t.Fatal("expected recap line to parse")
+	}
+	if host != "web1.example.com" {
+		t.Errorf("expected host web1.example.com, got %q", host)
+	}
+	want := hostStats{Ok: 5, Changed: 2, Failed: 1, Skipped: 3, Ignored: 1}
+	if stats != want {
+		t.Errorf("expected %+v, got %+v", want, stats)
+	}
+}
+
+func TestParseRecapLine_NotRecap(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"TASK [Gathering Facts] ****",
+		"ok: [localhost]",
+		"Sunday 01 January 2026  10:00:00 +0000 (0:00:01.123)       0:00:05.000 *****",
+	} {
+		if _, _, ok := parseRecapLine(line); ok {
+			t.Errorf("expected %q not to parse as a recap line", line)
+		}
+	}
+}
+
+func TestOutputParser_Recap(t *testing.T) {
+	report := newRunReport()
+	w := newLineWriter(newOutputParser(report).handleLine)
+	output := "PLAY [all] *****\n\n" +
+		"TASK [Gathering Facts] *****\nok: [web1]\nok: [web2]\n\n" +
+		"PLAY RECAP *****\n" +
+		"\x1b[0;33mweb1\x1b[0m                       : \x1b[0;32mok=2\x1b[0m    \x1b[0;33mchanged=1\x1b[0m    unreachable=0    failed=0    skipped=0    rescued=0    ignored=0\n" +
+		"web2                       : ok=1    changed=0    unreachable=0    failed=1    skipped=0    rescued=0    ignored=0\n" +
+		"db1                        : ok=0    changed=0    unreachable=1    failed=0    skipped=0    rescued=0    ignored=0"
+	// Write in two chunks to exercise partial-line buffering.
+	mid := len(output) / 2
+	_, _ = w.Write([]byte(output[:mid]))
+	_, _ = w.Write([]byte(output[mid:]))
+	w.Flush()
+
+	if got := report.hosts(); !reflect.DeepEqual(got, []string{"db1", "web1", "web2"}) {
+		t.Errorf("unexpected hosts: %v", got)
+	}
+	if got := report.changedHosts(); !reflect.DeepEqual(got, []string{"web1"}) {
+		t.Errorf("unexpected changed hosts: %v", got)
+	}
+	if got := report.failedHosts(); !reflect.DeepEqual(got, []string{"web2"}) {
+		t.Errorf("unexpected failed hosts: %v", got)
+	}
+	if got := report.unreachableHosts(); !reflect.DeepEqual(got, []string{"db1"}) {
+		t.Errorf("unexpected unreachable hosts: %v", got)
+	}
+	want := hostStats{Ok: 3, Changed: 1, Unreachable: 1, Failed: 1}
+	if got := report.totals(); got != want {
+		t.Errorf("expected totals %+v, got %+v", want, got)
+	}
+}
+
+func TestOutputParser_MultipleRecapsAccumulate(t *testing.T) {
+	report := newRunReport()
+	p := newOutputParser(report)
+	for _, line := range []string{
+		"PLAY RECAP ***",
+		"web1 : ok=2 changed=1 unreachable=0 failed=0",
+		"PLAY [second] ***",
+		"web1 : ok=9 changed=9 unreachable=0 failed=0", // outside a recap block
+		"PLAY RECAP ***",
+		"web1 : ok=1 changed=1 unreachable=0 failed=0",
+	} {
+		p.handleLine(line)
+	}
+	if got := report.hostStats()["web1"]; got != (hostStats{Ok: 3, Changed: 2}) {
+		t.Errorf("unexpected stats for web1: %+v", got)
+	}
+}
+
+func TestRunReport_Reset(t *testing.T) {
+	report := newRunReport()
+	report.recordStats("web1", hostStats{Changed: 1})
+	report.reset()
+	if got := report.hosts(); len(got) != 0 {
+		t.Errorf("expected no hosts after reset, got %v", got)
+	}
+	if got := report.changedHosts(); got == nil {
+		t.Error("expected an empty, non-nil host list so it encodes as []")
+	}
+}
+
+func TestLineWriter_CRLF(t *testing.T) {
+	var lines []string
+	w := newLineWriter(func(line string) { lines = append(lines, line) })
+	_, _ = w.Write([]byte("one\r\ntwo\nthree"))
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 complete lines before flush, got %d", len(lines))
+	}
+	w.Flush()
+	if got := strings.Join(lines, "|"); got != "one|two|three" {
+		t.Errorf("unexpected lines: %q", got)
+	}
+}
+
+func TestOutputParser_Failures(t *testing.T) {
+	report := newRunReport()
+	p := newOutputParser(report)
+	for _, line := range []string{
+		"PLAY [webservers] ***",
+		"TASK [Install nginx] ***",
+		`fatal: [web1]: FAILED! => {"changed": false, "msg": "No package matching 'nginx' found"}`,
+		`fatal: [web2 -> localhost]: FAILED! => {"changed": false, "rc": 1, "stderr": "boom"}`,
+		"TASK [Optional step] ***",
+		`fatal: [web1]: FAILED! => {"changed": false, "msg": "ignored failure"}`,
+		"...ignoring",
+		"TASK [Loop] ***",
+		`failed: [web1] (item=foo) => {"ansible_loop_var": "item", "item": "foo", "msg": "item failed"}`,
+		"TASK [Connect] ***",
+		`fatal: [db1]: UNREACHABLE! => {"changed": false, "msg": "Failed to connect to the host via ssh", "unreachable": true}`,
+	} {
+		p.handleLine(line)
+	}
+
+	failures := report.failedTasks()
+	if len(failures) != 3 {
+		t.Fatalf("expected 3 failures, got %d: %+v", len(failures), failures)
+	}
+	want := taskFailure{Host: "web1", Play: "webservers", Task: "Install nginx", Msg: "No package matching 'nginx' found"}
+	if failures[0] != want {
+		t.Errorf("expected %+v, got %+v", want, failures[0])
+	}
+	if failures[1].Host != "web2" || failures[1].Msg != "boom" {
+		t.Errorf("expected delegated failure on web2 with stderr message, got %+v", failures[1])
+	}
+	if failures[2].Item != "foo" || failures[2].Task != "Loop" {
+		t.Errorf("expected loop item failure, got %+v", failures[2])
+	}
+	if got := report.unreachableErrors()["db1"]; got != "Failed to connect to the host via ssh" {
+		t.Errorf("unexpected unreachable message: %q", got)
+	}
+}
+
+func TestOutputParser_TaskTimings(t *testing.T) {
+	report := newRunReport()
+	p := newOutputParser(report)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	p.handleLine("PLAY [all] ***")
+	p.handleLine("TASK [fast] ***")
+	now = now.Add(2 * time.Second)
+	p.handleLine("TASK [slow] ***")
+	now = now.Add(90 * time.Second)
+	p.handleLine("RUNNING HANDLER [restart] ***")
+	now = now.Add(10 * time.Second)
+	p.handleLine("PLAY RECAP ***")
+
+	slowest := report.slowestTasks(2)
+	if len(slowest) != 2 {
+		t.Fatalf("expected 2 timings, got %d", len(slowest))
+	}
+	if slowest[0].Task != "slow" || slowest[0].Duration != 90*time.Second {
+		t.Errorf("expected slow task first, got %+v", slowest[0])
+	}
+	if slowest[1].Task != "restart" || slowest[1].Play != "all" {
+		t.Errorf("expected handler second, got %+v", slowest[1])
+	}
+}
+
+func TestRunReport_OutputTailBounded(t *testing.T) {
+	report := newRunReport()
+	for i := 0; i < outputTailLines+10; i++ {
+		report.appendTail(fmt.Sprintf("line %d", i))
+	}
+	tail := report.outputTail()
+	if len(tail) != outputTailLines {
+		t.Fatalf("expected %d lines, got %d", outputTailLines, len(tail))
+	}
+	if tail[len(tail)-1] != fmt.Sprintf("line %d", outputTailLines+9) {
+		t.Errorf("expected the most recent line last, got %q", tail[len(tail)-1])
+	}
+}
+
+func TestResultMessage_NotJSON(t *testing.T) {
+	if got := resultMessage("  something odd "); got != "something odd" {
+		t.Errorf("expected raw text fallback, got %q", got)
+	}
+}
+
+func TestHostsOf(t *testing.T) {
+	got := hostsOf([]taskChange{{Host: "web2"}, {Host: "web1"}, {Host: "web2"}})
+	if len(got) != 2 || got[0] != "web1" || got[1] != "web2" {
+		t.Errorf("expected [web1 web2], got %v", got)
+	}
+}
+
+func TestRecordCustomStats_Merges(t *testing.T) {
+	report := newRunReport()
+	report.recordCustomStats(map[string]map[string]json.RawMessage{"_run": {"a": json.RawMessage(`1`), "b": json.RawMessage(`2`)}})
+	report.recordCustomStats(map[string]map[string]json.RawMessage{"_run": {"b": json.RawMessage(`3`)}, "web1": {"c": json.RawMessage(`4`)}})
+
+	custom := report.customStats()
+	if string(custom["_run"]["a"]) != "1" || string(custom["_run"]["b"]) != "3" || string(custom["web1"]["c"]) != "4" {
+		t.Errorf("unexpected custom stats: %v", custom)
+	}
+
+	report.reset()
+	if got := report.customStats(); len(got) != 0 {
+		t.Errorf("expected reset to discard custom stats, got %v", got)
+	}
+}
+
+func TestForgetHosts(t *testing.T) {
+	report := newRunReport()
+	report.recordStats("web1", hostStats{Ok: 2, Changed: 1})
+	report.recordStats("web2", hostStats{Ok: 1, Failed: 1})
+	report.recordResult(taskResult{Host: "web1", Task: "Install", Status: "changed"})
+	report.recordResult(taskResult{Host: "web2", Task: "Install", Status: "failed"})
+	report.recordFailure(taskFailure{Host: "web2", Task: "Install", Msg: "boom"})
+	report.appendTail("fatal: [web2]")
+
+	report.forgetHosts([]string{"web2"})
+	report.recordStats("web2", hostStats{Ok: 2})
+
+	if got := report.hostStats(); got["web1"] != (hostStats{Ok: 2, Changed: 1}) || got["web2"] != (hostStats{Ok: 2}) {
+		t.Errorf("unexpected stats after retry: %+v", got)
+	}
+	if got := report.taskResults(); len(got) != 1 || got[0].Host != "web1" {
+		t.Errorf("expected only web1's result to be kept, got %+v", got)
+	}
+	if got := report.failedTasks(); len(got) != 0 {
+		t.Errorf("expected web2's failure to be discarded, got %+v", got)
+	}
+	if got := report.outputTail(); len(got) != 0 {
+		t.Errorf("expected the output tail to be discarded, got %v", got)
+	}
+}
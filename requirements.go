@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Values of a collection's type and a role's scm that ansible-galaxy accepts.
+var (
+	collectionTypes = []string{"galaxy", "git", "url", "file", "dir", "subdirs"}
+	roleSCMs        = []string{"git", "hg"}
+)
+
+// collectionName matches a Galaxy collection name such as community.general.
+var collectionName = regexp.MustCompile(`^[a-z0-9_]+\.[a-z0-9_]+$`)
+
+// galaxyServerName matches the name of a Galaxy server configured in
+// ansible.cfg, which source may give instead of a URL.
+var galaxyServerName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// versionSpecifier matches one constraint of a collection version range, e.g.
+// ">=8.0.0" or "1.2.3-beta.1".
+var versionSpecifier = regexp.MustCompile(`^(==|!=|>=|<=|>|<|=)?\s*\d+(\.\d+){0,2}(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// requirement is one collection or role listed in a Galaxy requirements file.
+// Type holds a collection's type or a role's scm. Line is the line the entry
+// starts on, and lines maps each key to the line it is set on.
+type requirement struct {
+	Kind       string
+	Name       string
+	Src        string
+	Version    string
+	Source     string
+	Type       string
+	Signatures []string
+	Line       int
+
+	lines map[string]int
+}
+
+// requirementsError is a problem at a line of a requirements file.
+// Unsupported marks a valid file the check cannot follow, such as an include.
+type requirementsError struct {
+	Line        int
+	Msg         string
+	Unsupported bool
+}
+
+func (e *requirementsError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// ref returns what identifies the content on Galaxy: the collection name, or
+// the role's src, falling back to its name.
+func (r requirement) ref() string {
+	if r.Kind == galaxyLockRoles && r.Src != "" {
+		return r.Src
+	}
+	return r.Name
+}
+
+// parseRequirements reads the collections and roles of a requirements file:
+// a "collections" and a "roles" list, or a plain list of roles, whose entries
+// are either a name or a mapping of name, src, version, source, type and
+// signatures. Errors carry the line they were found on; an include of other
+// files is reported as unsupported, as the wrapper does not follow it.
+func parseRequirements(data []byte) ([]requirement, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, yamlSyntaxError(err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := resolveAlias(doc.Content[0])
+	switch {
+	case isYAMLNull(root):
+		return nil, nil
+	case root.Kind == yaml.SequenceNode:
+		// A list at the top level is the old format of a roles file.
+		return parseRequirementList(galaxyLockRoles, root)
+	case root.Kind != yaml.MappingNode:
+		return nil, &requirementsError{Line: root.Line, Msg: "expected collections and roles lists"}
+	}
+	var reqs []requirement
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := resolveAlias(root.Content[i]), resolveAlias(root.Content[i+1])
+		if key.Value != galaxyLockCollections && key.Value != galaxyLockRoles {
+			return nil, &requirementsError{Line: key.Line, Msg: fmt.Sprintf("unknown top-level key %q (expected collections or roles)", key.Value)}
+		}
+		if isYAMLNull(value) {
+			continue
+		}
+		if value.Kind != yaml.SequenceNode {
+			return nil, &requirementsError{Line: key.Line, Msg: fmt.Sprintf("%s must be a list", key.Value)}
+		}
+		list, err := parseRequirementList(key.Value, value)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, list...)
+	}
+	return reqs, nil
+}
+
+// parseRequirementList reads the entries of a collections or roles list.
+func parseRequirementList(kind string, list *yaml.Node) ([]requirement, error) {
+	var reqs []requirement
+	for _, item := range list.Content {
+		item = resolveAlias(item)
+		r := requirement{Kind: kind, Line: item.Line}
+		switch {
+		case isYAMLNull(item):
+			return nil, &requirementsError{Line: item.Line, Msg: "empty list item"}
+		case item.Kind == yaml.ScalarNode:
+			if kind == galaxyLockRoles {
+				r.Src = item.Value
+			} else {
+				r.Name = item.Value
+			}
+		case item.Kind == yaml.MappingNode:
+			for i := 0; i+1 < len(item.Content); i += 2 {
+				if err := r.set(resolveAlias(item.Content[i]), resolveAlias(item.Content[i+1])); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, &requirementsError{Line: item.Line, Msg: fmt.Sprintf("expected a %s name or mapping", strings.TrimSuffix(kind, "s"))}
+		}
+		reqs = append(reqs, r)
+	}
+	return reqs, nil
+}
+
+// requirementKeys lists the keys ansible-galaxy accepts in a collection and
+// in a role entry.
+var requirementKeys = map[string][]string{
+	galaxyLockCollections: {"name", "version", "source", "type", "signatures"},
+	galaxyLockRoles:       {"name", "src", "version", "scm"},
+}
+
+// set assigns one key of an entry.
+func (r *requirement) set(keyNode, value *yaml.Node) error {
+	key, line := keyNode.Value, keyNode.Line
+	if !slices.Contains(requirementKeys[r.Kind], key) {
+		if key == "include" {
+			return &requirementsError{Line: line, Msg: `"include" of other requirements files is not supported`, Unsupported: true}
+		}
+		return &requirementsError{Line: line, Msg: fmt.Sprintf("unknown key %q for a %s (expected %s)", key, strings.TrimSuffix(r.Kind, "s"), strings.Join(requirementKeys[r.Kind], ", "))}
+	}
+	if _, dup := r.lines[key]; dup {
+		return &requirementsError{Line: line, Msg: fmt.Sprintf("duplicate key %q", key)}
+	}
+	if r.lines == nil {
+		r.lines = make(map[string]int)
+	}
+	r.lines[key] = line
+	if key == "signatures" {
+		if isYAMLNull(value) {
+			return nil
+		}
+		if value.Kind != yaml.SequenceNode {
+			return &requirementsError{Line: line, Msg: "signatures must be a list"}
+		}
+		for _, sig := range value.Content {
+			if sig = resolveAlias(sig); sig.Kind != yaml.ScalarNode {
+				return &requirementsError{Line: sig.Line, Msg: "signatures must be a list of URLs"}
+			}
+			r.Signatures = append(r.Signatures, sig.Value)
+		}
+		return nil
+	}
+	if value.Kind != yaml.ScalarNode {
+		return &requirementsError{Line: line, Msg: fmt.Sprintf("%s must be a single value", key)}
+	}
+	v := value.Value
+	if isYAMLNull(value) {
+		v = ""
+	}
+	switch key {
+	case "name":
+		r.Name = v
+	case "src":
+		r.Src = v
+	case "version":
+		r.Version = v
+	case "source":
+		r.Source = v
+	case "type", "scm":
+		r.Type = v
+	}
+	return nil
+}
+
+// yamlErrorLine matches the line yaml.v3 reports a syntax error at.
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// yamlSyntaxError turns a YAML syntax error into a requirementsError at its
+// line; ansible-galaxy cannot read such a file either.
+func yamlSyntaxError(err error) error {
+	if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return &requirementsError{Line: line, Msg: "invalid YAML: " + m[2]}
+	}
+	return &requirementsError{Line: 1, Msg: "invalid YAML: " + strings.TrimPrefix(err.Error(), "yaml: ")}
+}
+
+// resolveAlias returns the node an alias points at, or n itself.
+func resolveAlias(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+// isYAMLNull reports whether n is a null value, e.g. an empty value or "~".
+func isYAMLNull(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && n.Tag == "!!null"
+}
+
+// line returns the line key is set on, or the entry's line.
+func (r requirement) line(key string) int {
+	if n, ok := r.lines[key]; ok {
+		return n
+	}
+	return r.Line
+}
+
+// validateRequirements checks the entries of a requirements file the way
+// ansible-galaxy would, without contacting a server.
+func validateRequirements(reqs []requirement) []*requirementsError {
+	var problems []*requirementsError
+	add := func(line int, format string, args ...any) {
+		problems = append(problems, &requirementsError{Line: line, Msg: fmt.Sprintf(format, args...)})
+	}
+	for _, r := range reqs {
+		if r.Kind == galaxyLockRoles {
+			if r.Src == "" && r.Name == "" {
+				add(r.Line, "role needs a src or a name")
+			}
+			if r.Type != "" && !slices.Contains(roleSCMs, r.Type) {
+				add(r.line("scm"), "invalid scm %q (expected %s)", r.Type, strings.Join(roleSCMs, " or "))
+			}
+			continue
+		}
+		if r.Name == "" {
+			add(r.Line, "collection needs a name")
+			continue
+		}
+		if r.Type != "" && !slices.Contains(collectionTypes, r.Type) {
+			add(r.line("type"), "invalid type %q (expected one of %s)", r.Type, strings.Join(collectionTypes, ", "))
+			continue
+		}
+		if (r.Type == "" || r.Type == "galaxy") && !isLocalRequirement(r) {
+			if !collectionName.MatchString(r.Name) {
+				add(r.line("name"), "invalid collection name %q (expected namespace.name)", r.Name)
+			}
+			for _, c := range strings.Split(r.Version, ",") {
+				if c = strings.TrimSpace(c); r.Version != "" && c != "*" && !versionSpecifier.MatchString(c) {
+					add(r.line("version"), "invalid version specifier %q", c)
+				}
+			}
+		}
+		if r.Source != "" && !strings.HasPrefix(r.Source, "https://") && !strings.HasPrefix(r.Source, "http://") && !galaxyServerName.MatchString(r.Source) {
+			add(r.line("source"), "invalid source %q (expected a Galaxy server URL or name)", r.Source)
+		}
+	}
+	return problems
+}
+
+// checkRequirementsFile parses and validates the requirements file at path.
+// Every problem is recorded in report, so it becomes an annotation on its
+// line, and the returned error lists them all.
+func checkRequirementsFile(path string, report *runReport) error {
+	// #nosec G304 -- the requirements file is an input of the workflow.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read galaxy file: %w", err)
+	}
+	var problems []*requirementsError
+	reqs, err := parseRequirements(data)
+	var re *requirementsError
+	switch {
+	case errors.As(err, &re) && re.Unsupported:
+		log.Printf("Warning: %s cannot be validated (line %d: %s); leaving it to ansible-galaxy", path, re.Line, re.Msg)
+		return nil
+	case errors.As(err, &re):
+		problems = []*requirementsError{re}
+	case err != nil:
+		return err
+	default:
+		problems = validateRequirements(reqs)
+	}
+	if len(problems) == 0 {
+		log.Printf("Galaxy requirements file %s lists %d collection(s) and role(s)", path, len(reqs))
+		return nil
+	}
+	msgs := make([]string, len(problems))
+	for i, p := range problems {
+		report.recordDiagnostic(diagnostic{Kind: diagnosticRequirements, Msg: p.Msg, File: path, Line: p.Line})
+		msgs[i] = fmt.Sprintf("%s:%d: %s", path, p.Line, p.Msg)
+	}
+	return fmt.Errorf("%w: invalid Galaxy requirements file: %s", ErrInvalidParameter, strings.Join(msgs, "; "))
+}
+
+// stripYAMLComment removes a trailing comment outside of quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+	return line
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRequirements(t *testing.T) {
+	data := `---
+# Collections used by the site playbook.
+collections:
+  - name: community.general
+    version: ">=8.0.0,<9.0.0"
+  - ansible.posix  # any version
+  - {name: community.docker, version: 3.10.0}
+  - name: https://github.com/acme/collection.git
+    type: git
+roles:
+- src: geerlingguy.docker
+  version: '7.1.0'
+  name: docker
+- geerlingguy.nginx
+`
+	got, err := parseRequirements([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []requirement{
+		{Kind: galaxyLockCollections, Name: "community.general", Version: ">=8.0.0,<9.0.0", Line: 4},
+		{Kind: galaxyLockCollections, Name: "ansible.posix", Line: 6},
+		{Kind: galaxyLockCollections, Name: "community.docker", Version: "3.10.0", Line: 7},
+		{Kind: galaxyLockCollections, Name: "https://github.com/acme/collection.git", Type: "git", Line: 8},
+		{Kind: galaxyLockRoles, Src: "geerlingguy.docker", Version: "7.1.0", Name: "docker", Line: 11},
+		{Kind: galaxyLockRoles, Src: "geerlingguy.nginx", Line: 14},
+	}
+	if got[4].line("name") != 13 || got[1].line("version") != 6 {
+		t.Errorf("unexpected key lines: %d, %d", got[4].line("name"), got[1].line("version"))
+	}
+	for i := range got {
+		got[i].lines = nil
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected requirements:\n got %+v\nwant %+v", got, want)
+	}
+	if got[4].ref() != "geerlingguy.docker" || got[0].ref() != "community.general" {
+		t.Errorf("unexpected refs: %q, %q", got[4].ref(), got[0].ref())
+	}
+}
+
+func TestParseRequirements_OldRolesFormat(t *testing.T) {
+	got, err := parseRequirements([]byte("- src: geerlingguy.apache\n  version: 4.0.0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Kind != galaxyLockRoles || got[0].Src != "geerlingguy.apache" || got[0].Version != "4.0.0" {
+		t.Errorf("unexpected requirements: %+v", got)
+	}
+}
+
+func TestParseRequirements_YAMLSyntax(t *testing.T) {
+	data := `---
+"collections":
+  - "name": community.general
+    'version': &v 9.0.0
+  - {name: ansible.posix, version: *v}
+roles: [geerlingguy.docker]
+...
+`
+	got, err := parseRequirements([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0].Name != "community.general" || got[1].Name != "ansible.posix" || got[1].Version != "9.0.0" || got[2].Src != "geerlingguy.docker" {
+		t.Errorf("unexpected requirements: %+v", got)
+	}
+	if got[0].line("version") != 4 || got[2].Line != 6 {
+		t.Errorf("unexpected lines: %d, %d", got[0].line("version"), got[2].Line)
+	}
+}
+
+func TestParseRequirements_Errors(t *testing.T) {
+	for _, tt := range []struct {
+		data string
+		line int
+		msg  string
+	}{
+		{"collection:\n  - a.b\n", 1, `unknown top-level key "collection"`},
+		{"collections:\n  - name: a.b\n    verison: 1.0.0\n", 3, `unknown key "verison" for a collection`},
+		{"roles:\n  - src: a.b\n    type: git\n", 3, `unknown key "type" for a role`},
+		{"collections:\n  - name: a.b\n    name: c.d\n", 3, `duplicate key "name"`},
+		{"collections:\n  - name: a.b\n   - c.d\n", 1, "invalid YAML"},
+		{"roles:\n  - src: 'x\n", 2, "invalid YAML"},
+		{"collections:\n  - name: [a.b]\n", 2, "name must be a single value"},
+		{"collections: community.general\n", 1, "must be a list"},
+	} {
+		_, err := parseRequirements([]byte(tt.data))
+		var re *requirementsError
+		if !errors.As(err, &re) || re.Line != tt.line || !strings.Contains(re.Msg, tt.msg) {
+			t.Errorf("%q: expected %q at line %d, got %v", tt.data, tt.msg, tt.line, err)
+		}
+	}
+}
+
+func TestParseRequirements_Signatures(t *testing.T) {
+	data := `collections:
+  - name: community.general
+    signatures:
+      - https://example.com/general.asc
+      - file:///keys/general.asc
+  - signatures:
+      - https://example.com/posix.asc
+    name: ansible.posix
+`
+	got, err := parseRequirements([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || len(got[0].Signatures) != 2 || got[1].Name != "ansible.posix" || len(got[1].Signatures) != 1 {
+		t.Errorf("unexpected requirements: %+v", got)
+	}
+}
+
+func TestValidateRequirements(t *testing.T) {
+	data := `collections:
+  - name: Community.General
+  - name: community.docker
+    version: ">=3.0.0,<4"
+  - name: ansible.posix
+    version: latest
+  - name: acme.tools
+    type: svn
+  - name: acme.internal
+    source: "https://hub.example.com/api/"
+  - name: acme.mirror
+    source: ftp://mirror
+  - name: https://github.com/acme/c.git
+    type: git
+    version: main
+roles:
+  - src: geerlingguy.docker
+    scm: cvs
+  - version: 1.0.0
+`
+	reqs, err := parseRequirements([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range validateRequirements(reqs) {
+		got = append(got, p.Error())
+	}
+	want := []string{
+		`line 2: invalid collection name "Community.General" (expected namespace.name)`,
+		`line 6: invalid version specifier "latest"`,
+		`line 8: invalid type "svn" (expected one of galaxy, git, url, file, dir, subdirs)`,
+		`line 12: invalid source "ftp://mirror" (expected a Galaxy server URL or name)`,
+		`line 18: invalid scm "cvs" (expected git or hg)`,
+		`line 19: role needs a src or a name`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected problems:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestCheckRequirementsFile(t *testing.T) {
+	dir := t.TempDir()
+	valid := createTempFile(t, dir, "requirements.yml", "collections:\n  - community.general\n")
+	report := newRunReport()
+	if err := checkRequirementsFile(valid, report); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	invalid := createTempFile(t, dir, "broken.yml", "collections:\n  - name: community.general\n    versoin: 8.0.0\n  - name: bad\n")
+	err := checkRequirementsFile(invalid, report)
+	if !errors.Is(err, ErrInvalidParameter) || !strings.Contains(err.Error(), invalid+`:3: unknown key "versoin"`) {
+		t.Fatalf("expected the problem with its file and line, got %v", err)
+	}
+	diags := report.diagnosticsOf(diagnosticRequirements)
+	if len(diags) != 1 || diags[0].File != invalid || diags[0].Line != 3 {
+		t.Fatalf("expected a located diagnostic, got %+v", diags)
+	}
+
+	var out strings.Builder
+	writeAnnotations(&out, report, err)
+	if !strings.HasPrefix(out.String(), "::error title=Invalid Galaxy requirements,file=") || !strings.Contains(out.String(), ",line=3::unknown key") {
+		t.Errorf("unexpected annotation: %q", out.String())
+	}
+	if strings.Count(out.String(), "::error") != 1 {
+		t.Errorf("expected no generic failure annotation:\n%s", out.String())
+	}
+}
+
+func TestCheckRequirementsFile_Include(t *testing.T) {
+	dir := t.TempDir()
+	createTempFile(t, dir, "other.yml", "- src: geerlingguy.apache\n")
+	path := createTempFile(t, dir, "requirements.yml", "- src: geerlingguy.docker\n- include: other.yml\n")
+	report := newRunReport()
+	if err := checkRequirementsFile(path, report); err != nil {
+		t.Fatalf("expected a roles file with include to be left to ansible-galaxy, got %v", err)
+	}
+	if diags := report.diagnosticsOf(diagnosticRequirements); len(diags) != 0 {
+		t.Errorf("expected no diagnostics, got %+v", diags)
+	}
+}
+
+func TestCheckRequirementsFile_FlowStyle(t *testing.T) {
+	dir := t.TempDir()
+	path := createTempFile(t, dir, "requirements.yml", "collections: [community.general, ansible.posix]\n")
+	report := newRunReport()
+	if err := checkRequirementsFile(path, report); err != nil {
+		t.Fatalf("expected flow style YAML to be valid, got %v", err)
+	}
+	if diags := report.diagnosticsOf(diagnosticRequirements); len(diags) != 0 {
+		t.Errorf("expected no diagnostics, got %+v", diags)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	ansible "github.com/arillso/go.ansible/v2"
+)
+
+// Failure classes retry-on selects from. Failures outside these classes, such
+// as syntax errors, are only retried with "any".
+const (
+	retryOnAny         = "any"
+	retryOnUnreachable = "unreachable"
+	retryOnHostFailed  = "host-failed"
+	retryOnTimeout     = "timeout"
+)
+
+// Backoff strategies between retries.
+const (
+	retryBackoffFixed       = "fixed"
+	retryBackoffExponential = "exponential"
+)
+
+// Exit codes of ansible-playbook the retry policy tells apart.
+const (
+	exitCodeHostFailed  = 2
+	exitCodeUnreachable = 4
+	exitCodeBreakPlay   = 8
+)
+
+// retryPolicy decides whether a failed attempt is retried and how long to wait
+// before the retry.
+type retryPolicy struct {
+	retries  int
+	delay    time.Duration
+	backoff  string
+	maxDelay time.Duration
+	// jitter is the share of each delay, in percent, that is randomly
+	// subtracted so that parallel jobs do not retry in lockstep.
+	jitter int
+	// on lists the failure classes to retry; empty means any.
+	on []string
+}
+
+// validateRetryOn checks the retry-on classes.
+func validateRetryOn(classes []string) error {
+	valid := []string{retryOnAny, retryOnUnreachable, retryOnHostFailed, retryOnTimeout}
+	for _, class := range classes {
+		if !slices.Contains(valid, class) {
+			return fmt.Errorf("%w: invalid value for --retry-on: %q (must be one of %s)",
+				ErrInvalidParameter, class, strings.Join(valid, ", "))
+		}
+	}
+	return nil
+}
+
+// failureClass classifies a failed attempt: "timeout" if it ran out of time,
+// "unreachable" or "host-failed" by ansible-playbook's exit code, and "" for
+// anything else.
+func failureClass(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return retryOnTimeout
+	}
+	var ansibleErr *ansible.AnsibleError
+	if !errors.As(err, &ansibleErr) {
+		return ""
+	}
+	switch ansibleErr.ExitCode {
+	case exitCodeUnreachable:
+		return retryOnUnreachable
+	case exitCodeHostFailed, exitCodeBreakPlay:
+		return retryOnHostFailed
+	}
+	return ""
+}
+
+// retryable reports whether err belongs to a failure class the policy
+// retries.
+func (p retryPolicy) retryable(err error) bool {
+	if len(p.on) == 0 || slices.Contains(p.on, retryOnAny) {
+		return true
+	}
+	class := failureClass(err)
+	return class != "" && slices.Contains(p.on, class)
+}
+
+// delayBefore returns the delay before the given retry, counted from 1. The
+// exponential backoff doubles the delay with every retry; maxDelay, if set,
+// caps it before the jitter is applied.
+func (p retryPolicy) delayBefore(retry int) time.Duration {
+	d := p.delay
+	if p.backoff == retryBackoffExponential {
+		for i := 1; i < retry && d < math.MaxInt64/2; i++ {
+			if p.maxDelay > 0 && d >= p.maxDelay {
+				break
+			}
+			d *= 2
+		}
+	}
+	if p.maxDelay > 0 && d > p.maxDelay {
+		d = p.maxDelay
+	}
+	if p.jitter > 0 && d > 0 {
+		// Dividing first keeps the product in range for any delay the
+		// uncapped backoff reaches.
+		// #nosec G404 -- jitter does not need a cryptographic source.
+		d -= time.Duration(rand.Int64N(int64(d/100)*int64(p.jitter) + 1))
+	}
+	return d
+}
+
+// retryLimitFile is the file in the retry directory that lists the hosts the
+// next attempt is limited to.
+const retryLimitFile = "limit.hosts"
+
+// failedHostRetry narrows retries to the hosts that failed. Ansible writes a
+// <playbook>.retry file with the failed and unreachable hosts into a private
+// directory, and the next attempt is limited to those hosts.
+type failedHostRetry struct {
+	dir   string
+	limit string
+}
+
+// newFailedHostRetry creates the retry directory. limit is the user's
+// original limit, which a successful attempt restores.
+func newFailedHostRetry(limit string) (*failedHostRetry, error) {
+	dir, err := os.MkdirTemp("", "ansible-retry-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create retry directory: %w", err)
+	}
+	return &failedHostRetry{dir: dir, limit: limit}, nil
+}
+
+// env returns the environment that makes Ansible write retry files into the
+// retry directory.
+func (f *failedHostRetry) env() map[string]string {
+	return map[string]string{
+		"ANSIBLE_RETRY_FILES_ENABLED":   "True",
+		"ANSIBLE_RETRY_FILES_SAVE_PATH": f.dir,
+	}
+}
+
+// close removes the retry directory.
+func (f *failedHostRetry) close() {
+	_ = os.RemoveAll(f.dir)
+}
+
+// clear removes retry files left by an earlier attempt.
+func (f *failedHostRetry) clear() {
+	matches, _ := filepath.Glob(filepath.Join(f.dir, "*.retry"))
+	for _, m := range matches {
+		_ = os.Remove(m)
+	}
+}
+
+// failedHosts returns the sorted, distinct hosts listed in the retry files of
+// the last attempt. If ran is not empty, only hosts in it are returned: the
+// attempt ran against the hosts matching the user's limit, so this keeps a
+// retry within that limit.
+func (f *failedHostRetry) failedHosts(ran []string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(f.dir, "*.retry"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list retry files: %w", err)
+	}
+	hosts := []string{}
+	for _, m := range matches {
+		// #nosec G304 -- the file lies in the wrapper's private retry directory.
+		data, err := os.ReadFile(m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read retry file: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			host := strings.TrimSpace(line)
+			if host == "" || (len(ran) > 0 && !slices.Contains(ran, host)) {
+				continue
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	slices.Sort(hosts)
+	return slices.Compact(hosts), nil
+}
+
+// next sets limit for the following attempt. After a failed attempt
+// with retry files it limits the playbook to the failed hosts and returns
+// them; otherwise it restores the original limit and returns nil, so the next
+// attempt runs against every host again.
+func (f *failedHostRetry) next(limit *string, execErr error, ran []string) []string {
+	defer f.clear()
+	*limit = f.limit
+	if execErr == nil {
+		return nil
+	}
+	hosts, err := f.failedHosts(ran)
+	if err != nil {
+		log.Printf("Warning: could not narrow the retry to the failed hosts: %v", err)
+		return nil
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+	path := filepath.Join(f.dir, retryLimitFile)
+	if err := os.WriteFile(path, []byte(strings.Join(hosts, "\n")+"\n"), 0600); err != nil {
+		log.Printf("Warning: could not narrow the retry to the failed hosts: %v", err)
+		return nil
+	}
+	*limit = "@" + path
+	log.Printf("Next attempt is limited to %d failed host(s): %s", len(hosts), strings.Join(hosts, ", "))
+	return hosts
+}
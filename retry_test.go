@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	ansible "github.com/arillso/go.ansible/v2"
+)
+
+func TestFailedHostRetry_Next(t *testing.T) {
+	retry, err := newFailedHostRetry("web")
+	if err != nil {
+		t.Fatalf("newFailedHostRetry: %v", err)
+	}
+	defer retry.close()
+	if env := retry.env(); env["ANSIBLE_RETRY_FILES_ENABLED"] != "True" || env["ANSIBLE_RETRY_FILES_SAVE_PATH"] != retry.dir {
+		t.Errorf("unexpected retry env: %v", env)
+	}
+
+	createTempFile(t, retry.dir, "site.retry", "web2\nweb1\n")
+	createTempFile(t, retry.dir, "deploy.retry", "web2\ndb1\n")
+	limit := "web"
+	hosts := retry.next(&limit, errors.New("exit status 4"), []string{"web1", "web2", "web3"})
+	if want := []string{"web1", "web2"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("expected retry hosts %v, got %v", want, hosts)
+	}
+	path, ok := strings.CutPrefix(limit, "@")
+	if !ok {
+		t.Fatalf("expected an @file limit, got %q", limit)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "web1\nweb2\n" {
+		t.Errorf("unexpected limit file: %q, %v", data, err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(retry.dir, "*.retry")); len(matches) != 0 {
+		t.Errorf("expected retry files to be cleared, got %v", matches)
+	}
+
+	if hosts := retry.next(&limit, nil, nil); hosts != nil || limit != "web" {
+		t.Errorf("expected a successful attempt to restore the limit, got %q and %v", limit, hosts)
+	}
+}
+
+func TestFailedHostRetry_NextWithoutRetryFiles(t *testing.T) {
+	retry, err := newFailedHostRetry("")
+	if err != nil {
+		t.Fatalf("newFailedHostRetry: %v", err)
+	}
+	defer retry.close()
+
+	limit := "@" + filepath.Join(retry.dir, retryLimitFile)
+	if hosts := retry.next(&limit, errors.New("syntax error"), []string{"web1"}); hosts != nil || limit != "" {
+		t.Errorf("expected a full retry without retry files, got %q and %v", limit, hosts)
+	}
+
+	retry.close()
+	if _, err := os.Stat(retry.dir); !os.IsNotExist(err) {
+		t.Errorf("expected the retry directory to be removed, got %v", err)
+	}
+}
+
+func TestFailureClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&ansible.AnsibleError{ExitCode: 4}, retryOnUnreachable},
+		{fmt.Errorf("wrapped: %w", &ansible.AnsibleError{ExitCode: 2}), retryOnHostFailed},
+		{&ansible.AnsibleError{ExitCode: 8}, retryOnHostFailed},
+		{&ansible.AnsibleError{ExitCode: 1}, ""},
+		{context.DeadlineExceeded, retryOnTimeout},
+		{errors.New("ansible-playbook not found"), ""},
+	}
+	for _, tt := range tests {
+		if got := failureClass(tt.err); got != tt.want {
+			t.Errorf("failureClass(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicy_Retryable(t *testing.T) {
+	unreachable := &ansible.AnsibleError{ExitCode: 4}
+	hostFailed := &ansible.AnsibleError{ExitCode: 2}
+	other := errors.New("syntax error")
+
+	policy := retryPolicy{on: []string{retryOnUnreachable, retryOnTimeout}}
+	if !policy.retryable(unreachable) || !policy.retryable(context.DeadlineExceeded) {
+		t.Error("expected unreachable hosts and timeouts to be retried")
+	}
+	if policy.retryable(hostFailed) || policy.retryable(other) {
+		t.Error("expected task failures and other errors not to be retried")
+	}
+	for _, p := range []retryPolicy{{}, {on: []string{retryOnAny}}} {
+		if !p.retryable(other) {
+			t.Errorf("expected %v to retry any failure", p.on)
+		}
+	}
+}
+
+func TestRetryPolicy_DelayBefore(t *testing.T) {
+	fixed := retryPolicy{delay: 10 * time.Second, backoff: retryBackoffFixed}
+	if got := fixed.delayBefore(3); got != 10*time.Second {
+		t.Errorf("fixed backoff: expected 10s, got %v", got)
+	}
+
+	exponential := retryPolicy{delay: 10 * time.Second, backoff: retryBackoffExponential, maxDelay: time.Minute}
+	for retry, want := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 3: 40 * time.Second, 4: time.Minute, 60: time.Minute} {
+		if got := exponential.delayBefore(retry); got != want {
+			t.Errorf("exponential backoff before retry %d: expected %v, got %v", retry, want, got)
+		}
+	}
+	uncapped := retryPolicy{delay: time.Second, backoff: retryBackoffExponential}
+	if got := uncapped.delayBefore(5); got != 16*time.Second {
+		t.Errorf("uncapped exponential backoff: expected 16s, got %v", got)
+	}
+
+	jittered := retryPolicy{delay: 10 * time.Second, backoff: retryBackoffFixed, jitter: 50}
+	for range 100 {
+		if got := jittered.delayBefore(1); got < 5*time.Second || got > 10*time.Second {
+			t.Fatalf("jittered delay %v outside [5s, 10s]", got)
+		}
+	}
+
+	// Without a cap, the backoff of a late retry approaches the largest
+	// duration; the jitter must neither overflow nor panic.
+	huge := retryPolicy{delay: time.Second, backoff: retryBackoffExponential, jitter: 100}
+	limit := retryPolicy{delay: time.Second, backoff: retryBackoffExponential}.delayBefore(1000)
+	for range 100 {
+		if got := huge.delayBefore(1000); got < 0 || got > limit {
+			t.Fatalf("jittered delay %v outside [0, %v]", got, limit)
+		}
+	}
+}
+
+func TestValidateRetryOn(t *testing.T) {
+	if err := validateRetryOn([]string{retryOnUnreachable, retryOnTimeout}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validateRetryOn([]string{"sometimes"}); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("expected ErrInvalidParameter, got %v", err)
+	}
+}
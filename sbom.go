@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// cycloneDXSpecVersion is the CycloneDX version of the SBOM written for
+// sbom-file.
+const cycloneDXSpecVersion = "1.5"
+
+// cycloneDXBOM is the root of a CycloneDX JSON document.
+type cycloneDXBOM struct {
+	BOMFormat    string               `json:"bomFormat"`
+	SpecVersion  string               `json:"specVersion"`
+	SerialNumber string               `json:"serialNumber"`
+	Version      int                  `json:"version"`
+	Metadata     cycloneDXMetadata    `json:"metadata"`
+	Components   []cycloneDXComponent `json:"components"`
+}
+
+// cycloneDXMetadata records when and by what the SBOM was written.
+type cycloneDXMetadata struct {
+	Timestamp string `json:"timestamp"`
+	Tools     struct {
+		Components []cycloneDXComponent `json:"components"`
+	} `json:"tools"`
+}
+
+// cycloneDXComponent is ansible-core or one collection or role.
+type cycloneDXComponent struct {
+	Type               string               `json:"type"`
+	BOMRef             string               `json:"bom-ref,omitempty"`
+	Group              string               `json:"group,omitempty"`
+	Name               string               `json:"name"`
+	Version            string               `json:"version,omitempty"`
+	Purl               string               `json:"purl,omitempty"`
+	Licenses           []cycloneDXLicense   `json:"licenses,omitempty"`
+	Hashes             []cycloneDXHash      `json:"hashes,omitempty"`
+	ExternalReferences []cycloneDXReference `json:"externalReferences,omitempty"`
+	Properties         []cycloneDXProperty  `json:"properties,omitempty"`
+}
+
+// cycloneDXLicense names a license as the package declares it; Galaxy does
+// not guarantee SPDX identifiers, so they are not written as ids.
+type cycloneDXLicense struct {
+	License struct {
+		Name string `json:"name"`
+	} `json:"license"`
+}
+
+// cycloneDXHash is the digest of a component.
+type cycloneDXHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+// cycloneDXReference points at where a component was downloaded from.
+type cycloneDXReference struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+// cycloneDXProperty is a name-value pair without a CycloneDX field of its own.
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// writeSBOMFile writes a CycloneDX SBOM of ansible-core and the collections
+// and roles in g's install paths to path.
+func writeSBOMFile(ctx context.Context, path string, g *galaxyInstall) error {
+	version, err := galaxyVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("could not write SBOM: %w", err)
+	}
+	packages, err := g.installedContent()
+	if err != nil {
+		return fmt.Errorf("could not write SBOM: %w", err)
+	}
+	if len(packages) == 0 {
+		collections, roles := g.installedPaths()
+		log.Printf("Warning: no collections or roles found in %s or %s; the SBOM lists only ansible-core", collections, roles)
+	}
+	bom, err := buildSBOM(ansibleCoreVersion(version), packages, time.Now())
+	if err != nil {
+		return fmt.Errorf("could not write SBOM: %w", err)
+	}
+	data, err := json.MarshalIndent(bom, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not write SBOM: %w", err)
+	}
+	if err := writeArtifactFile(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("could not write SBOM: %w", err)
+	}
+	log.Printf("SBOM of ansible-core %s and %d collection(s) and role(s) written to %s", ansibleCoreVersion(version), len(packages), path)
+	return nil
+}
+
+// ansibleCoreVersion extracts the version from the first line of
+// "ansible-galaxy --version", e.g. "2.17.1" from "ansible-galaxy [core 2.17.1]".
+func ansibleCoreVersion(line string) string {
+	_, version, ok := strings.Cut(line, "[core ")
+	if !ok {
+		return ""
+	}
+	version, _, _ = strings.Cut(version, "]")
+	return strings.TrimSpace(version)
+}
+
+// buildSBOM describes ansible-core and every installed package as CycloneDX
+// components, reading each package's license, source and file hash.
+func buildSBOM(coreVersion string, packages []installedPackage, now time.Time) (cycloneDXBOM, error) {
+	serial, err := newUUID()
+	if err != nil {
+		return cycloneDXBOM{}, err
+	}
+	bom := cycloneDXBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  cycloneDXSpecVersion,
+		SerialNumber: "urn:uuid:" + serial,
+		Version:      1,
+		Components:   []cycloneDXComponent{},
+	}
+	bom.Metadata.Timestamp = now.UTC().Format(time.RFC3339)
+	bom.Metadata.Tools.Components = []cycloneDXComponent{{Type: "application", Group: "arillso", Name: "action.playbook"}}
+
+	if coreVersion != "" {
+		bom.Components = append(bom.Components, cycloneDXComponent{
+			Type:    "framework",
+			BOMRef:  "pkg:pypi/ansible-core@" + coreVersion,
+			Name:    "ansible-core",
+			Version: coreVersion,
+			Purl:    "pkg:pypi/ansible-core@" + coreVersion,
+		})
+	}
+	for _, p := range packages {
+		hash, err := hashPackage(p.Dir)
+		if err != nil {
+			return cycloneDXBOM{}, fmt.Errorf("failed to hash %s: %w", p.Dir, err)
+		}
+		component := cycloneDXComponent{
+			Type:       "library",
+			BOMRef:     strings.TrimSuffix(p.Kind, "s") + ":" + p.Name + "@" + p.Version,
+			Name:       p.Name,
+			Version:    p.Version,
+			Hashes:     []cycloneDXHash{{Alg: "SHA-256", Content: hash}},
+			Properties: []cycloneDXProperty{{Name: "ansible:content-type", Value: strings.TrimSuffix(p.Kind, "s")}},
+		}
+		if p.Kind == galaxyLockCollections {
+			component.Group, component.Name, _ = strings.Cut(p.Name, ".")
+		}
+		for _, name := range packageLicenses(p) {
+			var l cycloneDXLicense
+			l.License.Name = name
+			component.Licenses = append(component.Licenses, l)
+		}
+		if url := packageSource(p); url != "" {
+			component.ExternalReferences = []cycloneDXReference{{Type: "distribution", URL: url}}
+		}
+		bom.Components = append(bom.Components, component)
+	}
+	return bom, nil
+}
+
+// packageLicenses returns the licenses a collection declares in its
+// MANIFEST.json or galaxy.yml, or a role in its meta/main.yml.
+func packageLicenses(p installedPackage) []string {
+	if p.Kind == galaxyLockRoles {
+		return readYAMLList(filepath.Join(p.Dir, "meta", "main.yml"), "license")
+	}
+	// #nosec G304 -- the manifest lies in the collections install path.
+	data, err := os.ReadFile(filepath.Join(p.Dir, "MANIFEST.json"))
+	if err != nil {
+		return readYAMLList(filepath.Join(p.Dir, "galaxy.yml"), "license")
+	}
+	var manifest struct {
+		CollectionInfo struct {
+			License []string `json:"license"`
+		} `json:"collection_info"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil
+	}
+	return manifest.CollectionInfo.License
+}
+
+// packageLicenseFile returns the license_file a collection declares in its
+// MANIFEST.json or galaxy.yml instead of, or besides, license identifiers. Roles
+// have no such key.
+func packageLicenseFile(p installedPackage) string {
+	if p.Kind != galaxyLockCollections {
+		return ""
+	}
+	// #nosec G304 -- the manifest lies in the collections install path.
+	data, err := os.ReadFile(filepath.Join(p.Dir, "MANIFEST.json"))
+	if err != nil {
+		if file := readYAMLList(filepath.Join(p.Dir, "galaxy.yml"), "license_file"); len(file) == 1 {
+			return file[0]
+		}
+		return ""
+	}
+	var manifest struct {
+		CollectionInfo struct {
+			LicenseFile string `json:"license_file"`
+		} `json:"collection_info"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return ""
+	}
+	return manifest.CollectionInfo.LicenseFile
+}
+
+// packageSource returns the URL a collection was downloaded from, falling
+// back to its Galaxy server. ansible-galaxy records neither for roles.
+func packageSource(p installedPackage) string {
+	if p.Kind != galaxyLockCollections {
+		return ""
+	}
+	info := filepath.Join(filepath.Dir(filepath.Dir(p.Dir)), p.Name+"-"+p.Version+".info", "GALAXY.yml")
+	if url := readFlatYAMLValue(info, "download_url"); url != "" {
+		return url
+	}
+	return p.Source
+}
+
+// hashPackage returns a SHA-256 over the relative path and content hash of
+// every file in dir, in path order. Files ansible-galaxy or Python write after
+// the install, such as .galaxy_install_info and __pycache__, are left out, so
+// the hash only changes with the content.
+func hashPackage(dir string) (string, error) {
+	var lines []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == "__pycache__" {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() || d.Name() == ".galaxy_install_info" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, filepath.ToSlash(rel)+"\x00"+sum+"\n")
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	slices.Sort(lines)
+	h := sha256.New()
+	for _, line := range lines {
+		_, _ = io.WriteString(h, line)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile returns the hex SHA-256 of a file's content.
+func hashFile(path string) (string, error) {
+	// #nosec G304 -- the file lies in an install path of ansible-galaxy.
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readYAMLList returns the value of the first key of that name in a YAML file,
+// at any indentation, as a list: a scalar, a flow list such as [MIT, BSD] or
+// the block list below the key. It returns nil if the file or key is missing.
+func readYAMLList(path, key string) []string {
+	// #nosec G304 -- the file lies in an install path of ansible-galaxy.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		v, ok := strings.CutPrefix(strings.TrimSpace(line), key+":")
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(stripYAMLComment(v))
+		if inner, ok := strings.CutPrefix(v, "["); ok {
+			var values []string
+			for _, item := range strings.Split(strings.TrimSuffix(inner, "]"), ",") {
+				if item = strings.Trim(strings.TrimSpace(item), `'"`); item != "" {
+					values = append(values, item)
+				}
+			}
+			return values
+		}
+		if v != "" {
+			return []string{strings.Trim(v, `'"`)}
+		}
+		var values []string
+		for _, next := range lines[i+1:] {
+			next = strings.TrimSpace(next)
+			if next == "" || strings.HasPrefix(next, "#") {
+				continue
+			}
+			item, ok := strings.CutPrefix(next, "- ")
+			if !ok {
+				break
+			}
+			values = append(values, strings.Trim(strings.TrimSpace(stripYAMLComment(item)), `'"`))
+		}
+		return values
+	}
+	return nil
+}
+
+// newUUID returns a random (version 4) UUID for the SBOM's serial number.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate a serial number: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
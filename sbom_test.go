@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writePackageFile writes a file into an installed package, creating its
+// directory.
+func writePackageFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	createTempFile(t, dir, name, content)
+}
+
+func TestAnsibleCoreVersion(t *testing.T) {
+	for in, want := range map[string]string{
+		"ansible-galaxy [core 2.17.1]": "2.17.1",
+		"ansible-galaxy 2.9.27":        "",
+	} {
+		if got := ansibleCoreVersion(in); got != want {
+			t.Errorf("ansibleCoreVersion(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestReadYAMLList(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		data string
+		want []string
+	}{
+		{"galaxy_info:\n  author: acme\n  license: MIT  # see LICENSE\n", []string{"MIT"}},
+		{"license: [GPL-3.0-or-later, 'BSD-2-Clause']\n", []string{"GPL-3.0-or-later", "BSD-2-Clause"}},
+		{"license:\n  - GPL-3.0-or-later\n\n  - \"Apache-2.0\"\nlicense_file: ''\n", []string{"GPL-3.0-or-later", "Apache-2.0"}},
+		{"license_file: COPYING\n", nil},
+	} {
+		path := createTempFile(t, dir, "meta.yml", tt.data)
+		if got := readYAMLList(path, "license"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.data, got, tt.want)
+		}
+	}
+	if got := readYAMLList(filepath.Join(dir, "missing.yml"), "license"); got != nil {
+		t.Errorf("expected nil for a missing file, got %q", got)
+	}
+}
+
+func TestInstalledPackages_SourceCheckout(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "ansible_collections", "acme", "tools")
+	writePackageFile(t, dir, "galaxy.yml", "namespace: acme\nname: tools\nversion: 1.2.0\nlicense:\n  - MIT\nlicense_file: LICENSE\n")
+
+	got, err := installedPackages(root, filepath.Join(root, "roles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Name != "acme.tools" || got[0].Version != "1.2.0" || got[0].Dir != dir {
+		t.Fatalf("unexpected packages: %+v", got)
+	}
+	if licenses := packageLicenses(got[0]); !reflect.DeepEqual(licenses, []string{"MIT"}) {
+		t.Errorf("unexpected licenses: %q", licenses)
+	}
+	if file := packageLicenseFile(got[0]); file != "LICENSE" {
+		t.Errorf("unexpected license file: %q", file)
+	}
+}
+
+func TestBuildSBOM(t *testing.T) {
+	root := t.TempDir()
+	installFakeContent(t, root,
+		map[string]string{"community.general": "8.6.0"},
+		map[string]string{"geerlingguy.docker": "7.1.0"})
+	collection := filepath.Join(root, "collections", "ansible_collections", "community", "general")
+	writePackageFile(t, collection, "MANIFEST.json", `{"collection_info": {"namespace": "community", "name": "general", "version": "8.6.0", "license": ["GPL-3.0-or-later"]}}`)
+	info := filepath.Join(root, "collections", "ansible_collections", "community.general-8.6.0.info")
+	writePackageFile(t, info, "GALAXY.yml", "download_url: https://galaxy.ansible.com/download/community-general-8.6.0.tar.gz\nserver: https://galaxy.ansible.com/api/\n")
+	role := filepath.Join(root, "roles", "geerlingguy.docker")
+	writePackageFile(t, filepath.Join(role, "meta"), "main.yml", "galaxy_info:\n  role_name: docker\n  license: \"MIT\"\n")
+
+	packages, err := installedPackages(filepath.Join(root, "collections"), filepath.Join(root, "roles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bom, err := buildSBOM("2.17.1", packages, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bom.BOMFormat != "CycloneDX" || bom.SpecVersion != "1.5" || bom.Metadata.Timestamp != "2026-01-02T03:04:05Z" {
+		t.Errorf("unexpected header: %+v", bom)
+	}
+	if !regexp.MustCompile(`^urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(bom.SerialNumber) {
+		t.Errorf("unexpected serial number %q", bom.SerialNumber)
+	}
+	if len(bom.Components) != 3 {
+		t.Fatalf("expected ansible-core, a collection and a role, got %+v", bom.Components)
+	}
+
+	core, coll, r := bom.Components[0], bom.Components[1], bom.Components[2]
+	if core.Name != "ansible-core" || core.Version != "2.17.1" || core.Purl != "pkg:pypi/ansible-core@2.17.1" {
+		t.Errorf("unexpected ansible-core component: %+v", core)
+	}
+	if coll.Group != "community" || coll.Name != "general" || coll.Version != "8.6.0" || coll.BOMRef != "collection:community.general@8.6.0" {
+		t.Errorf("unexpected collection component: %+v", coll)
+	}
+	if len(coll.Licenses) != 1 || coll.Licenses[0].License.Name != "GPL-3.0-or-later" {
+		t.Errorf("unexpected collection licenses: %+v", coll.Licenses)
+	}
+	if len(coll.ExternalReferences) != 1 || coll.ExternalReferences[0].URL != "https://galaxy.ansible.com/download/community-general-8.6.0.tar.gz" {
+		t.Errorf("unexpected collection source: %+v", coll.ExternalReferences)
+	}
+	if r.Name != "geerlingguy.docker" || r.Version != "7.1.0" || len(r.Licenses) != 1 || r.Licenses[0].License.Name != "MIT" || r.ExternalReferences != nil {
+		t.Errorf("unexpected role component: %+v", r)
+	}
+	if len(r.Hashes) != 1 || r.Hashes[0].Alg != "SHA-256" || len(r.Hashes[0].Content) != 64 {
+		t.Errorf("unexpected role hashes: %+v", r.Hashes)
+	}
+}
+
+func TestHashPackage(t *testing.T) {
+	dir := t.TempDir()
+	writePackageFile(t, filepath.Join(dir, "tasks"), "main.yml", "- debug: msg=hi\n")
+	writePackageFile(t, filepath.Join(dir, "meta"), ".galaxy_install_info", "install_date: today\n")
+	first, err := hashPackage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Install metadata and bytecode do not change the hash; content does.
+	writePackageFile(t, filepath.Join(dir, "meta"), ".galaxy_install_info", "install_date: tomorrow\n")
+	writePackageFile(t, filepath.Join(dir, "plugins", "__pycache__"), "x.pyc", "bytecode")
+	if again, _ := hashPackage(dir); again != first {
+		t.Error("expected install metadata and __pycache__ to be ignored")
+	}
+	writePackageFile(t, filepath.Join(dir, "tasks"), "main.yml", "- debug: msg=bye\n")
+	if changed, _ := hashPackage(dir); changed == first {
+		t.Error("expected changed content to change the hash")
+	}
+}
+
+func TestWriteSBOMFile(t *testing.T) {
+	entry := t.TempDir()
+	installFakeContent(t, entry, map[string]string{"ansible.posix": "1.5.4"}, nil)
+	fakeGalaxyVersion(t, "ansible-galaxy [core 2.17.1]", "")
+	path := filepath.Join(t.TempDir(), "reports", "sbom.cdx.json")
+
+	if err := writeSBOMFile(context.Background(), path, &galaxyInstall{entry: entry}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bom cycloneDXBOM
+	if err := json.Unmarshal(data, &bom); err != nil {
+		t.Fatalf("SBOM is not valid JSON: %v", err)
+	}
+	if len(bom.Components) != 2 || bom.Components[1].Name != "posix" || bom.Components[1].Version != "1.5.4" {
+		t.Errorf("unexpected components: %+v", bom.Components)
+	}
+}
+
+func TestWriteSBOMFile_NothingInstalled(t *testing.T) {
+	dir := t.TempDir()
+	fakeGalaxyVersion(t, "ansible-galaxy [core 2.17.1]", "")
+	path := filepath.Join(dir, "sbom.cdx.json")
+	g := &galaxyInstall{file: createTempFile(t, dir, "requirements.yml", "roles:\n  - geerlingguy.docker\n"), entry: filepath.Join(dir, "empty")}
+	if err := writeSBOMFile(context.Background(), path, g); err == nil || !strings.Contains(err.Error(), "no installed Galaxy content found") {
+		t.Errorf("expected missing content to fail the SBOM, got %v", err)
+	}
+
+	// Without requirements, an empty SBOM is written.
+	g.file = ""
+	if err := writeSBOMFile(context.Background(), path, g); err != nil {
+		t.Fatal(err)
+	}
+}
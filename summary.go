@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	ansible "github.com/arillso/go.ansible/v2"
+)
+
+// summarySlowestTasks is the number of tasks listed in the "Slowest Tasks"
+// section of the step summary.
+const summarySlowestTasks = 5
+
+// summaryMessageLimit caps the length of a single failure message in the step
+// summary so one noisy module result cannot blow up the page.
+const summaryMessageLimit = 500
+
+// writeStepSummary writes a markdown summary to $GITHUB_STEP_SUMMARY.
+func writeStepSummary(playbooks []string, execErr error, duration time.Duration, report *runReport) {
+	summaryFile := os.Getenv("GITHUB_STEP_SUMMARY")
+	if summaryFile == "" {
+		return
+	}
+
+	// The path comes from $GITHUB_STEP_SUMMARY, set by the Actions runner; 0644
+	// is required so the runner can read the file back. The matching gosec
+	// rules are excluded in .golangci.yml.
+	f, err := os.OpenFile(summaryFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Warning: could not write step summary: %v", err)
+		return
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := fmt.Fprint(f, renderStepSummary(playbooks, execErr, duration, report)); err != nil {
+		log.Printf("Warning: could not write step summary: %v", err)
+	}
+}
+
+// renderStepSummary builds the markdown step summary: the overview table
+// followed, when report holds data, by the per-host recap, the attempts of a
+// retried run, failed tasks, the idempotence check, drift, the plan,
+// unreachable hosts, Ansible errors, deduplicated warnings, slowest tasks, the
+// installed Python packages and — on failure — the output tail.
+func renderStepSummary(playbooks []string, execErr error, duration time.Duration, report *runReport) string {
+	// Inside a table cell, a pipe ends the cell even in a code span.
+	spans := make([]string, len(playbooks))
+	for i, p := range playbooks {
+		spans[i] = codeSpan(strings.ReplaceAll(p, "|", `\|`))
+	}
+	playbookList := strings.Join(spans, ", ")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "## Ansible Playbook Results\n\n| | |\n|---|---|\n| **Playbooks** | %s |\n| **Status** | %s |\n| **Duration** | %s |\n",
+		playbookList, summaryStatus(execErr), formatDuration(duration))
+	if report == nil {
+		return b.String()
+	}
+	if g := report.galaxyRecord(); g != nil {
+		fmt.Fprintf(&b, "| **Galaxy install** | %s |\n", galaxySummary(g))
+	}
+	pip := report.pipRecord()
+	if pip != nil {
+		fmt.Fprintf(&b, "| **Python requirements** | %s |\n", pipSummary(pip))
+	}
+
+	writeHostRecap(&b, report)
+
+	if attempts := report.attemptHistory(); len(attempts) > 1 {
+		b.WriteString("\n### Attempts\n\n| Attempt | Result | Exit code | Failure | Duration |\n|---:|---|---:|---|---:|\n")
+		for i, a := range attempts {
+			result, class := "✅ Success", "—"
+			if a.ExitCode != 0 {
+				result = "❌ Failed"
+				class = "other"
+			}
+			if a.Class != "" {
+				class = a.Class
+			}
+			fmt.Fprintf(&b, "| %d | %s | %d | %s | %s |\n", i+1, result, a.ExitCode, class, formatDuration(a.Duration))
+		}
+	}
+
+	if failures := report.failedTasks(); len(failures) > 0 {
+		b.WriteString("\n### Failed Tasks\n\n")
+		b.WriteString("| Host | Task | Module | Message |\n|---|---|---|---|\n")
+		for _, ft := range failures {
+			task := ft.Task
+			if ft.Item != "" {
+				task += " (item=" + ft.Item + ")"
+			}
+			module := "—"
+			if ft.Module != "" {
+				module = "`" + markdownCell(ft.Module) + "`"
+			}
+			fmt.Fprintf(&b, "| `%s` | %s | %s | %s |\n",
+				markdownCell(ft.Host), markdownCell(task), module, markdownCell(truncate(ft.Msg, summaryMessageLimit)))
+		}
+	}
+
+	if changes, checked := report.idempotence(); checked {
+		b.WriteString("\n### Idempotence\n\n")
+		if len(changes) == 0 {
+			b.WriteString("✅ The second run reported no changes.\n")
+		} else {
+			fmt.Fprintf(&b, "❌ %d task result(s) changed on the second run:\n\n", len(changes))
+			writeChangesTable(&b, changes)
+		}
+	}
+
+	if changes, checked := report.drift(); checked {
+		b.WriteString("\n### Drift\n\n")
+		if len(changes) == 0 {
+			b.WriteString("✅ No drift: check mode reported no changes.\n")
+		} else {
+			icon := "⚠️"
+			if errors.Is(execErr, ErrDriftDetected) {
+				icon = "❌"
+			}
+			fmt.Fprintf(&b, "%s %d task result(s) on %d host(s) would change:\n\n", icon, len(changes), len(hostsOf(changes)))
+			writeChangesTable(&b, changes)
+		}
+	}
+
+	if plan := report.planSummary(); plan != nil {
+		hosts := len(hostsOf(plan.Changes))
+		b.WriteString("\n### Plan\n\n")
+		switch {
+		case plan.Mode == modeApply:
+			fmt.Fprintf(&b, "✅ Plan `%s` from commit `%s` verified: %d change(s) expected on %d host(s).\n",
+				markdownCell(plan.File), shortSHA(plan.GitSHA), len(plan.Changes), hosts)
+		case len(plan.Changes) == 0:
+			fmt.Fprintf(&b, "Plan written to `%s`: no changes expected.\n", markdownCell(plan.File))
+		default:
+			fmt.Fprintf(&b, "Plan written to `%s`: %d change(s) expected on %d host(s).\n",
+				markdownCell(plan.File), len(plan.Changes), hosts)
+		}
+		if len(plan.Changes) > 0 {
+			b.WriteString("\n")
+			writeChangesTable(&b, plan.Changes)
+		}
+	}
+
+	if unreachable := report.unreachableHosts(); len(unreachable) > 0 {
+		errs := report.unreachableErrors()
+		b.WriteString("\n### Unreachable Hosts\n\n")
+		for _, host := range unreachable {
+			if msg := errs[host]; msg != "" {
+				fmt.Fprintf(&b, "- `%s`: %s\n", markdownCell(host), markdownCell(truncate(msg, summaryMessageLimit)))
+			} else {
+				fmt.Fprintf(&b, "- `%s`\n", markdownCell(host))
+			}
+		}
+	}
+
+	if errs := report.diagnosticsOf(diagnosticError); len(errs) > 0 {
+		b.WriteString("\n### Errors\n\n")
+		for _, d := range errs {
+			location := ""
+			if d.File != "" {
+				location = fmt.Sprintf(" (`%s:%d`)", markdownCell(annotationPath(d.File)), d.Line)
+			}
+			fmt.Fprintf(&b, "- %s%s\n", markdownCell(truncate(d.Msg, summaryMessageLimit)), location)
+		}
+	}
+
+	if warnings := report.diagnosticsOf(diagnosticWarning, diagnosticDeprecation); len(warnings) > 0 {
+		b.WriteString("\n### Warnings\n\n")
+		for _, d := range warnings {
+			prefix := ""
+			if d.Kind == diagnosticDeprecation {
+				prefix = "**Deprecation:** "
+			}
+			count := ""
+			if d.Count > 1 {
+				count = fmt.Sprintf(" (×%d)", d.Count)
+			}
+			fmt.Fprintf(&b, "- %s%s%s\n", prefix, markdownCell(truncate(d.Msg, summaryMessageLimit)), count)
+		}
+	}
+
+	if slowest := report.slowestTasks(summarySlowestTasks); len(slowest) > 0 {
+		b.WriteString("\n### Slowest Tasks\n\n| Task | Play | Duration |\n|---|---|---:|\n")
+		for _, t := range slowest {
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", markdownCell(t.Task), markdownCell(t.Play), formatDuration(t.Duration))
+		}
+	}
+
+	if pip != nil && len(pip.Packages) > 0 {
+		fmt.Fprintf(&b, "\n<details>\n<summary>Python packages (%d)</summary>\n\n| Package | Version |\n|---|---|\n", len(pip.Packages))
+		for _, pkg := range pip.Packages {
+			fmt.Fprintf(&b, "| `%s` | %s |\n", markdownCell(pkg.Name), markdownCell(pkg.Version))
+		}
+		b.WriteString("\n</details>\n")
+	}
+
+	if tail := report.outputTail(); execErr != nil && len(tail) > 0 {
+		fmt.Fprintf(&b, "\n<details>\n<summary>Ansible output (last %d lines)</summary>\n\n````text\n%s\n````\n\n</details>\n",
+			len(tail), strings.Join(tail, "\n"))
+	}
+
+	return b.String()
+}
+
+// writeChangesTable writes a table of changed tasks. Play and task are shown
+// as "—" when only the recap was available.
+func writeChangesTable(b *strings.Builder, changes []taskChange) {
+	b.WriteString("| Host | Play | Task |\n|---|---|---|\n")
+	for _, ch := range changes {
+		play, task := "—", "—"
+		if ch.Play != "" {
+			play = markdownCell(ch.Play)
+		}
+		if ch.Task != "" {
+			task = markdownCell(ch.Task)
+		}
+		fmt.Fprintf(b, "| `%s` | %s | %s |\n", markdownCell(ch.Host), play, task)
+	}
+}
+
+// galaxySummary describes the Galaxy install in one table cell.
+func galaxySummary(g *galaxyPhase) string {
+	s := formatDuration(g.Duration)
+	if g.CacheHit {
+		return s + " (cached)"
+	}
+	if g.Attempts > 1 {
+		s += fmt.Sprintf(" (%d attempts)", g.Attempts)
+	}
+	if g.Failed {
+		s = "❌ " + s
+	}
+	return s
+}
+
+// pipSummary describes the pip install in one table cell.
+func pipSummary(p *pipPhase) string {
+	s := formatDuration(p.Duration)
+	if p.Failed {
+		return "❌ " + s
+	}
+	s += fmt.Sprintf(", %d package(s)", len(p.Packages))
+	if p.CacheHit {
+		s += " (cached)"
+	}
+	return s
+}
+
+// summaryStatus describes the outcome of the run in one line.
+func summaryStatus(execErr error) string {
+	switch {
+	case execErr == nil:
+		return "✅ Success"
+	case errors.Is(execErr, ErrCancelled):
+		return "🛑 Cancelled"
+	case errors.Is(execErr, ErrTimedOut):
+		var te *timeoutError
+		if errors.As(execErr, &te) {
+			return fmt.Sprintf("⏱️ Timed out (%s)", te)
+		}
+		return "⏱️ Timed out"
+	}
+	var ansibleErr *ansible.AnsibleError
+	if errors.As(execErr, &ansibleErr) {
+		return fmt.Sprintf("❌ Failed (exit code %d)", ansibleErr.ExitCode)
+	}
+	return fmt.Sprintf("❌ Failed: %v", execErr)
+}
+
+// writeHostRecap writes the "Host Recap" section, if report knows any hosts.
+func writeHostRecap(b *strings.Builder, report *runReport) {
+	hosts := report.hosts()
+	if len(hosts) == 0 {
+		return
+	}
+	stats := report.hostStats()
+	b.WriteString("\n### Host Recap\n\n")
+	b.WriteString("| Host | OK | Changed | Unreachable | Failed | Skipped | Rescued | Ignored |\n")
+	b.WriteString("|---|---:|---:|---:|---:|---:|---:|---:|\n")
+	for _, host := range hosts {
+		writeRecapRow(b, "`"+markdownCell(host)+"`", stats[host])
+	}
+	writeRecapRow(b, "**Total**", report.totals())
+}
+
+// writeRecapRow writes one row of the host recap table.
+func writeRecapRow(b *strings.Builder, label string, s hostStats) {
+	fmt.Fprintf(b, "| %s | %d | %d | %d | %d | %d | %d | %d |\n",
+		label, s.Ok, s.Changed, s.Unreachable, s.Failed, s.Skipped, s.Rescued, s.Ignored)
+}
+
+// markdownCell escapes s for use inside a markdown table cell: pipes are
+// escaped, HTML is neutralised and newlines become <br>.
+func markdownCell(s string) string {
+	s = strings.NewReplacer(
+		"|", `\|`,
+		"<", "&lt;",
+		">", "&gt;",
+		"`", "'",
+		"\r\n", "<br>",
+		"\n", "<br>",
+	).Replace(s)
+	return strings.TrimSpace(s)
+}
+
+// truncate shortens s to at most limit runes, marking the cut with "…".
+func truncate(s string, limit int) string {
+	r := []rune(s)
+	if len(r) <= limit {
+		return s
+	}
+	return string(r[:limit]) + "…"
+}
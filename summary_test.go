@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	ansible "github.com/arillso/go.ansible/v2"
+)
+
+func TestRenderStepSummary_FullReport(t *testing.T) {
+	report := newRunReport()
+	report.recordStats("web1", hostStats{Ok: 4, Changed: 1})
+	report.recordStats("web2", hostStats{Ok: 1, Failed: 1})
+	report.recordStats("db1", hostStats{Unreachable: 1})
+	report.recordFailure(taskFailure{Host: "web2", Task: "Install | nginx", Module: "ansible.builtin.apt", Msg: "line one\n<b>line two</b>"})
+	report.recordUnreachable("db1", "Failed to connect to the host via ssh")
+	report.recordTiming(taskTiming{Play: "all", Task: "Install | nginx", Duration: 75 * time.Second})
+	report.appendTail("fatal: [web2]: FAILED!")
+
+	summary := renderStepSummary([]string{"site.yml"}, &ansible.AnsibleError{ExitCode: 2}, time.Minute, report)
+
+	for _, want := range []string{
+		"### Host Recap",
+		"| `web1` | 4 | 1 | 0 | 0 | 0 | 0 | 0 |",
+		"| **Total** | 5 | 1 | 1 | 1 | 0 | 0 | 0 |",
+		"### Failed Tasks",
+		"| `web2` | Install \\| nginx | `ansible.builtin.apt` | line one<br>&lt;b&gt;line two&lt;/b&gt; |",
+		"### Unreachable Hosts",
+		"- `db1`: Failed to connect to the host via ssh",
+		"### Slowest Tasks",
+		"| Install \\| nginx | all | 1m 15s |",
+		"<details>",
+		"fatal: [web2]: FAILED!",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("expected %q in summary, got:\n%s", want, summary)
+		}
+	}
+}
+
+func TestRenderStepSummary_SuccessOmitsOutputTail(t *testing.T) {
+	report := newRunReport()
+	report.recordStats("web1", hostStats{Ok: 1})
+	report.appendTail("PLAY RECAP ***")
+
+	summary := renderStepSummary([]string{"site.yml"}, nil, time.Second, report)
+	if strings.Contains(summary, "<details>") {
+		t.Errorf("expected no output tail on success, got:\n%s", summary)
+	}
+	for _, section := range []string{"### Failed Tasks", "### Unreachable Hosts"} {
+		if strings.Contains(summary, section) {
+			t.Errorf("expected no %q section without data, got:\n%s", section, summary)
+		}
+	}
+}
+
+func TestRenderStepSummary_PlaybookNames(t *testing.T) {
+	summary := renderStepSummary([]string{"a|b.yml", "c`d.yml"}, nil, time.Second, newRunReport())
+	if want := "| **Playbooks** | `a\\|b.yml`, ``c`d.yml`` |\n"; !strings.Contains(summary, want) {
+		t.Errorf("expected %q in summary, got:\n%s", want, summary)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if got := truncate("héllo wörld", 5); got != "héllo…" {
+		t.Errorf("unexpected truncation: %q", got)
+	}
+	if got := truncate("short", 10); got != "short" {
+		t.Errorf("expected short string unchanged, got %q", got)
+	}
+}
+
+func TestRenderStepSummary_Diagnostics(t *testing.T) {
+	report := newRunReport()
+	report.recordDiagnostic(diagnostic{Kind: diagnosticError, Msg: "bad syntax", File: "site.yml", Line: 4})
+	report.recordDiagnostic(diagnostic{Kind: diagnosticWarning, Msg: "no hosts matched"})
+	report.recordDiagnostic(diagnostic{Kind: diagnosticWarning, Msg: "no hosts matched"})
+	report.recordDiagnostic(diagnostic{Kind: diagnosticDeprecation, Msg: "old option"})
+
+	summary := renderStepSummary([]string{"site.yml"}, errors.New("exit 4"), time.Second, report)
+	for _, want := range []string{
+		"### Errors\n\n- bad syntax (`site.yml:4`)\n",
+		"### Warnings\n\n- no hosts matched (×2)\n- **Deprecation:** old option\n",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("expected %q in summary, got:\n%s", want, summary)
+		}
+	}
+}
+
+func TestRenderStepSummary_Idempotence(t *testing.T) {
+	report := newRunReport()
+	report.recordIdempotence([]taskChange{
+		{Host: "web1", Play: "Web", Task: "Render | config"},
+		{Host: "db1"},
+	})
+	summary := renderStepSummary([]string{"site.yml"}, ErrNotIdempotent, time.Minute, report)
+	for _, want := range []string{
+		"### Idempotence",
+		"❌ 2 task result(s) changed on the second run:",
+		"| `web1` | Web | Render \\| config |",
+		"| `db1` | — | — |",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("expected %q in summary, got:\n%s", want, summary)
+		}
+	}
+
+	clean := newRunReport()
+	clean.recordIdempotence(nil)
+	if summary := renderStepSummary([]string{"site.yml"}, nil, time.Minute, clean); !strings.Contains(summary, "✅ The second run reported no changes.") {
+		t.Errorf("expected a passed idempotence check, got:\n%s", summary)
+	}
+	if summary := renderStepSummary([]string{"site.yml"}, nil, time.Minute, newRunReport()); strings.Contains(summary, "Idempotence") {
+		t.Errorf("expected no idempotence section without a check, got:\n%s", summary)
+	}
+}
+
+func TestRenderStepSummary_Drift(t *testing.T) {
+	report := newRunReport()
+	report.recordDrift([]taskChange{{Host: "web1", Play: "Web", Task: "Render config"}})
+
+	if summary := renderStepSummary([]string{"site.yml"}, nil, time.Minute, report); !strings.Contains(summary, "⚠️ 1 task result(s) on 1 host(s) would change:") {
+		t.Errorf("expected a drift warning, got:\n%s", summary)
+	}
+	summary := renderStepSummary([]string{"site.yml"}, ErrDriftDetected, time.Minute, report)
+	for _, want := range []string{"### Drift", "❌ 1 task result(s) on 1 host(s) would change:", "| `web1` | Web | Render config |"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("expected %q in summary, got:\n%s", want, summary)
+		}
+	}
+
+	clean := newRunReport()
+	clean.recordDrift(nil)
+	if summary := renderStepSummary([]string{"site.yml"}, nil, time.Minute, clean); !strings.Contains(summary, "✅ No drift: check mode reported no changes.") {
+		t.Errorf("expected no drift, got:\n%s", summary)
+	}
+}
+
+func TestRenderStepSummary_Plan(t *testing.T) {
+	report := newRunReport()
+	report.recordPlan(planSummary{Mode: modePlan, File: "plan.json", Changes: []taskChange{{Host: "web1", Play: "Web", Task: "Render config"}}})
+	summary := renderStepSummary([]string{"site.yml"}, nil, time.Minute, report)
+	for _, want := range []string{"### Plan", "Plan written to `plan.json`: 1 change(s) expected on 1 host(s).", "| `web1` | Web | Render config |"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("expected %q in summary, got:\n%s", want, summary)
+		}
+	}
+
+	applied := newRunReport()
+	applied.recordPlan(planSummary{Mode: modeApply, File: "plan.json", GitSHA: "0123456789abcdef", Changes: []taskChange{}})
+	if summary := renderStepSummary([]string{"site.yml"}, nil, time.Minute, applied); !strings.Contains(summary, "✅ Plan `plan.json` from commit `0123456789ab` verified: 0 change(s) expected on 0 host(s).") {
+		t.Errorf("expected a verified plan, got:\n%s", summary)
+	}
+}
+
+func TestRenderStepSummary_Attempts(t *testing.T) {
+	report := newRunReport()
+	report.recordAttempt(attemptRecord{ExitCode: 4, Class: retryOnUnreachable, Duration: 90 * time.Second})
+	report.recordAttempt(attemptRecord{ExitCode: 1, Duration: 5 * time.Second})
+	report.reset()
+	report.recordAttempt(attemptRecord{Duration: 80 * time.Second})
+
+	summary := renderStepSummary([]string{"site.yml"}, nil, 3*time.Minute, report)
+	for _, want := range []string{
+		"### Attempts",
+		"| 1 | ❌ Failed | 4 | unreachable | 1m 30s |",
+		"| 2 | ❌ Failed | 1 | other | 5s |",
+		"| 3 | ✅ Success | 0 | — | 1m 20s |",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("expected %q in summary:\n%s", want, summary)
+		}
+	}
+
+	single := newRunReport()
+	single.recordAttempt(attemptRecord{Duration: time.Second})
+	if summary := renderStepSummary([]string{"site.yml"}, nil, time.Second, single); strings.Contains(summary, "### Attempts") {
+		t.Errorf("expected no attempts section for a single attempt:\n%s", summary)
+	}
+}
+
+func TestSummaryStatus_Interrupted(t *testing.T) {
+	if got := summaryStatus(fmt.Errorf("%w: boom", ErrCancelled)); got != "🛑 Cancelled" {
+		t.Errorf("unexpected status for a cancelled run: %q", got)
+	}
+	if got := summaryStatus(fmt.Errorf("%w: boom", ErrTimedOut)); got != "⏱️ Timed out" {
+		t.Errorf("unexpected status for a timed out run: %q", got)
+	}
+	phase := &timeoutError{phase: phasePlaybook, timeout: 10 * time.Minute}
+	if got := summaryStatus(fmt.Errorf("%w: boom", phase)); got != "⏱️ Timed out (playbook timeout of 10m 0s reached)" {
+		t.Errorf("unexpected status for a phase timeout: %q", got)
+	}
+}
+
+func TestRenderStepSummary_GalaxyInstall(t *testing.T) {
+	report := newRunReport()
+	if summary := renderStepSummary([]string{"site.yml"}, nil, time.Minute, report); strings.Contains(summary, "Galaxy install") {
+		t.Errorf("expected no Galaxy row without an install:\n%s", summary)
+	}
+
+	report.recordGalaxy(galaxyPhase{Attempts: 2, Duration: 75 * time.Second})
+	report.reset()
+	summary := renderStepSummary([]string{"site.yml"}, nil, 2*time.Minute, report)
+	if !strings.Contains(summary, "| **Duration** | 2m 0s |\n| **Galaxy install** | 1m 15s (2 attempts) |\n") {
+		t.Errorf("expected the Galaxy install in the overview:\n%s", summary)
+	}
+
+	report.recordGalaxy(galaxyPhase{Attempts: 1, Duration: 3 * time.Second, Failed: true})
+	if summary := renderStepSummary([]string{"site.yml"}, ErrGalaxyFailed, 3*time.Second, report); !strings.Contains(summary, "| **Galaxy install** | ❌ 3s |") {
+		t.Errorf("expected a failed Galaxy install:\n%s", summary)
+	}
+}
+
+func TestRenderStepSummary_PipInstall(t *testing.T) {
+	report := newRunReport()
+	report.recordPip(pipPhase{Duration: 20 * time.Second, CacheHit: true, Packages: []pythonPackage{
+		{Name: "netaddr", Version: "1.3.0"},
+		{Name: "boto3", Version: "1.34.0"},
+	}})
+	summary := renderStepSummary([]string{"site.yml"}, nil, time.Minute, report)
+	for _, want := range []string{
+		"| **Python requirements** | 20s, 2 package(s) (cached) |\n",
+		"<summary>Python packages (2)</summary>\n\n| Package | Version |\n|---|---|\n| `netaddr` | 1.3.0 |\n| `boto3` | 1.34.0 |\n",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("expected %q in summary:\n%s", want, summary)
+		}
+	}
+
+	report.recordPip(pipPhase{Duration: 4 * time.Second, Failed: true})
+	if summary := renderStepSummary([]string{"site.yml"}, ErrPipFailed, 4*time.Second, report); !strings.Contains(summary, "| **Python requirements** | ❌ 4s |") ||
+		strings.Contains(summary, "Python packages") {
+		t.Errorf("expected a failed pip install without packages:\n%s", summary)
+	}
+}
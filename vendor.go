@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// vendoredArtifact is the archive in the vendor directory that satisfies a
+// requirement.
+type vendoredArtifact struct {
+	req     requirement
+	path    string
+	version string
+}
+
+// vendorPrefix returns the file name prefix of a requirement's archives:
+// "community-general-" for a collection, as "ansible-galaxy collection
+// download" names them, and "<role>-" for a role.
+func vendorPrefix(r requirement) string {
+	if r.Kind == galaxyLockCollections {
+		return strings.ReplaceAll(r.ref(), ".", "-") + "-"
+	}
+	return r.ref() + "-"
+}
+
+// isLocalRequirement reports whether a requirement already points at content
+// on disk, which needs no archive.
+func isLocalRequirement(r requirement) bool {
+	switch r.Type {
+	case "file", "dir", "subdirs":
+		return true
+	}
+	ref := r.ref()
+	return strings.HasPrefix(ref, "/") || strings.HasPrefix(ref, "./") || strings.HasPrefix(ref, "../") || strings.HasSuffix(ref, ".tar.gz")
+}
+
+// resolveVendored finds the archive for every requirement in dir. Roles are
+// matched by their exact version, collections by the highest version that
+// satisfies their version range. Requirements without an archive are listed
+// in the error.
+func resolveVendored(reqs []requirement, dir, file string) ([]vendoredArtifact, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read galaxy-vendor-dir: %w", err)
+	}
+	var artifacts []vendoredArtifact
+	var missing []string
+	for _, r := range reqs {
+		if isLocalRequirement(r) {
+			continue
+		}
+		if r.Kind == galaxyLockCollections && r.Type != "" && r.Type != "galaxy" {
+			missing = append(missing, fmt.Sprintf("collection %s (%s:%d) has type %q, which cannot be vendored", r.ref(), file, r.Line, r.Type))
+			continue
+		}
+		best := vendoredArtifact{req: r}
+		for _, e := range entries {
+			version, hasPrefix := strings.CutPrefix(e.Name(), vendorPrefix(r))
+			version, hasSuffix := strings.CutSuffix(version, ".tar.gz")
+			if !hasPrefix || !hasSuffix || e.IsDir() || !looksLikeVersion(version) {
+				continue
+			}
+			if !vendoredVersionMatches(r, version) {
+				continue
+			}
+			if best.path == "" || compareVersions(version, best.version) > 0 {
+				best.path, best.version = filepath.Join(dir, e.Name()), version
+			}
+		}
+		if best.path == "" {
+			want := r.Version
+			if want == "" {
+				want = "any version"
+			}
+			missing = append(missing, fmt.Sprintf("%s %s %s (%s:%d)", strings.TrimSuffix(r.Kind, "s"), r.ref(), want, file, r.Line))
+			continue
+		}
+		artifacts = append(artifacts, best)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("no vendored archive in %s for: %s", dir, strings.Join(missing, "; "))
+	}
+	return artifacts, nil
+}
+
+// looksLikeVersion reports whether the rest of an archive name is a version,
+// so that community-general-extras-1.0.0.tar.gz is not taken for a release of
+// community.general.
+func looksLikeVersion(s string) bool {
+	s = strings.TrimPrefix(s, "v")
+	return s != "" && s[0] >= '0' && s[0] <= '9'
+}
+
+// vendoredVersionMatches reports whether an archive's version satisfies a
+// requirement: a role's version is a Git ref or release and must match
+// exactly, a collection's version may be a range.
+func vendoredVersionMatches(r requirement, version string) bool {
+	if r.Kind == galaxyLockRoles {
+		return r.Version == "" || r.Version == version
+	}
+	if strings.HasPrefix(version, "v") {
+		return false
+	}
+	return versionMatches(version, r.Version)
+}
+
+// installedName returns the name a vendored requirement is installed and
+// locked under.
+func (a vendoredArtifact) installedName() string {
+	if a.req.Kind == galaxyLockRoles && a.req.Name != "" {
+		return a.req.Name
+	}
+	return a.req.ref()
+}
+
+// vendoredRequirements renders a requirements file that installs the
+// archives instead of the requirements they stand for, keeping the
+// signatures of collections so they are still verified. Requirements that
+// already point at local content are kept.
+func vendoredRequirements(reqs []requirement, artifacts []vendoredArtifact) ([]byte, error) {
+	byLine := make(map[int]vendoredArtifact, len(artifacts))
+	for _, a := range artifacts {
+		byLine[a.req.Line] = a
+	}
+	var b strings.Builder
+	for _, kind := range []string{galaxyLockCollections, galaxyLockRoles} {
+		fmt.Fprintf(&b, "%s:\n", kind)
+		for _, r := range reqs {
+			if r.Kind != kind {
+				continue
+			}
+			a, vendored := byLine[r.Line]
+			switch {
+			case vendored && kind == galaxyLockCollections:
+				path, err := filepath.Abs(a.path)
+				if err != nil {
+					return nil, err
+				}
+				fmt.Fprintf(&b, "  - name: %s\n    type: file\n", strconv.Quote(path))
+				writeSignatures(&b, r.Signatures)
+			case vendored:
+				path, err := filepath.Abs(a.path)
+				if err != nil {
+					return nil, err
+				}
+				name := r.Name
+				if name == "" {
+					name = r.ref()
+				}
+				fmt.Fprintf(&b, "  - src: %s\n    name: %s\n", strconv.Quote(path), strconv.Quote(name))
+			default:
+				fmt.Fprintf(&b, "  - %s: %s\n", map[string]string{galaxyLockCollections: "name", galaxyLockRoles: "src"}[kind], strconv.Quote(r.ref()))
+				if r.Name != "" && kind == galaxyLockRoles {
+					fmt.Fprintf(&b, "    name: %s\n", strconv.Quote(r.Name))
+				}
+				if r.Type != "" {
+					fmt.Fprintf(&b, "    %s: %s\n", map[string]string{galaxyLockCollections: "type", galaxyLockRoles: "scm"}[kind], strconv.Quote(r.Type))
+				}
+				writeSignatures(&b, r.Signatures)
+			}
+		}
+	}
+	return []byte(b.String()), nil
+}
+
+// writeSignatures writes the signatures of a collection entry.
+func writeSignatures(b *strings.Builder, signatures []string) {
+	if len(signatures) == 0 {
+		return
+	}
+	b.WriteString("    signatures:\n")
+	for _, sig := range signatures {
+		fmt.Fprintf(b, "      - %s\n", strconv.Quote(sig))
+	}
+}
+
+// compareVersions compares two dotted versions numerically, part by part. A
+// pre-release such as 2.0.0-beta1 sorts before its release; parts that are
+// not numbers compare as strings.
+func compareVersions(a, b string) int {
+	aCore, aPre, _ := strings.Cut(a, "-")
+	bCore, bPre, _ := strings.Cut(b, "-")
+	aParts, bParts := strings.Split(aCore, "."), strings.Split(bCore, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var x, y string
+		if i < len(aParts) {
+			x = aParts[i]
+		}
+		if i < len(bParts) {
+			y = bParts[i]
+		}
+		xn, xErr := strconv.Atoi(x)
+		yn, yErr := strconv.Atoi(y)
+		switch {
+		case (x == "" || xErr == nil) && (y == "" || yErr == nil):
+			if xn != yn {
+				return xn - yn
+			}
+		case x != y:
+			return strings.Compare(x, y)
+		}
+	}
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	return strings.Compare(aPre, bPre)
+}
+
+// versionMatches reports whether version satisfies a Galaxy version range: a
+// comma-separated list of constraints such as ">=8.0.0,<9.0.0", where a bare
+// version means "==" and "" or "*" match anything.
+func versionMatches(version, constraints string) bool {
+	if constraints == "" || constraints == "*" {
+		return true
+	}
+	for _, c := range strings.Split(constraints, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		op := c[:len(c)-len(strings.TrimLeft(c, "<>=!"))]
+		cmp := compareVersions(version, strings.TrimSpace(c[len(op):]))
+		var ok bool
+		switch op {
+		case "", "=", "==":
+			ok = cmp == 0
+		case "!=":
+			ok = cmp != 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		default:
+			return false
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
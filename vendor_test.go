@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// vendorDir creates an archive of every given name in a new directory.
+func vendorDir(t *testing.T, names ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("archive"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestResolveVendored(t *testing.T) {
+	dir := vendorDir(t,
+		"community-general-8.5.0.tar.gz",
+		"community-general-8.6.0.tar.gz",
+		"community-general-9.0.0.tar.gz",
+		"community-general-extras-10.0.0.tar.gz",
+		"geerlingguy.docker-7.1.0.tar.gz",
+		"geerlingguy.docker-7.0.0.tar.gz",
+	)
+	reqs := []requirement{
+		{Kind: galaxyLockCollections, Name: "community.general", Version: ">=8.0.0,<9.0.0", Line: 2},
+		{Kind: galaxyLockCollections, Name: "./local/acme-tools-1.0.0.tar.gz", Line: 4},
+		{Kind: galaxyLockRoles, Src: "geerlingguy.docker", Version: "7.0.0", Line: 6},
+	}
+	got, err := resolveVendored(reqs, dir, "requirements.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].version != "8.6.0" || got[1].version != "7.0.0" {
+		t.Errorf("unexpected artifacts: %+v", got)
+	}
+}
+
+func TestResolveVendored_Missing(t *testing.T) {
+	dir := vendorDir(t, "community-general-8.6.0.tar.gz")
+	reqs := []requirement{
+		{Kind: galaxyLockCollections, Name: "community.general", Version: "9.0.0", Line: 2},
+		{Kind: galaxyLockCollections, Name: "ansible.posix", Line: 3},
+		{Kind: galaxyLockCollections, Name: "https://github.com/acme/c.git", Type: "git", Line: 4},
+		{Kind: galaxyLockRoles, Src: "geerlingguy.docker", Line: 6},
+	}
+	_, err := resolveVendored(reqs, dir, "requirements.yml")
+	if err == nil {
+		t.Fatal("expected missing archives to fail")
+	}
+	for _, want := range []string{
+		"collection community.general 9.0.0 (requirements.yml:2)",
+		"collection ansible.posix any version (requirements.yml:3)",
+		`has type "git", which cannot be vendored`,
+		"role geerlingguy.docker any version (requirements.yml:6)",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestVendoredRequirements(t *testing.T) {
+	reqs := []requirement{
+		{Kind: galaxyLockCollections, Name: "community.general", Source: "https://galaxy.ansible.com", Signatures: []string{"https://example.com/general.asc"}, Line: 2},
+		{Kind: galaxyLockCollections, Name: "/opt/acme-tools-1.0.0.tar.gz", Type: "file", Line: 3},
+		{Kind: galaxyLockRoles, Src: "geerlingguy.docker", Name: "docker", Line: 5},
+	}
+	artifacts := []vendoredArtifact{
+		{req: reqs[0], path: "/vendor/community-general-8.6.0.tar.gz", version: "8.6.0"},
+		{req: reqs[2], path: "/vendor/geerlingguy.docker-7.1.0.tar.gz", version: "7.1.0"},
+	}
+	data, err := vendoredRequirements(reqs, artifacts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `collections:
+  - name: "/vendor/community-general-8.6.0.tar.gz"
+    type: file
+    signatures:
+      - "https://example.com/general.asc"
+  - name: "/opt/acme-tools-1.0.0.tar.gz"
+    type: "file"
+roles:
+  - src: "/vendor/geerlingguy.docker-7.1.0.tar.gz"
+    name: "docker"
+`
+	if string(data) != want {
+		t.Errorf("unexpected requirements:\n%s", data)
+	}
+	// The generated file must be readable by the wrapper's own parser.
+	if _, err := parseRequirements(data); err != nil {
+		t.Errorf("generated requirements do not parse: %v", err)
+	}
+}
+
+func TestWithLockedSources(t *testing.T) {
+	locked := []lockedContent{
+		{Kind: galaxyLockCollections, Name: "community.general", Version: "8.6.0", Source: "https://galaxy.ansible.com/api/"},
+		{Kind: galaxyLockCollections, Name: "ansible.posix", Version: "1.5.4", Source: "https://galaxy.ansible.com/api/"},
+		{Kind: galaxyLockRoles, Name: "docker", Version: "7.1.0"},
+	}
+	installed := []lockedContent{
+		{Kind: galaxyLockCollections, Name: "community.general", Version: "8.6.0"},
+		{Kind: galaxyLockCollections, Name: "ansible.posix", Version: "1.5.4"},
+		{Kind: galaxyLockRoles, Name: "docker", Version: "7.1.0"},
+	}
+	vendored := []vendoredArtifact{
+		{req: requirement{Kind: galaxyLockCollections, Name: "community.general"}},
+		{req: requirement{Kind: galaxyLockRoles, Src: "geerlingguy.docker", Name: "docker"}},
+	}
+
+	// A lock written online matches vendored content by name and version;
+	// content that was not vendored still has its source compared.
+	got := lockDifferences(locked, withLockedSources(installed, locked, vendored))
+	if want := []string{"collection ansible.posix comes from , locked to https://galaxy.ansible.com/api/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected differences: %q", got)
+	}
+	if installed[0].Source != "" {
+		t.Error("expected the installed content not to be modified")
+	}
+	installed[0].Version = "8.7.0"
+	if got := lockDifferences(locked, withLockedSources(installed, locked, vendored)); len(got) != 2 {
+		t.Errorf("expected a changed vendored version to differ, got %q", got)
+	}
+}
+
+func TestVersionMatches(t *testing.T) {
+	for _, tt := range []struct {
+		version, constraints string
+		want                 bool
+	}{
+		{"8.6.0", "", true},
+		{"8.6.0", "*", true},
+		{"8.6.0", "8.6.0", true},
+		{"8.6.0", "==8.6.1", false},
+		{"8.6.0", ">=8.0.0,<9.0.0", true},
+		{"9.0.0", ">=8.0.0,<9.0.0", false},
+		{"8.10.0", ">8.9.0", true},
+		{"8.6.0", "!=8.6.0", false},
+		{"2.0.0-beta1", "<2.0.0", true},
+	} {
+		if got := versionMatches(tt.version, tt.constraints); got != tt.want {
+			t.Errorf("versionMatches(%q, %q) = %v, want %v", tt.version, tt.constraints, got, tt.want)
+		}
+	}
+}
+
+func TestInstallGalaxyRequirements_Vendored(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "requirements.yml")
+	if err := os.WriteFile(file, []byte("collections:\n  - name: community.general\n    version: 8.6.0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	vendor := vendorDir(t, "community-general-8.6.0.tar.gz")
+	logFile := fakeGalaxy(t, `while [ $# -gt 0 ]; do if [ "$1" = -r ]; then cat "$2" >> `+filepath.Join(dir, "installed.yml")+`; fi; shift; done`)
+
+	g := &galaxyInstall{file: file, vendorDir: vendor, offline: true}
+	if err := installGalaxyRequirements(context.Background(), g, retryPolicy{}, nil, 0, false, newRunReport()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	calls, _ := os.ReadFile(logFile)
+	if !strings.Contains(string(calls), "collection install -r ") || !strings.Contains(string(calls), "--offline") || strings.Contains(string(calls), "-r "+file) {
+		t.Errorf("expected an offline install from a generated file:\n%s", calls)
+	}
+	installed, _ := os.ReadFile(filepath.Join(dir, "installed.yml"))
+	if !strings.Contains(string(installed), filepath.Join(vendor, "community-general-8.6.0.tar.gz")) {
+		t.Errorf("expected the archive to be installed:\n%s", installed)
+	}
+	if _, err := os.Stat(g.requirements); !os.IsNotExist(err) {
+		t.Errorf("expected the generated file to be removed, got %v", err)
+	}
+}